@@ -4,6 +4,7 @@ import (
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
 	"github.com/freedreamer82/mqtt-shell/internal/pkg/bundle"
+	"github.com/freedreamer82/mqtt-shell/internal/pkg/config"
 	"github.com/freedreamer82/mqtt-shell/internal/pkg/constant"
 	"github.com/freedreamer82/mqtt-shell/internal/pkg/locale"
 	"github.com/freedreamer82/mqtt-shell/internal/pkg/screens"
@@ -19,7 +20,7 @@ func main() {
 	window.SetIcon(bundle.ResourceMqttShellMidResolutionPng)
 	window.Resize(fyne.NewSize(constant.MainWindowW, constant.MainWindowH))
 
-	app := screens.NewMainScreen(myApp, window)
+	app := screens.NewMainScreen(myApp, window, config.DefaultConfigFile())
 
 	window.SetContent(app.GetContainer())
 
@@ -6,6 +6,8 @@ import (
 	"github.com/freedreamer82/mqtt-shell/internal/pkg/config"
 	"github.com/freedreamer82/mqtt-shell/internal/pkg/logging"
 	"github.com/freedreamer82/mqtt-shell/pkg/info"
+	"os"
+	"strings"
 
 	"github.com/alecthomas/kong"
 	"github.com/rotisserie/eris"
@@ -36,7 +38,7 @@ func main() {
 	}
 	logrus.SetFormatter(formatter)
 
-	conf, err := config.Parse(v, CLI.ConfigFile, &CLI)
+	conf, err := config.Parse(v, config.CommandConfigFile(ctx.Command(), CLI.ConfigFile), &CLI)
 	if err != nil {
 		log.Panicf("Failed to parse configuration file: %s", eris.ToString(err, true))
 		return
@@ -51,6 +53,9 @@ func main() {
 	if CLI.Verbose {
 		conf.Logging.Level = log.TraceLevel
 	}
+	if mqttshell.IsStdoutStream(conf) {
+		conf.Logging.ToStderr = true
+	}
 	logging.Setup(&conf.Logging)
 
 	mqttOpts, errOpts := mqttshell.BuildMqttOpts(conf)
@@ -61,10 +66,18 @@ func main() {
 
 	if ctx.Command() == "server" {
 		mqttshell.RunServer(mqttOpts, conf)
-	} else if ctx.Command() == "client" {
-		mqttshell.RunClient(mqttOpts, conf)
+	} else if strings.HasPrefix(ctx.Command(), "client") {
+		errClient := mqttshell.RunClient(mqttOpts, conf)
+		if errClient != nil {
+			fmt.Println(errClient.Error())
+			os.Exit(1)
+		}
 	} else if ctx.Command() == "beacon" {
-		mqttshell.RunBeacon(mqttOpts, conf)
+		errBeacon := mqttshell.RunBeacon(mqttOpts, conf)
+		if errBeacon != nil {
+			fmt.Println(errBeacon.Error())
+			os.Exit(1)
+		}
 		return
 	} else if ctx.Command() == "copy local-2-remote" {
 		mqttshell.RunCopyLocalToRemote(mqttOpts, conf)
@@ -72,6 +85,55 @@ func main() {
 	} else if ctx.Command() == "copy remote-2-local" {
 		mqttshell.RunCopyRemoteToLocal(mqttOpts, conf)
 		return
+	} else if strings.HasPrefix(ctx.Command(), "fs ") {
+		errFs := mqttshell.RunFs(mqttOpts, conf, ctx.Command())
+		if errFs != nil {
+			fmt.Println(errFs.Error())
+			os.Exit(1)
+		}
+		return
+	} else if ctx.Command() == "sync" {
+		errSync := mqttshell.RunSync(mqttOpts, conf)
+		if errSync != nil {
+			fmt.Println(errSync.Error())
+			os.Exit(1)
+		}
+		return
+	} else if ctx.Command() == "transfers" {
+		errTransfers := mqttshell.RunTransfers(mqttOpts, conf)
+		if errTransfers != nil {
+			fmt.Println(errTransfers.Error())
+			os.Exit(1)
+		}
+		return
+	} else if ctx.Command() == "multicast" {
+		errMulticast := mqttshell.RunMulticast(mqttOpts, conf)
+		if errMulticast != nil {
+			fmt.Println(errMulticast.Error())
+			os.Exit(1)
+		}
+		return
+	} else if ctx.Command() == "sftp" {
+		errSftp := mqttshell.RunSftp(mqttOpts, conf)
+		if errSftp != nil {
+			fmt.Println(errSftp.Error())
+			os.Exit(1)
+		}
+		return
+	} else if ctx.Command() == "forward" {
+		errForward := mqttshell.RunForward(mqttOpts, conf)
+		if errForward != nil {
+			fmt.Println(errForward.Error())
+			os.Exit(1)
+		}
+		return
+	} else if ctx.Command() == "socks" {
+		errSocks := mqttshell.RunSocks(mqttOpts, conf)
+		if errSocks != nil {
+			fmt.Println(errSocks.Error())
+			os.Exit(1)
+		}
+		return
 	}
 
 	select {} //wait forever
@@ -25,6 +25,7 @@ require (
 	github.com/freedreamer82/go-console v1.0.1
 	github.com/helloyi/go-sshclient v1.2.0
 	github.com/olekukonko/tablewriter v1.0.4
+	github.com/pkg/sftp v1.13.5
 	golang.org/x/crypto v0.38.0
 
 )
@@ -63,7 +64,6 @@ require (
 	github.com/olekukonko/errors v1.1.0 // indirect
 	github.com/olekukonko/ll v0.0.6-0.20250511102614-9564773e9d27 // indirect
 	github.com/pelletier/go-toml/v2 v2.2.4 // indirect
-	github.com/pkg/sftp v1.13.5 // indirect
 	github.com/pmezard/go-difflib v1.0.1-0.20181226105442-5d4384ee4fb2 // indirect
 	github.com/reiver/go-oi v1.0.0 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
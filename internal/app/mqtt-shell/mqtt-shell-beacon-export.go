@@ -0,0 +1,167 @@
+package mqtt_shell
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttchat"
+	log "github.com/sirupsen/logrus"
+)
+
+// exportInventory writes the servers as an inventory for other tools, one group for
+// every label key=value.
+func exportInventory(clients []mqttchat.Client, format string) error {
+	clients = safeInventoryClients(clients)
+	switch format {
+	case "ansible":
+		return exportAnsible(os.Stdout, clients)
+	case "ssh-config":
+		return exportSshConfig(os.Stdout, clients)
+	case "json":
+		return exportJson(os.Stdout, clients)
+	}
+	return errors.New(fmt.Sprintf("unknown export format %s", format))
+}
+
+// unsafeInventoryRegexp matches whitespace and control characters, which would let a value
+// received from the network start a new line, or a new directive, of the inventory.
+var unsafeInventoryRegexp = regexp.MustCompile(`[\s\p{C}]`)
+
+// sshHostRegexp are the characters of ids and addresses written in a ssh config, no patterns.
+var sshHostRegexp = regexp.MustCompile(`^[A-Za-z0-9._:%-]+$`)
+
+func checkInventoryClient(c mqttchat.Client) error {
+	h := hostOf(c)
+	if !sshHostRegexp.MatchString(c.Id) {
+		return errors.New("id not valid")
+	} else if !sshHostRegexp.MatchString(c.Ip) {
+		return errors.New("ip not valid")
+	} else if unsafeInventoryRegexp.MatchString(c.Version) {
+		return errors.New("version not valid")
+	} else if unsafeInventoryRegexp.MatchString(h.Hostname) {
+		return errors.New("hostname not valid")
+	}
+	for k, v := range h.Labels {
+		if k == "" || unsafeInventoryRegexp.MatchString(k) || unsafeInventoryRegexp.MatchString(v) {
+			return errors.New("labels not valid")
+		}
+	}
+	return nil
+}
+
+// safeInventoryClients skips the servers whose beacon carries values which cannot be
+// written safely in an inventory.
+func safeInventoryClients(clients []mqttchat.Client) []mqttchat.Client {
+	safe := make([]mqttchat.Client, 0, len(clients))
+	for _, c := range clients {
+		if err := checkInventoryClient(c); err != nil {
+			log.Warnf("server %q not exported: %s", c.Id, err.Error())
+			continue
+		}
+		safe = append(safe, c)
+	}
+	return safe
+}
+
+// inventoryGroups maps every label key=value to the ids of the servers having it.
+func inventoryGroups(clients []mqttchat.Client) map[string][]string {
+	groups := make(map[string][]string)
+	for _, c := range clients {
+		for k, v := range hostOf(c).Labels {
+			group := k + "=" + v
+			groups[group] = append(groups[group], c.Id)
+		}
+	}
+	return groups
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var ansibleGroupRegexp = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// ansibleGroup turns a label key=value in a valid group name, site=milan-1 is site_milan_1.
+func ansibleGroup(label string) string {
+	return ansibleGroupRegexp.ReplaceAllString(label, "_")
+}
+
+// yamlString quotes s, a json string is a valid yaml scalar.
+func yamlString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// exportAnsible writes a yaml inventory.
+func exportAnsible(w io.Writer, clients []mqttchat.Client) error {
+	fmt.Fprintln(w, "all:")
+	fmt.Fprintln(w, "  hosts:")
+	for _, c := range clients {
+		h := hostOf(c)
+		fmt.Fprintf(w, "    %s:\n", yamlString(c.Id))
+		fmt.Fprintf(w, "      ansible_host: %s\n", yamlString(c.Ip))
+		fmt.Fprintf(w, "      mqtt_shell_version: %s\n", yamlString(c.Version))
+		if h.Hostname != "" {
+			fmt.Fprintf(w, "      mqtt_shell_hostname: %s\n", yamlString(h.Hostname))
+		}
+	}
+	groups := inventoryGroups(clients)
+	if len(groups) == 0 {
+		return nil
+	}
+	fmt.Fprintln(w, "  children:")
+	for _, label := range sortedKeys(groups) {
+		fmt.Fprintf(w, "    %s:\n", ansibleGroup(label))
+		fmt.Fprintln(w, "      hosts:")
+		for _, id := range groups[label] {
+			fmt.Fprintf(w, "        %s: {}\n", yamlString(id))
+		}
+	}
+	return nil
+}
+
+// exportSshConfig writes a Host block for every server, with its version as comment.
+func exportSshConfig(w io.Writer, clients []mqttchat.Client) error {
+	for _, c := range clients {
+		fmt.Fprintf(w, "# mqtt-shell %s\n", c.Version)
+		fmt.Fprintf(w, "Host %s\n", c.Id)
+		fmt.Fprintf(w, "    HostName %s\n\n", c.Ip)
+	}
+	return nil
+}
+
+type inventoryHostJson struct {
+	Ip       string            `json:"ip"`
+	Version  string            `json:"version"`
+	Hostname string            `json:"hostname,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+type inventoryJson struct {
+	Hosts  map[string]inventoryHostJson `json:"hosts"`
+	Groups map[string][]string          `json:"groups"`
+}
+
+func exportJson(w io.Writer, clients []mqttchat.Client) error {
+	inventory := inventoryJson{Hosts: make(map[string]inventoryHostJson), Groups: inventoryGroups(clients)}
+	for _, c := range clients {
+		h := hostOf(c)
+		inventory.Hosts[c.Id] = inventoryHostJson{Ip: c.Ip, Version: c.Version, Hostname: h.Hostname, Labels: h.Labels}
+	}
+	b, err := json.MarshalIndent(inventory, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
@@ -0,0 +1,253 @@
+package mqtt_shell
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/freedreamer82/mqtt-shell/internal/pkg/config"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttchat"
+	log "github.com/sirupsen/logrus"
+)
+
+func RunBeacon(mqttOpts *MQTT.ClientOptions, conf *config.Config) error {
+	filter, err := mqttchat.NewBeaconFilter(conf.Beacon.MatchId, conf.Beacon.MatchVersion, conf.Beacon.Subnet,
+		conf.Beacon.Selector)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Starting beacon discovery..")
+	discovery := mqttchat.NewBeaconDiscovery(mqttOpts, conf.BeaconRequestTopic,
+		conf.BeaconResponseTopic, conf.TimeoutBeaconSec,
+		conf.Topics.BeaconConverter)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if conf.Beacon.Watch {
+		watchBeacons(discovery.Watch(ctx), filter, conf.Beacon.Format)
+		return nil
+	}
+
+	clients, err := discovery.Discover(ctx, filter)
+	if err != nil && ctx.Err() == nil {
+		return err
+	}
+	sortClients(clients, conf.Beacon.Sort, conf.Beacon.Reverse)
+	warnCollisions(clients)
+	if conf.Beacon.Export != "" {
+		return exportInventory(clients, conf.Beacon.Export)
+	}
+	return printClients(clients, conf.Beacon.Format)
+}
+
+func printClients(clients []mqttchat.Client, format string) error {
+	switch format {
+	case "json":
+		return printJson(clients)
+	case "jsonl":
+		for _, c := range clients {
+			b, err := json.Marshal(c)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+		}
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"id", "ip", "version", "time", "uptime", "hostname", "os", "arch", "labels", "conflicts"})
+		for _, c := range clients {
+			h := hostOf(c)
+			w.Write([]string{c.Id, c.Ip, c.Version, c.Time, c.Uptime, h.Hostname, h.Os, h.Arch, mqttchat.FormatLabels(h.Labels),
+				strings.Join(c.Conflicts, " ")})
+		}
+		w.Flush()
+		return w.Error()
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tIP\tVERSION\tTIME\tUPTIME\tHOSTNAME\tOS\tLABELS")
+		for _, c := range clients {
+			h := hostOf(c)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.Id, c.Ip, c.Version, c.Time, formatUptime(c.Uptime),
+				h.Hostname, formatOs(h), mqttchat.FormatLabels(h.Labels))
+		}
+		return w.Flush()
+	}
+	return nil
+}
+
+// warnCollisions reports the ids used by more than one server.
+func warnCollisions(clients []mqttchat.Client) {
+	for _, c := range clients {
+		if len(c.Conflicts) > 0 {
+			log.Warnf("ID COLLISION: %d servers are running with id %s (instances %s %s)", len(c.Conflicts)+1, c.Id,
+				c.Uuid, strings.Join(c.Conflicts, " "))
+		}
+	}
+}
+
+// sortClients orders the servers by the given field, then by id.
+func sortClients(clients []mqttchat.Client, by string, reverse bool) {
+	sort.SliceStable(clients, func(i, j int) bool {
+		a, b := clients[i], clients[j]
+		if reverse {
+			a, b = b, a
+		}
+		cmp := 0
+		switch by {
+		case "ip":
+			cmp = compareIps(a.Ip, b.Ip)
+		case "version":
+			cmp = compareVersions(a.Version, b.Version)
+		case "uptime":
+			ua, _ := time.ParseDuration(a.Uptime)
+			ub, _ := time.ParseDuration(b.Uptime)
+			if ua < ub {
+				cmp = -1
+			} else if ua > ub {
+				cmp = 1
+			}
+		}
+		if cmp == 0 {
+			return a.Id < b.Id
+		}
+		return cmp < 0
+	})
+}
+
+func compareIps(a string, b string) int {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return strings.Compare(a, b)
+	}
+	return bytes.Compare(ipA.To16(), ipB.To16())
+}
+
+// compareVersions compares dotted versions numerically where both parts are numbers.
+func compareVersions(a string, b string) int {
+	split := func(r rune) bool { return r == '.' || r == '-' || r == '+' }
+	partsA, partsB := strings.FieldsFunc(a, split), strings.FieldsFunc(b, split)
+	for i := 0; i < len(partsA) && i < len(partsB); i++ {
+		na, errA := strconv.Atoi(partsA[i])
+		nb, errB := strconv.Atoi(partsB[i])
+		if errA == nil && errB == nil {
+			if na != nb {
+				return na - nb
+			}
+		} else if cmp := strings.Compare(partsA[i], partsB[i]); cmp != 0 {
+			return cmp
+		}
+	}
+	return len(partsA) - len(partsB)
+}
+
+type watchedNode struct {
+	client mqttchat.Client
+	online bool
+	since  time.Time
+}
+
+// beaconEventJson is a line of the jsonl output of --watch.
+type beaconEventJson struct {
+	Event mqttchat.EventType `json:"event"`
+	mqttchat.Client
+}
+
+// watchBeacons shows the changes of presence of the servers matching filter.
+func watchBeacons(events <-chan mqttchat.Event, filter *mqttchat.BeaconFilter, format string) {
+	nodes := make(map[string]*watchedNode)
+	for ev := range events {
+		online := ev.Type == mqttchat.Event_Online
+		n, exist := nodes[ev.Client.Id]
+		if !exist {
+			n = &watchedNode{client: ev.Client, online: online, since: time.Now()}
+		} else if n.online != online {
+			n.since = time.Now()
+		}
+		n.online = online
+		// offline beacons carry no ip, the last known one is kept
+		if online {
+			n.client = ev.Client
+		} else {
+			n.client.Conflicts = ev.Client.Conflicts
+		}
+		if !filter.Match(n.client) {
+			delete(nodes, ev.Client.Id)
+			continue
+		}
+		nodes[ev.Client.Id] = n
+
+		if format == "jsonl" {
+			b, err := json.Marshal(beaconEventJson{Event: ev.Type, Client: n.client})
+			if err == nil {
+				fmt.Println(string(b))
+			}
+		} else {
+			drawBeaconTable(nodes)
+		}
+	}
+}
+
+func drawBeaconTable(nodes map[string]*watchedNode) {
+	ids := make([]string, 0, len(nodes))
+	online := 0
+	for id, n := range nodes {
+		ids = append(ids, id)
+		if n.online {
+			online++
+		}
+	}
+	sort.Strings(ids)
+
+	// clear the screen and go home
+	fmt.Print("\033[H\033[2J")
+	fmt.Printf("%s - %d online, %d offline\n\n", time.Now().Format(time.DateTime), online, len(nodes)-online)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tID\tIP\tVERSION\tUPTIME\tSINCE")
+	for _, id := range ids {
+		n := nodes[id]
+		status, uptime := "offline", "-"
+		if n.online {
+			status, uptime = "online", formatUptime(n.client.Uptime)
+		}
+		if len(n.client.Conflicts) > 0 {
+			status = fmt.Sprintf("COLLISION(%d)", len(n.client.Conflicts)+1)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", status, id, n.client.Ip, n.client.Version, uptime, n.since.Format(time.TimeOnly))
+	}
+	w.Flush()
+}
+
+// hostOf returns the host of c, empty for the servers not sending it.
+func hostOf(c mqttchat.Client) mqttchat.HostInfo {
+	if c.Host == nil {
+		return mqttchat.HostInfo{}
+	}
+	return *c.Host
+}
+
+func formatOs(h mqttchat.HostInfo) string {
+	if h.Os == "" {
+		return ""
+	}
+	return h.Os + "/" + h.Arch
+}
+
+func formatUptime(uptime string) string {
+	d, err := time.ParseDuration(uptime)
+	if err != nil {
+		return uptime
+	}
+	return fmt.Sprintf("%d days %02d:%02d", int(d.Hours())/24, int(d.Hours())%24, int(d.Minutes())%60)
+}
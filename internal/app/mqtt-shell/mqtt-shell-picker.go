@@ -0,0 +1,302 @@
+package mqtt_shell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/chzyer/readline"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/freedreamer82/mqtt-shell/internal/pkg/config"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttchat"
+)
+
+// pickerEntry is a server in the list of the picker, online or used recently.
+type pickerEntry struct {
+	client mqttchat.Client
+	online bool
+	// a recent server has no beacon until discovered
+	seen bool
+	// position in the recent servers, -1 if never used
+	recent int
+	score  int
+}
+
+// serverPicker is a fuzzy searchable list of the servers, filled while they are discovered.
+type serverPicker struct {
+	mutex   sync.Mutex
+	fd      int
+	out     io.Writer
+	entries map[string]*pickerEntry
+	query   []rune
+	shown   []*pickerEntry
+	cursor  int
+	// lines of the last draw, to go back and redraw
+	lines int
+}
+
+func brokerKey(conf *config.Config) string {
+	return fmt.Sprintf("%s:%d", conf.Broker, conf.BrokerPort)
+}
+
+// PickServer lets the user choose the server among the ones online and the recent ones.
+func PickServer(mqttOpts *MQTT.ClientOptions, conf *config.Config) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !readline.IsTerminal(fd) {
+		return "", errors.New("ID is necessary in client Mode without a terminal to choose the server")
+	}
+
+	p := serverPicker{fd: fd, out: os.Stdout, entries: make(map[string]*pickerEntry)}
+	for i, r := range loadRecentServers(brokerKey(conf)) {
+		p.entries[r.Id] = &pickerEntry{client: mqttchat.Client{Id: r.Id}, recent: i}
+	}
+
+	state, err := readline.MakeRaw(fd)
+	if err != nil {
+		return "", err
+	}
+	defer readline.Restore(fd, state)
+
+	discovery := mqttchat.NewBeaconDiscovery(mqttOpts, conf.BeaconRequestTopic, conf.BeaconResponseTopic,
+		conf.TimeoutBeaconSec, conf.Topics.BeaconConverter)
+	ctx, cancel := context.WithCancel(context.Background())
+	events := discovery.Watch(ctx)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for ev := range events {
+			p.update(ev)
+		}
+	}()
+
+	p.mutex.Lock()
+	p.refresh()
+	p.draw()
+	p.mutex.Unlock()
+	id, err := p.run(os.Stdin)
+
+	cancel()
+	<-done
+	p.clear()
+	return id, err
+}
+
+// run reads the keys until a server is chosen or the picker is cancelled.
+func (p *serverPicker) run(in io.Reader) (string, error) {
+	buf := make([]byte, 64)
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		p.mutex.Lock()
+		id, chosen, err := p.key(buf[:n])
+		if !chosen && err == nil {
+			p.draw()
+		}
+		p.mutex.Unlock()
+		if chosen || err != nil {
+			return id, err
+		}
+	}
+}
+
+func (p *serverPicker) key(b []byte) (string, bool, error) {
+	switch k := string(b); {
+	case k == "\x03" || k == "\x1b":
+		return "", false, errors.New("no server chosen")
+	case k == "\r" || k == "\n":
+		if len(p.shown) == 0 {
+			return "", false, nil
+		}
+		return p.shown[p.cursor].client.Id, true, nil
+	case k == "\x7f" || k == "\b":
+		if len(p.query) > 0 {
+			p.query = p.query[:len(p.query)-1]
+			p.cursor = 0
+		}
+	case k == "\x15":
+		p.query = p.query[:0]
+		p.cursor = 0
+	case k == "\x1b[A" || k == "\x1bOA" || k == "\x10":
+		if p.cursor > 0 {
+			p.cursor--
+		}
+	case k == "\x1b[B" || k == "\x1bOB" || k == "\x0e" || k == "\t":
+		if p.cursor < len(p.shown)-1 {
+			p.cursor++
+		}
+	case b[0] != '\x1b':
+		for len(b) > 0 {
+			r, size := utf8.DecodeRune(b)
+			if unicode.IsPrint(r) {
+				p.query = append(p.query, r)
+				p.cursor = 0
+			}
+			b = b[size:]
+		}
+	}
+	p.refresh()
+	return "", false, nil
+}
+
+// update applies a change of presence coming from the discovery.
+func (p *serverPicker) update(ev mqttchat.Event) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	e, exist := p.entries[ev.Client.Id]
+	if !exist {
+		e = &pickerEntry{client: ev.Client, recent: -1}
+		p.entries[ev.Client.Id] = e
+	}
+	e.online, e.seen = ev.Type == mqttchat.Event_Online, true
+	if e.online {
+		e.client = ev.Client
+	}
+
+	// keep the cursor on the same server
+	selected := ""
+	if p.cursor < len(p.shown) {
+		selected = p.shown[p.cursor].client.Id
+	}
+	p.refresh()
+	for i, s := range p.shown {
+		if s.client.Id == selected {
+			p.cursor = i
+		}
+	}
+	p.draw()
+}
+
+// refresh filters and orders the entries by the query.
+func (p *serverPicker) refresh() {
+	query := []rune(strings.ToLower(string(p.query)))
+	p.shown = p.shown[:0]
+	for _, e := range p.entries {
+		if !e.online && e.recent < 0 {
+			continue
+		}
+		h := hostOf(e.client)
+		text := strings.ToLower(strings.Join([]string{e.client.Id, e.client.Ip, h.Hostname, mqttchat.FormatLabels(h.Labels)}, " "))
+		score, ok := fuzzyScore([]rune(text), query)
+		if !ok {
+			continue
+		}
+		e.score = score
+		p.shown = append(p.shown, e)
+	}
+	sort.Slice(p.shown, func(i, j int) bool {
+		a, b := p.shown[i], p.shown[j]
+		if a.score != b.score {
+			return a.score < b.score
+		} else if (a.recent >= 0) != (b.recent >= 0) {
+			return a.recent >= 0
+		} else if a.recent != b.recent {
+			return a.recent < b.recent
+		}
+		return a.client.Id < b.client.Id
+	})
+	if p.cursor >= len(p.shown) {
+		p.cursor = max(len(p.shown)-1, 0)
+	}
+}
+
+// fuzzyScore tells if all the runes of query are in text in the same order, the score
+// is the position of the first match plus the gaps between the matches.
+func fuzzyScore(text []rune, query []rune) (int, bool) {
+	if len(query) == 0 {
+		return 0, true
+	}
+	first, q := -1, 0
+	for i, r := range text {
+		if r != query[q] {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		q++
+		if q == len(query) {
+			return i - len(query) + 1, true
+		}
+	}
+	return 0, false
+}
+
+func (p *serverPicker) draw() {
+	width, height, err := readline.GetSize(p.fd)
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+
+	var b strings.Builder
+	p.rewind(&b)
+	lines := []string{"server> " + string(p.query) + "_"}
+
+	rows := max(height-3, 1)
+	top := 0
+	if p.cursor >= rows {
+		top = p.cursor - rows + 1
+	}
+	idWidth := 2
+	for _, e := range p.shown {
+		idWidth = max(idWidth, utf8.RuneCountInString(e.client.Id))
+	}
+	for i := top; i < len(p.shown) && i < top+rows; i++ {
+		e := p.shown[i]
+		mark, recent := "  ", " "
+		if i == p.cursor {
+			mark = "> "
+		}
+		if e.recent >= 0 {
+			recent = "*"
+		}
+		status := "-"
+		if e.online {
+			status = formatUptime(e.client.Uptime)
+		} else if e.seen {
+			status = "offline"
+		}
+		line := fmt.Sprintf("%s%s %-*s  %-15s  %-12s  %s", mark, recent, idWidth, e.client.Id, e.client.Ip, status,
+			mqttchat.FormatLabels(hostOf(e.client).Labels))
+		lines = append(lines, line)
+	}
+	lines = append(lines, fmt.Sprintf("%d servers, * recent - up/down to move, enter to connect, esc to cancel", len(p.shown)))
+
+	for i, line := range lines {
+		if utf8.RuneCountInString(line) >= width {
+			line = string([]rune(line)[:width-1])
+		}
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(line)
+	}
+	p.lines = len(lines) - 1
+	fmt.Fprint(p.out, b.String())
+}
+
+// rewind moves back to the first line of the last draw and clears down from there.
+func (p *serverPicker) rewind(b *strings.Builder) {
+	if p.lines > 0 {
+		fmt.Fprintf(b, "\033[%dA", p.lines)
+	}
+	b.WriteString("\r\033[J")
+}
+
+func (p *serverPicker) clear() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var b strings.Builder
+	p.rewind(&b)
+	p.lines = 0
+	fmt.Fprint(p.out, b.String())
+}
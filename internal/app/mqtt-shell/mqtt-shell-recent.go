@@ -0,0 +1,82 @@
+package mqtt_shell
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const maxRecentServers = 10
+
+// recentServer is a server the client connected to, remembered for the picker.
+type recentServer struct {
+	Id     string    `json:"id"`
+	Broker string    `json:"broker"`
+	Time   time.Time `json:"time"`
+}
+
+func recentServersFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "mqtt-shell", "recent.json"), nil
+}
+
+func readRecentServers() []recentServer {
+	recent := []recentServer{}
+	file, err := recentServersFile()
+	if err != nil {
+		return recent
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return recent
+	}
+	json.Unmarshal(b, &recent)
+	return recent
+}
+
+// loadRecentServers returns the servers used on broker, the last one first.
+func loadRecentServers(broker string) []recentServer {
+	recent := []recentServer{}
+	for _, r := range readRecentServers() {
+		if r.Broker == broker {
+			recent = append(recent, r)
+		}
+	}
+	return recent
+}
+
+// saveRecentServer moves id on top of the recent servers of broker.
+func saveRecentServer(id string, broker string) error {
+	file, err := recentServersFile()
+	if err != nil {
+		return err
+	}
+
+	recent := []recentServer{{Id: id, Broker: broker, Time: time.Now()}}
+	perBroker := 1
+	for _, r := range readRecentServers() {
+		if r.Broker == broker && r.Id == id {
+			continue
+		} else if r.Broker == broker {
+			if perBroker == maxRecentServers {
+				continue
+			}
+			perBroker++
+		}
+		recent = append(recent, r)
+	}
+
+	b, err := json.MarshalIndent(recent, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, b, 0600)
+}
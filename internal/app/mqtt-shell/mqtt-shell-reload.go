@@ -0,0 +1,223 @@
+package mqtt_shell
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/freedreamer82/mqtt-shell/internal/pkg/config"
+	"github.com/freedreamer82/mqtt-shell/internal/pkg/logging"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttchat"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqtttunnel"
+	"github.com/freedreamer82/mqtt-shell/pkg/plugins/sshbridge"
+	"github.com/freedreamer82/mqtt-shell/pkg/plugins/telnetbridge"
+	log "github.com/sirupsen/logrus"
+)
+
+// runningServer are the services of a server, reconfigured when the config file is reloaded.
+type runningServer struct {
+	// started is the config the server started with, conf the last one applied
+	started *config.Config
+	conf    *config.Config
+	chat    *mqttchat.MqttServerChat
+	cp      *mqttcp.MqttServerCp
+	tunnel  *mqtttunnel.MqttServerTunnel
+	telnet  mqttchat.MqttSeverChatPlugin
+	ssh     mqttchat.MqttSeverChatPlugin
+}
+
+// cpSettings are the cp settings loaded from files, checked before applying any change.
+type cpSettings struct {
+	publisherKey ed25519.PublicKey
+	jail         *mqttcp.PathJail
+}
+
+func loadCpSettings(conf *config.Config) (cpSettings, error) {
+	settings := cpSettings{}
+	if conf.Cp.PublisherKey != "" {
+		key, err := mqttcp.LoadPublicKey(conf.Cp.PublisherKey)
+		if err != nil {
+			return settings, errors.New(fmt.Sprintf("invalid publisher key: %s", err.Error()))
+		}
+		settings.publisherKey = key
+	}
+	jail, err := mqttcp.NewPathJail(conf.Cp.ReadRoots, conf.Cp.WriteRoots)
+	if err != nil {
+		return settings, errors.New(fmt.Sprintf("invalid cp roots: %s", err.Error()))
+	}
+	settings.jail = jail
+	return settings, nil
+}
+
+func loadTunnelPolicy(conf *config.Config) (*mqtttunnel.TunnelPolicy, error) {
+	policy, err := mqtttunnel.NewTunnelPolicy(conf.Tunnel.Allow, conf.Tunnel.Deny)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid tunnel policy: %s", err.Error()))
+	}
+	return policy, nil
+}
+
+func (s *runningServer) applyChat(conf *config.Config) {
+	s.chat.SetInactivityTimeout(time.Duration(conf.InactivityTimeoutSec) * time.Second)
+	s.chat.SetAutoCompleteDirs(conf.AutoCompleteDirs)
+
+	// a plugin changed is replaced, its sessions are closed
+	telnet := conf.TelnetBridgePlugin
+	if s.telnet != nil && (!telnet.Enabled || telnet != s.conf.TelnetBridgePlugin) {
+		s.chat.RemovePlugin(s.telnet.PluginId())
+		s.telnet = nil
+	}
+	if telnet.Enabled && s.telnet == nil {
+		s.telnet = telnetbridge.NewTelnetBridgePlugin(telnet.MaxConnections, telnet.Keyword, s.chat.GetOutputChan())
+		s.chat.AddPlugin(s.telnet)
+	}
+	ssh := conf.SSHBridgePlugin
+	if s.ssh != nil && (!ssh.Enabled || ssh != s.conf.SSHBridgePlugin) {
+		s.chat.RemovePlugin(s.ssh.PluginId())
+		s.ssh = nil
+	}
+	if ssh.Enabled && s.ssh == nil {
+		s.ssh = sshbridge.NewSSHBridgePlugin(ssh.MaxConnections, ssh.Keyword, s.chat.GetOutputChan())
+		s.chat.AddPlugin(s.ssh)
+	}
+}
+
+func (s *runningServer) applyCp(conf *config.Config, settings cpSettings) {
+	if s.cp == nil {
+		return
+	}
+	s.cp.SetAllowMd5(conf.Cp.AllowMd5)
+	s.cp.SetPublisherKey(settings.publisherKey)
+	s.cp.SetPathJail(settings.jail)
+	s.cp.SetAllowSetOwner(conf.Cp.AllowSetOwner)
+	s.cp.SetAllowOtherTransfers(conf.Cp.AllowOtherTransfers)
+}
+
+func (s *runningServer) applyTunnel(conf *config.Config, policy *mqtttunnel.TunnelPolicy) {
+	if s.tunnel == nil {
+		return
+	}
+	s.tunnel.SetPolicy(policy)
+	s.tunnel.SetMaxConnections(conf.Tunnel.MaxConnections)
+	s.tunnel.SetGatewayPorts(conf.Tunnel.GatewayPorts)
+}
+
+// liveSettings are the settings applied on reload.
+func liveSettings(c *config.Config) map[string]interface{} {
+	return map[string]interface{}{
+		"Logging":                c.Logging,
+		"InactivityTimeoutSec":   c.InactivityTimeoutSec,
+		"AutoCompleteDirs":       c.AutoCompleteDirs,
+		"TelnetBridgePlugin":     c.TelnetBridgePlugin,
+		"SSHBridgePlugin":        c.SSHBridgePlugin,
+		"Cp.AllowMd5":            c.Cp.AllowMd5,
+		"Cp.PublisherKey":        c.Cp.PublisherKey,
+		"Cp.ReadRoots":           c.Cp.ReadRoots,
+		"Cp.WriteRoots":          c.Cp.WriteRoots,
+		"Cp.AllowSetOwner":       c.Cp.AllowSetOwner,
+		"Cp.AllowOtherTransfers": c.Cp.AllowOtherTransfers,
+		"Tunnel.Allow":           c.Tunnel.Allow,
+		"Tunnel.Deny":            c.Tunnel.Deny,
+		"Tunnel.MaxConnections":  c.Tunnel.MaxConnections,
+		"Tunnel.GatewayPorts":    c.Tunnel.GatewayPorts,
+	}
+}
+
+// restartSettings are the settings used only when the server starts.
+func restartSettings(c *config.Config) map[string]interface{} {
+	return map[string]interface{}{
+		"Broker":                     c.Broker,
+		"BrokerPort":                 c.BrokerPort,
+		"BrokerUser":                 c.BrokerUser,
+		"BrokerPassword":             c.BrokerPassword,
+		"Id":                         c.Id,
+		"Tls":                        c.Tls,
+		"Topics":                     c.Topics,
+		"Network":                    c.Network,
+		"Labels":                     c.Labels,
+		"BeaconIntervalSec":          c.BeaconIntervalSec,
+		"Cp.CpServerEnabled":         c.Cp.CpServerEnabled,
+		"Tunnel.TunnelServerEnabled": c.Tunnel.TunnelServerEnabled,
+		"SSHConsole":                 c.SSHConsole,
+	}
+}
+
+func changedSettings(before map[string]interface{}, after map[string]interface{}) []string {
+	changed := []string{}
+	for name, value := range after {
+		if !reflect.DeepEqual(before[name], value) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func setupLogging(conf *config.Config) {
+	if conf.Verbose {
+		conf.Logging.Level = log.TraceLevel
+	}
+	logging.Setup(&conf.Logging)
+}
+
+// reload parses and validates the config file again, then applies the settings which
+// do not need a restart. Nothing is applied if the new config is not valid.
+func (s *runningServer) reload() error {
+	if s.conf.ConfigFile == "" {
+		return errors.New("no config file to reload")
+	}
+	conf, err := s.conf.Reload()
+	if err != nil {
+		return err
+	}
+	err = ValidateConf("server", conf)
+	if err != nil {
+		return err
+	}
+	cp, err := loadCpSettings(conf)
+	if err != nil {
+		return err
+	}
+	policy, err := loadTunnelPolicy(conf)
+	if err != nil {
+		return err
+	}
+
+	setupLogging(conf)
+	s.applyChat(conf)
+	s.applyCp(conf, cp)
+	s.applyTunnel(conf, policy)
+	applied := changedSettings(liveSettings(s.conf), liveSettings(conf))
+	s.conf = conf
+
+	if len(applied) > 0 {
+		log.Infof("config reloaded, applied: %s", strings.Join(applied, ", "))
+	} else {
+		log.Info("config reloaded, nothing changed")
+	}
+	restart := changedSettings(restartSettings(s.started), restartSettings(conf))
+	if len(restart) > 0 {
+		log.Warnf("config reloaded, restart needed to apply: %s", strings.Join(restart, ", "))
+	}
+	return nil
+}
+
+// reloadOnSighup reloads the config file every time the process gets SIGHUP.
+func (s *runningServer) reloadOnSighup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Infof("SIGHUP, reloading %s", s.conf.ConfigFile)
+		if err := s.reload(); err != nil {
+			log.Errorf("config not reloaded: %s", err.Error())
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package mqtt_shell
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/dustin/go-humanize"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/freedreamer82/mqtt-shell/internal/pkg/config"
 	"github.com/freedreamer82/mqtt-shell/pkg/appconsole"
@@ -10,57 +12,125 @@ import (
 	"github.com/freedreamer82/mqtt-shell/pkg/mqttchat"
 	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp"
 	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp/mft"
-	"github.com/freedreamer82/mqtt-shell/pkg/plugins/sshbridge"
-	"github.com/freedreamer82/mqtt-shell/pkg/plugins/telnetbridge"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttsftp"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqtttunnel"
 	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 func RunServer(mqttOpts *MQTT.ClientOptions, conf *config.Config) {
 	log.Info("Starting server..")
 
+	cpSettings, err := loadCpSettings(conf)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	policy, err := loadTunnelPolicy(conf)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
 	netIOpt := mqttchat.WithOptionNetworkInterface(conf.Network.Interface)
+	beaconOpts := []mqttchat.MqttServerChatOption{mqttchat.WithOptionLabels(conf.Labels),
+		mqttchat.WithOptionCapabilities(serverCapabilities(conf)...),
+		mqttchat.WithOptionBeaconInterval(time.Duration(conf.BeaconIntervalSec) * time.Second)}
 
 	topic := mqttchat.ServerTopic{RxTopic: conf.RxTopic, TxTopic: conf.TxTopic, BeaconRxTopic: conf.BeaconTopic, BeaconTxTopic: conf.BeaconRequestTopic}
-	var chat *mqttchat.MqttServerChat
-
-	if conf.TelnetBridgePlugin.Enabled {
-		chat = mqttchat.NewServerChat(mqttOpts, topic, info.VERSION, netIOpt,
-			telnetbridge.WithTelnetBridge(conf.TelnetBridgePlugin.MaxConnections, conf.TelnetBridgePlugin.Keyword),
-			sshbridge.WithSSHBridge(conf.SSHBridgePlugin.MaxConnections, conf.SSHBridgePlugin.Keyword),
-		)
-		//mqttchat.WithOptionAutoCompleteDirs([]string{"/usr"}))
-	} else {
-		chat = mqttchat.NewServerChat(mqttOpts, topic, info.VERSION, netIOpt)
-	}
+	chat := mqttchat.NewServerChat(mqttOpts, topic, info.VERSION, append(beaconOpts, netIOpt)...)
+	server := runningServer{started: conf, conf: conf, chat: chat}
+	server.applyChat(conf)
 	chat.Start()
 
 	if conf.Cp.CpServerEnabled {
 		time.Sleep(time.Second)
-		mqttCpServer := mqttcp.NewMqttServerCp(mqttOpts, conf.Cp.Local2ServerTopic, conf.Cp.Server2LocalTopic, mqttcp.WithOptionMqttWorker(chat.Worker()))
-		mqttCpServer.Start()
+		server.cp = mqttcp.NewMqttServerCp(mqttOpts, conf.Cp.Local2ServerTopic, conf.Cp.Server2LocalTopic, mqttcp.WithOptionMqttWorker(chat.Worker()),
+			mqttcp.WithOptionTransferTopic(conf.Topics.CpTransferFormat()))
+		server.applyCp(conf, cpSettings)
+		server.cp.Start()
+	}
+
+	if conf.Tunnel.TunnelServerEnabled {
+		server.tunnel = mqtttunnel.NewMqttServerTunnel(mqttOpts, conf.Tunnel.Local2ServerTopic, conf.Tunnel.Server2LocalTopic,
+			mqtttunnel.WithOptionMqttWorker(chat.Worker()), mqtttunnel.WithOptionStreamTopic(conf.Topics.TunnelStreamFormat()))
+		server.applyTunnel(conf, policy)
+		server.tunnel.Start()
 	}
 
 	if conf.SSHConsole.Privatekey != "" {
 		sshConsole := appconsole.NewMqttServerChatConsole(chat, conf.SSHConsole.Host, conf.SSHConsole.Port,
 			conf.SSHConsole.Maxconns, conf.SSHConsole.Privatekey, conf.SSHConsole.TimeoutSec, conf.SSHConsole.Password)
+		if server.cp != nil {
+			sshConsole.SetCpServer(server.cp)
+		}
 		sshConsole.Start()
 	}
+
+	go server.reloadOnSighup()
 }
 
-func RunClient(mqttOpts *MQTT.ClientOptions, conf *config.Config) {
+// serverCapabilities lists the services enabled on the server, advertised in its beacon.
+func serverCapabilities(conf *config.Config) []string {
+	capabilities := []string{"shell"}
+	if conf.Cp.CpServerEnabled {
+		capabilities = append(capabilities, "cp")
+	}
+	if conf.Tunnel.TunnelServerEnabled {
+		capabilities = append(capabilities, "tunnel")
+	}
+	if conf.SSHConsole.Privatekey != "" {
+		capabilities = append(capabilities, "console")
+	}
+	return capabilities
+}
+
+const defaultHistoryLimit = 1000
+
+func RunClient(mqttOpts *MQTT.ClientOptions, conf *config.Config) error {
 	log.Info("Starting client..")
+	if conf.Id == "" {
+		id, err := PickServer(mqttOpts, conf)
+		if err != nil {
+			return err
+		}
+		conf.SetId(id)
+	}
+	err := saveRecentServer(conf.Id, brokerKey(conf))
+	if err != nil {
+		log.Debugf("recent servers not saved: %s", err.Error())
+	}
+
 	chat := mqttchat.NewClientChat(mqttOpts, conf.TxTopic, conf.RxTopic, info.VERSION)
+	if conf.Preferences.HistoryFile != "" {
+		limit := conf.Preferences.HistoryLimit
+		if limit == 0 {
+			limit = defaultHistoryLimit
+		}
+		chat.SetHistoryFile(conf.Preferences.HistoryFile, limit)
+	}
+	mqttCpClient := newCpClient(mqttOpts, conf,
+		mqttcp.WithOptionClientWorker(chat.Worker()), mqttcp.WithOptionWriter(io.Discard))
+	chat.SetCpClient(mqttCpClient)
 	chat.Start()
+	return nil
 }
 
-func RunBeacon(mqttOpts *MQTT.ClientOptions, conf *config.Config) {
-	log.Info("Starting beacon discovery..")
-	discovery := mqttchat.NewBeaconDiscovery(mqttOpts, conf.BeaconRequestTopic,
-		conf.BeaconResponseTopic, conf.TimeoutBeaconSec,
-		config.BeaconConverter)
-	discovery.Run(nil)
+// newCpClient returns a copy client of the server conf.Id.
+func newCpClient(mqttOpts *MQTT.ClientOptions, conf *config.Config, opts ...mqttcp.MqttClientCpOption) *mqttcp.MqttClientCp {
+	opts = append(opts, mqttcp.WithOptionClientTransferTopic(conf.Topics.CpTransferFormat()))
+	return mqttcp.NewMqttClientCp(mqttOpts, conf.Cp.Server2LocalTopic, conf.Cp.Local2ServerTopic, opts...)
+}
+
+// newTunnelClient returns a tunnel client of the server conf.Id.
+func newTunnelClient(mqttOpts *MQTT.ClientOptions, conf *config.Config) *mqtttunnel.MqttClientTunnel {
+	return mqtttunnel.NewMqttClientTunnel(mqttOpts, conf.Tunnel.Server2LocalTopic, conf.Tunnel.Local2ServerTopic,
+		mqtttunnel.WithOptionStreamTopic(conf.Topics.TunnelStreamFormat()))
 }
 
 func printProgress(progressChan chan mft.MftProgress, mqttCpClient *mqttcp.MqttClientCp) {
@@ -72,36 +142,385 @@ func printProgress(progressChan chan mft.MftProgress, mqttCpClient *mqttcp.MqttC
 	mqttCpClient.Printf("\rProgress: %d/%d frames (%.2f%%)\nTransfer complete.\n", lastProgress.FrameReceived, lastProgress.FrameTotal, lastProgress.Percent)
 }
 
+// cancelOnInterrupt aborts the running transfer on both sides at the first interrupt,
+// the second one terminates the process.
+func cancelOnInterrupt(mqttCpClient *mqttcp.MqttClientCp) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		signal.Stop(sigChan)
+		mqttCpClient.CancelAll()
+	}()
+}
+
 func RunCopyLocalToRemote(mqttOpts *MQTT.ClientOptions, conf *config.Config) {
-	mqttCpClient := mqttcp.NewMqttClientCp(mqttOpts, conf.Cp.Server2LocalTopic, conf.Cp.Local2ServerTopic)
+	opts := []mqttcp.MqttClientCpOption{
+		mqttcp.WithOptionOverwrite(conf.Copy.Local2Remote.Overwrite, conf.Copy.Local2Remote.Suffix),
+		mqttcp.WithOptionDestinationAttr(conf.Copy.Local2Remote.Mode, conf.Copy.Local2Remote.Owner),
+		mqttcp.WithOptionPreserveOwner(conf.Copy.Local2Remote.PreserveOwner),
+	}
+	if conf.Copy.Local2Remote.Signature != "" {
+		opts = append(opts, mqttcp.WithOptionSignatureFile(conf.Copy.Local2Remote.Signature))
+	} else if conf.Copy.Local2Remote.SignKey != "" {
+		key, err := mqttcp.LoadPrivateKey(conf.Copy.Local2Remote.SignKey)
+		if err != nil {
+			fmt.Printf("invalid sign key: %s\n", err.Error())
+			return
+		}
+		opts = append(opts, mqttcp.WithOptionSigningKey(key))
+	}
+	mqttCpClient := newCpClient(mqttOpts, conf, opts...)
 	progressChan := make(chan mft.MftProgress, 200)
 
 	go printProgress(progressChan, mqttCpClient)
+	cancelOnInterrupt(mqttCpClient)
 
 	mqttCpClient.CopyLocalToRemote(conf.Copy.Local2Remote.Source, conf.Copy.Local2Remote.Destination, &progressChan)
 }
 
 func RunCopyRemoteToLocal(mqttOpts *MQTT.ClientOptions, conf *config.Config) {
-	mqttCpClient := mqttcp.NewMqttClientCp(mqttOpts, conf.Cp.Server2LocalTopic, conf.Cp.Local2ServerTopic)
+	opts := []mqttcp.MqttClientCpOption{
+		mqttcp.WithOptionOverwrite(conf.Copy.Remote2Local.Overwrite, conf.Copy.Remote2Local.Suffix),
+		mqttcp.WithOptionDestinationAttr(conf.Copy.Remote2Local.Mode, conf.Copy.Remote2Local.Owner),
+		mqttcp.WithOptionPreserveOwner(conf.Copy.Remote2Local.PreserveOwner),
+	}
+	if IsStdoutStream(conf) {
+		opts = append(opts, mqttcp.WithOptionWriter(os.Stderr))
+	}
+	mqttCpClient := newCpClient(mqttOpts, conf, opts...)
 	progressChan := make(chan mft.MftProgress, 200)
 
 	go printProgress(progressChan, mqttCpClient)
+	cancelOnInterrupt(mqttCpClient)
 
 	mqttCpClient.CopyRemoteToLocal(conf.Copy.Remote2Local.Source, conf.Copy.Remote2Local.Destination, &progressChan)
 }
 
+// IsStdoutStream tells if the data goes to stdout, so nothing else must be printed there.
+func IsStdoutStream(conf *config.Config) bool {
+	return conf.Copy.Remote2Local.Destination == mqttcp.MqttCpStreamPath || conf.Beacon.Format != "table" ||
+		conf.Beacon.Export != ""
+}
+
+func RunFs(mqttOpts *MQTT.ClientOptions, conf *config.Config, command string) error {
+	mqttCpClient := newCpClient(mqttOpts, conf)
+	defer mqttCpClient.Stop()
+
+	switch strings.Fields(command)[1] {
+	case "ls":
+		entries, err := mqttCpClient.List(conf.Fs.Ls.Path)
+		if err != nil {
+			return err
+		}
+		return printFsEntries(entries, conf.Fs.Ls.Json)
+	case "stat":
+		entry, err := mqttCpClient.Stat(conf.Fs.Stat.Path)
+		if err != nil {
+			return err
+		}
+		if conf.Fs.Stat.Json {
+			return printJson(entry)
+		}
+		return printFsEntries([]mqttcp.MqttJsonFsEntry{entry}, false)
+	case "mkdir":
+		return mqttCpClient.Mkdir(conf.Fs.Mkdir.Path, conf.Fs.Mkdir.Parents, conf.Fs.Mkdir.Mode)
+	case "rm":
+		return mqttCpClient.Remove(conf.Fs.Rm.Path, conf.Fs.Rm.Recursive)
+	case "mv":
+		return mqttCpClient.Rename(conf.Fs.Mv.Source, conf.Fs.Mv.Destination, conf.Fs.Mv.Force)
+	}
+	return fmt.Errorf("%s not supported", command)
+}
+
+func RunSync(mqttOpts *MQTT.ClientOptions, conf *config.Config) error {
+	opts := []mqttcp.MqttClientCpOption{
+		mqttcp.WithOptionOverwrite(mqttcp.MqttCpOverwrite_Overwrite, ""),
+		mqttcp.WithOptionDeltaBlockSize(conf.Sync.BlockSize),
+		mqttcp.WithOptionChecksum(conf.Sync.Checksum),
+	}
+	if conf.Sync.SignKey != "" {
+		key, err := mqttcp.LoadPrivateKey(conf.Sync.SignKey)
+		if err != nil {
+			return fmt.Errorf("invalid sign key: %s", err.Error())
+		}
+		opts = append(opts, mqttcp.WithOptionSigningKey(key))
+	}
+	mqttCpClient := newCpClient(mqttOpts, conf, opts...)
+	defer mqttCpClient.Stop()
+	cancelOnInterrupt(mqttCpClient)
+
+	stats, err := mqttCpClient.Sync(conf.Sync.Source, conf.Sync.Destination, conf.Sync.Delete)
+	fmt.Printf("%d files sent, %d up to date, %d dirs created, %d deleted: %s sent, %s reused\n",
+		stats.Files, stats.Skipped, stats.Dirs, stats.Deleted,
+		humanize.IBytes(uint64(stats.Literal)), humanize.IBytes(uint64(stats.Matched)))
+	return err
+}
+
+func RunTransfers(mqttOpts *MQTT.ClientOptions, conf *config.Config) error {
+	mqttCpClient := newCpClient(mqttOpts, conf)
+	defer mqttCpClient.Stop()
+
+	if conf.Transfers.Cancel != "" {
+		return mqttCpClient.Cancel(conf.Transfers.Cancel)
+	}
+	transfers, err := mqttCpClient.Transfers()
+	if err != nil {
+		return err
+	}
+	if conf.Transfers.Json {
+		return printJson(transfers)
+	}
+	for _, t := range transfers {
+		fmt.Printf("%s %s %-20s %s %s %s %s\n", t.UUID, t.ClientUUID, t.Cmd,
+			formatTransferProgress(t), humanize.IBytes(uint64(t.Rate()))+"/s", formatTransferETA(t), t.Path)
+	}
+	return nil
+}
+
+// formatTransferProgress prints done bytes, and the percentage when the size is known.
+func formatTransferProgress(t mqttcp.MqttJsonTransfer) string {
+	if t.Percent() < 0 {
+		return humanize.IBytes(uint64(t.Done))
+	}
+	return fmt.Sprintf("%s/%s (%.1f%%)", humanize.IBytes(uint64(t.Done)), humanize.IBytes(uint64(t.Size)), t.Percent())
+}
+
+func formatTransferETA(t mqttcp.MqttJsonTransfer) string {
+	eta := t.ETA()
+	if eta < 0 {
+		return "-"
+	}
+	return eta.String()
+}
+
+func RunMulticast(mqttOpts *MQTT.ClientOptions, conf *config.Config) error {
+	opts := []mqttcp.MqttClientCpOption{
+		mqttcp.WithOptionOverwrite(conf.Multicast.Overwrite, conf.Multicast.Suffix),
+		mqttcp.WithOptionDestinationAttr(conf.Multicast.Mode, conf.Multicast.Owner),
+	}
+	if conf.Multicast.Signature != "" {
+		opts = append(opts, mqttcp.WithOptionSignatureFile(conf.Multicast.Signature))
+	} else if conf.Multicast.SignKey != "" {
+		key, err := mqttcp.LoadPrivateKey(conf.Multicast.SignKey)
+		if err != nil {
+			return fmt.Errorf("invalid sign key: %s", err.Error())
+		}
+		opts = append(opts, mqttcp.WithOptionSigningKey(key))
+	}
+
+	targets := make([]mqttcp.MulticastTarget, 0, len(conf.Multicast.Targets))
+	for _, id := range conf.Multicast.Targets {
+		targets = append(targets, mqttcp.MulticastTarget{Id: id, RxTopic: conf.Topics.ServerTopic(conf.Topics.CpCmdReply, id),
+			TxTopic: conf.Topics.ServerTopic(conf.Topics.CpCmd, id)})
+	}
+	if len(targets) == 0 {
+		return errors.New("no target")
+	}
+
+	opts = append(opts, mqttcp.WithOptionClientTransferTopic(conf.Topics.CpTransferFormat()))
+	mqttCpClient := mqttcp.NewMqttClientCp(mqttOpts, targets[0].RxTopic, targets[0].TxTopic, opts...)
+	defer mqttCpClient.Stop()
+
+	progressChan := make(chan mft.MftProgress, 200)
+	done := make(chan bool)
+	go func() {
+		for p := range progressChan {
+			fmt.Printf("\rProgress: %d/%d frames (%.2f%%)", p.FrameReceived, p.FrameTotal, p.Percent)
+		}
+		fmt.Println()
+		close(done)
+	}()
+
+	results, err := mqttCpClient.Multicast(conf.Multicast.Source, conf.Multicast.Destination, targets, &progressChan)
+	close(progressChan)
+	<-done
+
+	failed := 0
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+			fmt.Printf("%s: %s\n", r.Id, r.Error)
+		} else {
+			fmt.Printf("%s: ok, %d repair requests\n", r.Id, r.Repairs)
+		}
+	}
+	if err != nil {
+		return err
+	} else if failed > 0 {
+		return fmt.Errorf("%d of %d servers failed", failed, len(results))
+	}
+	return nil
+}
+
+func RunSftp(mqttOpts *MQTT.ClientOptions, conf *config.Config) error {
+	mqttCpClient := newCpClient(mqttOpts, conf,
+		mqttcp.WithOptionOverwrite(mqttcp.MqttCpOverwrite_Overwrite, ""),
+		mqttcp.WithOptionWriter(io.Discard))
+	defer mqttCpClient.Stop()
+
+	opts := []mqttsftp.MqttSftpServerOption{
+		mqttsftp.WithOptionCredentials(conf.Sftp.User, conf.Sftp.Password),
+		mqttsftp.WithOptionStartDirectory(conf.Sftp.Dir),
+	}
+	if conf.Sftp.HostKey != "" {
+		key, err := mqttsftp.LoadHostKey(conf.Sftp.HostKey)
+		if err != nil {
+			return fmt.Errorf("invalid host key: %s", err.Error())
+		}
+		opts = append(opts, mqttsftp.WithOptionHostKey(key))
+	}
+
+	server, err := mqttsftp.NewMqttSftpServer(mqttCpClient, conf.Sftp.Listen, opts...)
+	if err != nil {
+		return err
+	}
+	err = server.Listen()
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	if host, _, errSplit := net.SplitHostPort(server.GetAddress()); errSplit == nil {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			log.Warnf("sftp server listening on %s, reachable from the network", host)
+		}
+	}
+	fmt.Printf("sftp server for %s on %s, user %s password %s\n", conf.Id, server.GetAddress(), server.GetUser(), server.GetPassword())
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		server.Close()
+	}()
+	return server.Serve()
+}
+
+func RunForward(mqttOpts *MQTT.ClientOptions, conf *config.Config) error {
+	tunnelClient := newTunnelClient(mqttOpts, conf)
+	defer tunnelClient.Stop()
+
+	listeners := []net.Listener{}
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	errChan := make(chan error, len(conf.Forward.Local))
+	for _, local := range conf.Forward.Local {
+		spec, err := mqtttunnel.ParseForwardSpec(local)
+		if err != nil {
+			return err
+		}
+		listener, err := net.Listen("tcp", spec.Listen)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+		fmt.Printf("forwarding %s to %s from %s\n", listener.Addr(), spec.Target, conf.Id)
+		go func() {
+			errChan <- tunnelClient.Forward(listener, spec.Target)
+		}()
+	}
+
+	defer tunnelClient.CancelRemoteForwards()
+	for _, remote := range conf.Forward.Remote {
+		spec, err := mqtttunnel.ParseForwardSpec(remote)
+		if err != nil {
+			return err
+		}
+		listen, err := tunnelClient.RemoteForward(spec.Listen, spec.Target)
+		if err != nil {
+			return fmt.Errorf("reverse forward %s: %s", remote, err.Error())
+		}
+		fmt.Printf("forwarding %s on %s to %s\n", listen, conf.Id, spec.Target)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-sigChan:
+		return nil
+	case err := <-errChan:
+		return err
+	}
+}
+
+func RunSocks(mqttOpts *MQTT.ClientOptions, conf *config.Config) error {
+	tunnelClient := newTunnelClient(mqttOpts, conf)
+	defer tunnelClient.Stop()
+
+	listen := conf.Socks.Listen
+	if _, err := strconv.Atoi(listen); err == nil {
+		listen = net.JoinHostPort("127.0.0.1", listen)
+	}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	if host, _, errSplit := net.SplitHostPort(listener.Addr().String()); errSplit == nil {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			log.Warnf("socks proxy listening on %s without authentication, reachable from the network", host)
+		}
+	}
+	fmt.Printf("socks5 proxy on %s through %s\n", listener.Addr(), conf.Id)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		listener.Close()
+	}()
+	return tunnelClient.ServeSocks(listener)
+}
+
+func printFsEntries(entries []mqttcp.MqttJsonFsEntry, asJson bool) error {
+	if asJson {
+		return printJson(entries)
+	}
+	for _, e := range entries {
+		owner := "-"
+		if e.Uid != nil && e.Gid != nil {
+			owner = fmt.Sprintf("%d:%d", *e.Uid, *e.Gid)
+		}
+		name := e.Name
+		if e.IsLink {
+			name += " -> " + e.Link
+		}
+		fmt.Printf("%s %11s %10d %s %s\n", e.Perm, owner, e.Size,
+			time.Unix(0, e.ModTime).Format(time.DateTime), name)
+	}
+	return nil
+}
+
+func printJson(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
 func BuildMqttOpts(conf *config.Config) (*MQTT.ClientOptions, error) {
 	if conf.Broker == "" {
 		return nil, fmt.Errorf("broker required")
-	} else if conf.BrokerPort == 0 {
+	} else if conf.BrokerPort == 0 && !strings.Contains(conf.Broker, "://") {
 		return nil, fmt.Errorf("broker port required")
 	}
 
-	brokerurl := conf.Broker
 	var mqttOpts = MQTT.NewClientOptions()
-	addr := fmt.Sprintf("tcp://%s:%d", brokerurl, conf.BrokerPort)
+	addr := config.BrokerUrl(conf.Broker, conf.BrokerPort, conf.Tls.Enabled)
 	log.Info("Connecting to : " + addr)
 	mqttOpts.AddBroker(addr)
+	if conf.Tls.Enabled {
+		tlsConf, err := config.NewTlsConfig(conf.Tls)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %s", err.Error())
+		}
+		mqttOpts.SetTLSConfig(tlsConf)
+	}
 	user := conf.BrokerUser
 	password := conf.BrokerPassword
 	if user != "" && password != "" {
@@ -112,10 +531,30 @@ func BuildMqttOpts(conf *config.Config) (*MQTT.ClientOptions, error) {
 }
 
 func ValidateConf(command string, conf *config.Config) error {
-	if command == "client" && conf.Id == "" {
-		return errors.New("ID is necessary in client Mode")
+	if err := conf.ValidateProfile(); err != nil {
+		return err
+	} else if err := conf.ValidateTopics(); err != nil {
+		return err
 	} else if strings.Contains(command, "copy") && conf.Id == "" {
 		return errors.New("ID is necessary in copy Mode")
+	} else if strings.HasPrefix(command, "fs ") && conf.Id == "" {
+		return errors.New("ID is necessary in fs Mode")
+	} else if command == "sync" && conf.Id == "" {
+		return errors.New("ID is necessary in sync Mode")
+	} else if command == "sftp" && conf.Id == "" {
+		return errors.New("ID is necessary in sftp Mode")
+	} else if command == "transfers" && conf.Id == "" {
+		return errors.New("ID is necessary in transfers Mode")
+	} else if command == "forward" && conf.Id == "" {
+		return errors.New("ID is necessary in forward Mode")
+	} else if command == "socks" && conf.Id == "" {
+		return errors.New("ID is necessary in socks Mode")
+	} else if command == "forward" && len(conf.Forward.Local) == 0 && len(conf.Forward.Remote) == 0 {
+		return errors.New("at least one -L or -R forward is necessary")
+	} else if command == "beacon" && conf.Beacon.Watch && conf.Beacon.Format != "table" && conf.Beacon.Format != "jsonl" {
+		return errors.New("--watch supports only table and jsonl formats")
+	} else if command == "beacon" && conf.Beacon.Watch && conf.Beacon.Export != "" {
+		return errors.New("--export can not be used with --watch")
 	}
 	return nil
 }
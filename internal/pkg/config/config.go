@@ -1,6 +1,7 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -36,27 +37,118 @@ type CLI struct {
 	BrokerPort     int              `short:"p" help:"broker port"`
 	Version        kong.VersionFlag `short:"v" xor:"flags"`
 	Id             string           `short:"i" help:"node id"`
+	Profile        string           `help:"connection profile from the config file"`
 
 	Client struct {
+		Target string `arg:"" optional:"" help:"@profile to connect with, or the server id"`
 	} `cmd:"client"`
 
 	Server struct {
 	} `cmd:"server"`
 
 	Beacon struct {
+		Watch        bool   `short:"w" help:"keep running, showing a live table of the servers online and offline"`
+		Format       string `help:"output format, with --watch table or jsonl" enum:"table,json,jsonl,csv" default:"table"`
+		Sort         string `help:"sort servers by" enum:"id,ip,version,uptime" default:"id"`
+		Reverse      bool   `help:"reverse the sort order"`
+		MatchId      string `help:"only servers with id matching the glob"`
+		MatchVersion string `help:"only servers with version matching the glob"`
+		Subnet       string `help:"only servers with ip in the subnet (cidr)"`
+		Export       string `help:"print the servers as ansible, ssh-config or json inventory, grouped by label" enum:"ansible,ssh-config,json," default:""`
+		Selector     string `short:"l" help:"only servers with labels matching, e.g. site=milan,role!=gw*,customer,tier in (1,2)"`
 	} `cmd:"beacon"`
 
 	Copy struct {
 		Local2Remote struct {
-			Source      string `short:"S" help:"local source" required:"true"`
-			Destination string `short:"D" help:"remote destination" required:"true"`
+			Source        string `short:"S" help:"local source" required:"true"`
+			Destination   string `short:"D" help:"remote destination" required:"true"`
+			Signature     string `help:"detached ed25519 signature of the source" type:"existingfile"`
+			SignKey       string `help:"ed25519 private key used to sign the source" type:"existingfile"`
+			Overwrite     string `help:"if destination exists: fail, overwrite or backup" enum:"fail,overwrite,backup" default:"fail"`
+			Suffix        string `help:"backup suffix" default:".bak"`
+			Mode          string `help:"explicit destination mode, octal (default source mode)"`
+			Owner         string `help:"explicit destination owner user[:group]"`
+			PreserveOwner bool   `help:"keep source uid/gid, when the receiver is privileged"`
 		} `cmd`
 		Remote2Local struct {
-			Source      string `short:"S" help:"remote source" required:"true"`
-			Destination string `short:"D" help:"local destination" required:"true"`
+			Source        string `short:"S" help:"remote source" required:"true"`
+			Destination   string `short:"D" help:"local destination" required:"true"`
+			Overwrite     string `help:"if destination exists: fail, overwrite or backup" enum:"fail,overwrite,backup" default:"fail"`
+			Suffix        string `help:"backup suffix" default:".bak"`
+			Mode          string `help:"explicit destination mode, octal (default source mode)"`
+			Owner         string `help:"explicit destination owner user[:group]"`
+			PreserveOwner bool   `help:"keep source uid/gid, when the receiver is privileged"`
 		} `cmd`
 	} `cmd:"copy"`
 
+	Fs struct {
+		Ls struct {
+			Path string `arg:"" help:"remote directory"`
+			Json bool   `help:"json output"`
+		} `cmd:"" help:"list a remote directory"`
+		Stat struct {
+			Path string `arg:"" help:"remote path"`
+			Json bool   `help:"json output"`
+		} `cmd:"" help:"describe a remote file"`
+		Mkdir struct {
+			Path    string `arg:"" help:"remote directory"`
+			Parents bool   `help:"create missing parents"`
+			Mode    string `help:"directory mode, octal"`
+		} `cmd:"" help:"create a remote directory"`
+		Rm struct {
+			Path      string `arg:"" help:"remote path"`
+			Recursive bool   `short:"r" help:"remove directories and their content"`
+		} `cmd:"" help:"remove a remote file or directory"`
+		Mv struct {
+			Source      string `arg:"" help:"remote source"`
+			Destination string `arg:"" help:"remote destination"`
+			Force       bool   `short:"f" help:"overwrite destination"`
+		} `cmd:"" help:"rename a remote file or directory"`
+	} `cmd:"fs"`
+
+	Sync struct {
+		Source      string `short:"S" help:"local file or directory" required:"true"`
+		Destination string `short:"D" help:"remote destination" required:"true"`
+		Delete      bool   `help:"remove remote entries missing locally"`
+		Checksum    bool   `help:"compare files by hash instead of size and modification time"`
+		BlockSize   int    `help:"delta block size, picked from the file size if 0"`
+		SignKey     string `help:"ed25519 private key used to sign the files" type:"existingfile"`
+	} `cmd:"sync" help:"push local files to the server sending only the changed blocks"`
+
+	Transfers struct {
+		Cancel string `help:"cancel the transfer with the given uuid"`
+		Json   bool   `help:"json output"`
+	} `cmd:"transfers" help:"list the transfers in progress on the server"`
+
+	Multicast struct {
+		Source      string   `short:"S" help:"local source" required:"true"`
+		Destination string   `short:"D" help:"remote destination" required:"true"`
+		Targets     []string `short:"t" help:"ids of the servers to copy to" required:"true"`
+		Signature   string   `help:"detached ed25519 signature of the source" type:"existingfile"`
+		SignKey     string   `help:"ed25519 private key used to sign the source" type:"existingfile"`
+		Overwrite   string   `help:"if destination exists: fail, overwrite or backup" enum:"fail,overwrite,backup" default:"fail"`
+		Suffix      string   `help:"backup suffix" default:".bak"`
+		Mode        string   `help:"explicit destination mode, octal (default source mode)"`
+		Owner       string   `help:"explicit destination owner user[:group]"`
+	} `cmd:"multicast" help:"copy a file to many servers publishing the data once"`
+
+	Sftp struct {
+		Listen   string `short:"l" help:"local listen address" default:"127.0.0.1:2022"`
+		User     string `help:"sftp user" default:"mqtt-shell"`
+		Password string `help:"sftp password, random if empty"`
+		HostKey  string `help:"ssh host key, ephemeral if empty" type:"existingfile"`
+		Dir      string `help:"remote start directory" default:"/"`
+	} `cmd:"sftp" help:"serve the remote filesystem over a local sftp server"`
+
+	Forward struct {
+		Local  []string `short:"L" help:"local forward [bind:]port:host:hostport, host reached from the server"`
+		Remote []string `short:"R" help:"reverse forward [bind:]port:host:hostport, bind on the server and host reached from here"`
+	} `cmd:"forward" help:"forward ports between this machine and the server"`
+
+	Socks struct {
+		Listen string `short:"l" help:"local listen address, or just the port on loopback" default:"127.0.0.1:1080"`
+	} `cmd:"socks" help:"local socks5 proxy opening the connections from the server"`
+
 	Gui struct {
 	} `cmd:"gui"`
 }
@@ -143,36 +235,69 @@ type Config struct {
 	BeaconRequestTopic  string
 	BeaconResponseTopic string
 	TimeoutBeaconSec    uint64
+	BeaconIntervalSec   uint64
 	TelnetBridgePlugin  TelnetBridgePluginConfig
 	SSHBridgePlugin     SSHBridgePluginConfig
 	SSHConsole          SSHConsole
 	Network             Network
 	Cp                  CpConfig
+	Tunnel              TunnelConfig
+	// Labels are the key/value pairs advertised in the beacon of the server (site, role...).
+	Labels      map[string]string
+	Tls         TlsConfig
+	Preferences ClientPreferences
+	Profiles    map[string]Profile
+	Topics      TopicsConfig
+	// InactivityTimeoutSec is the idle time after which the server forgets a client session.
+	InactivityTimeoutSec uint64
+	// AutoCompleteDirs are the directories of the commands autocompleted by the server.
+	AutoCompleteDirs []string
+	// flags of the command line, parsed again on Reload
+	cmdline CLI
 }
 
 type CpConfig struct {
 	CpServerEnabled   bool
 	Local2ServerTopic string
 	Server2LocalTopic string
+	// AllowMd5 accepts transfers of legacy clients verified with md5 instead of sha256.
+	AllowMd5 bool
+	// PublisherKey is the ed25519 public key which must have signed every uploaded file.
+	PublisherKey string
+	// ReadRoots are the directories clients can copy from, empty means everywhere.
+	ReadRoots []string
+	// WriteRoots are the directories clients can copy to, empty means everywhere.
+	WriteRoots []string
+	// AllowSetOwner lets clients choose the owner of the files they upload.
+	AllowSetOwner bool
+	// AllowOtherTransfers lets clients list and cancel the transfers of the other clients.
+	AllowOtherTransfers bool
 }
 
-func NewDefaultCpConfig(id string) CpConfig {
+func NewDefaultCpConfig() CpConfig {
 	return CpConfig{
-		CpServerEnabled:   false,
-		Local2ServerTopic: getLocal2ServerTopic(id),
-		Server2LocalTopic: getServer2LocalTopic(id),
+		CpServerEnabled: false,
 	}
 }
 
-const templateTopicLocal2Server = "/mqtt-cp/%s/cmd"
-const templateTopicServer2Local = "/mqtt-cp/%s/cmd/res"
-
-func getLocal2ServerTopic(id string) string {
-	return fmt.Sprintf(templateTopicLocal2Server, id)
+type TunnelConfig struct {
+	TunnelServerEnabled bool
+	Local2ServerTopic   string
+	Server2LocalTopic   string
+	// Allow are the host:port targets clients can open connections to, empty means none.
+	Allow []string
+	// Deny are the targets refused even if allowed.
+	Deny           []string
+	MaxConnections int
+	// GatewayPorts lets reverse tunnels listen on addresses other than loopback.
+	GatewayPorts bool
 }
 
-func getServer2LocalTopic(id string) string {
-	return fmt.Sprintf(templateTopicServer2Local, id)
+func NewDefaultTunnelConfig() TunnelConfig {
+	return TunnelConfig{
+		TunnelServerEnabled: false,
+		MaxConnections:      32,
+	}
 }
 
 type TelnetBridgePluginConfig struct {
@@ -191,20 +316,21 @@ type SSHBridgePluginConfig struct {
 // / filled with default options
 func NewConfig() Config {
 	_, addr := getNetInfo()
-	return Config{
-		CLI:                 CLI{BrokerPort: 1883},
-		Logging:             NewLoggingConfig(),
-		TxTopic:             getTxTopic(addr),
-		RxTopic:             getRxTopic(addr),
-		BeaconTopic:         getBeaconTopic(addr),
-		Network:             Network{Interface: ""},
-		BeaconRequestTopic:  BeaconRequestTopic,
-		BeaconResponseTopic: BeaconReplyTopic, //getBeaconTopic("+"),
-		TimeoutBeaconSec:    10,
-		TelnetBridgePlugin:  TelnetBridgePluginConfig{Enabled: false, Keyword: "telnet", MaxConnections: 5},
-		SSHBridgePlugin:     SSHBridgePluginConfig{Enabled: false, Keyword: "ssh", MaxConnections: 5},
-		Cp:                  NewDefaultCpConfig(addr),
+	config := Config{
+		CLI:                  CLI{BrokerPort: 1883},
+		Logging:              NewLoggingConfig(),
+		Network:              Network{Interface: ""},
+		TimeoutBeaconSec:     10,
+		BeaconIntervalSec:    60,
+		InactivityTimeoutSec: 180,
+		TelnetBridgePlugin:   TelnetBridgePluginConfig{Enabled: false, Keyword: "telnet", MaxConnections: 5},
+		SSHBridgePlugin:      SSHBridgePluginConfig{Enabled: false, Keyword: "ssh", MaxConnections: 5},
+		Cp:                   NewDefaultCpConfig(),
+		Tunnel:               NewDefaultTunnelConfig(),
+		Topics:               NewDefaultTopicsConfig(),
 	}
+	config.setTopics(addr)
+	return config
 }
 
 // / NewLoggingConfig creates a new logging configuration structure
@@ -290,7 +416,19 @@ func Parse(v *viper.Viper, configFile string, cli *CLI) (*Config, error) {
 		return nil, eris.Wrap(err, "failed to unmarshal configuration file")
 	}
 
+	if name := cli.ProfileName(); name != "" {
+		err = applyProfile(&config, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cli.Client.Target != "" && !strings.HasPrefix(cli.Client.Target, "@") && cli.Id == "" {
+		// client <id>, it wins over the id of the profile
+		cli.Id = cli.Client.Target
+	}
 	mergeCliandConfig(&config, cli)
+	config.ConfigFile = configFile
+	config.cmdline = *cli
 
 	id := os.Getenv("MQTT_SHELL_ID")
 	if id != "" && config.Id == "" {
@@ -299,18 +437,49 @@ func Parse(v *viper.Viper, configFile string, cli *CLI) (*Config, error) {
 	}
 
 	if config.Id != "" {
-		config.TxTopic = getTxTopic(config.Id)
-		config.RxTopic = getRxTopic(config.Id)
-		config.BeaconTopic = getBeaconTopic(config.Id)
-		config.BeaconRequestTopic = BeaconRequestTopic
-		config.BeaconResponseTopic = getBeaconTopic("+")
-		config.Cp.Local2ServerTopic = getLocal2ServerTopic(config.Id)
-		config.Cp.Server2LocalTopic = getServer2LocalTopic(config.Id)
+		config.SetId(config.Id)
+	} else {
+		// topics of the mac address, with the templates of the file
+		_, addr := getNetInfo()
+		config.setTopics(addr)
 	}
 
 	return &config, nil
 }
 
+// Reload parses again the config file, with the same command line flags.
+func (config *Config) Reload() (*Config, error) {
+	cli := config.cmdline
+	return Parse(viper.New(), config.ConfigFile, &cli)
+}
+
+// SetId sets the node id and the topics derived from it.
+func (config *Config) SetId(id string) {
+	config.Id = id
+	config.setTopics(id)
+}
+
+func (config *Config) setTopics(id string) {
+	t := &config.Topics
+	config.TxTopic = t.ServerTopic(t.CmdReply, id)
+	config.RxTopic = t.ServerTopic(t.Cmd, id)
+	config.BeaconTopic = t.ServerTopic(t.Event, id)
+	config.BeaconRequestTopic = t.WhoamiTopic()
+	config.BeaconResponseTopic = t.EventFilter()
+	config.Cp.Local2ServerTopic = t.ServerTopic(t.CpCmd, id)
+	config.Cp.Server2LocalTopic = t.ServerTopic(t.CpCmdReply, id)
+	config.Tunnel.Local2ServerTopic = t.ServerTopic(t.TunnelCmd, id)
+	config.Tunnel.Server2LocalTopic = t.ServerTopic(t.TunnelCmdReply, id)
+}
+
+// ValidateTopics checks the topic templates and that the id can be part of a topic.
+func (config *Config) ValidateTopics() error {
+	if strings.ContainsAny(config.Id, "+#") {
+		return errors.New(fmt.Sprintf("id %s not valid: + and # are mqtt wildcards", config.Id))
+	}
+	return config.Topics.Validate()
+}
+
 // / stringToFileSizeHookFunc is a mapstructure decode hook
 // / which decodes strings to file sizes
 func stringToFileSizeHookFunc() mapstructure.DecodeHookFunc {
@@ -337,15 +506,6 @@ func stringToLogLevelHookFunc() mapstructure.DecodeHookFunc {
 	}
 }
 
-const topicPrefix = "/mqtt-shell/"
-
-var TemplateSubTopic = topicPrefix + "%s/cmd"
-var TemplateSubTopicreply = topicPrefix + "%s/cmd/res"
-var TemplateBeaconTopic = topicPrefix + "%s/event"
-
-const BeaconRequestTopic = topicPrefix + "whoami"
-const BeaconReplyTopic = topicPrefix + "+/event"
-
 func getNetInfo() (string, string) {
 
 	interfaces, _ := net.Interfaces()
@@ -369,27 +529,3 @@ func getNetInfo() (string, string) {
 	}
 	return "", ""
 }
-
-func getTxTopic(nodeID string) string {
-	topic := fmt.Sprintf(TemplateSubTopicreply, nodeID)
-	return topic
-}
-
-func getRxTopic(nodeID string) string {
-	topic := fmt.Sprintf(TemplateSubTopic, nodeID)
-	return topic
-}
-
-func getBeaconTopic(nodeID string) string {
-	topic := fmt.Sprintf(TemplateBeaconTopic, nodeID)
-	return topic
-}
-
-func BeaconConverter(topic string) string {
-	res := strings.ReplaceAll(topic, topicPrefix, "")
-	split := strings.Split(res, "/")
-	if len(split) > 0 {
-		return split[0]
-	}
-	return ""
-}
@@ -0,0 +1,246 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"dario.cat/mergo"
+	"github.com/spf13/viper"
+)
+
+// TlsConfig is the tls connection to the broker.
+type TlsConfig struct {
+	Enabled bool
+	// CaFile verifies the broker, the system roots are used if empty.
+	CaFile string
+	// CertFile and KeyFile are the client certificate, for brokers requiring it.
+	CertFile string
+	KeyFile  string
+	// Insecure skips the verification of the broker certificate.
+	Insecure bool
+}
+
+// ClientPreferences are the settings of the interactive client.
+type ClientPreferences struct {
+	HistoryFile  string
+	HistoryLimit int
+}
+
+// Profile bundles a broker, its credentials and optionally a server, selected with
+// --profile <name> or client @<name>. Names are case insensitive.
+type Profile struct {
+	Broker         string
+	BrokerPort     int
+	BrokerUser     string
+	BrokerPassword string
+	Tls            TlsConfig
+	Id             string
+	Preferences    ClientPreferences
+}
+
+// DefaultConfigFile is the config read when none is given with -c.
+func DefaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "mqtt-shell", "config.toml")
+}
+
+// CommandConfigFile is the config file read by command: the one given with -c, or the default
+// one if it exists. A server reads only the file it is given, a stray user config must not
+// change a daemon.
+func CommandConfigFile(command string, configFile string) string {
+	if configFile == "" && command != "server" && fileExists(DefaultConfigFile()) {
+		return DefaultConfigFile()
+	}
+	return configFile
+}
+
+// ProfileName returns the profile requested, from --profile or client @name.
+func (cli *CLI) ProfileName() string {
+	if strings.HasPrefix(cli.Client.Target, "@") {
+		return strings.ToLower(strings.TrimPrefix(cli.Client.Target, "@"))
+	}
+	return strings.ToLower(cli.Profile)
+}
+
+// applyProfile overrides the connection of config with the profile name, the flags
+// given on the command line are applied later and win over both. A missing profile
+// is reported by ValidateProfile.
+func applyProfile(config *Config, name string) error {
+	p, exist := config.Profiles[name]
+	if !exist {
+		return nil
+	}
+
+	profileCli := CLI{Broker: p.Broker, BrokerPort: p.BrokerPort, BrokerUser: p.BrokerUser,
+		BrokerPassword: p.BrokerPassword, Id: p.Id}
+	if err := mergo.Merge(&config.CLI, profileCli, mergo.WithOverride); err != nil {
+		return err
+	}
+	if err := mergo.Merge(&config.Tls, p.Tls, mergo.WithOverride); err != nil {
+		return err
+	}
+	return mergo.Merge(&config.Preferences, p.Preferences, mergo.WithOverride)
+}
+
+// ValidateProfile checks that the profile requested exists.
+func (config *Config) ValidateProfile() error {
+	name := config.ProfileName()
+	if _, exist := config.Profiles[name]; name != "" && !exist {
+		return errors.New(fmt.Sprintf("profile %s not found", name))
+	}
+	return nil
+}
+
+// BrokerUrl returns the url of the broker, given as url or as host.
+func BrokerUrl(broker string, port int, tlsEnabled bool) string {
+	if strings.Contains(broker, "://") {
+		return broker
+	}
+	scheme := "tcp"
+	if tlsEnabled {
+		scheme = "ssl"
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, broker, port)
+}
+
+// NewTlsConfig loads the certificates of t.
+func NewTlsConfig(t TlsConfig) (*tls.Config, error) {
+	tlsConf := &tls.Config{InsecureSkipVerify: t.Insecure}
+	if t.CaFile != "" {
+		pem, err := os.ReadFile(t.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf("no certificate found in %s", t.CaFile))
+		}
+		tlsConf.RootCAs = pool
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
+// LoadProfiles reads the profiles of a config file, none if the file does not exist.
+func LoadProfiles(file string) (map[string]Profile, error) {
+	profiles := make(map[string]Profile)
+	if !fileExists(file) {
+		return profiles, nil
+	}
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	if err := v.UnmarshalKey("profiles", &profiles); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+var profileSectionRegexp = regexp.MustCompile(`^\s*\[\s*profiles\s*[.\]]`)
+var bareKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// SaveProfiles replaces the profile sections of a toml config file, the rest of the
+// file is kept as it is.
+func SaveProfiles(file string, profiles map[string]Profile) error {
+	kept := []string{}
+	if b, err := os.ReadFile(file); err == nil {
+		inProfile := false
+		for _, line := range strings.Split(string(b), "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "[") {
+				inProfile = profileSectionRegexp.MatchString(line)
+			}
+			if !inProfile {
+				kept = append(kept, line)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var b strings.Builder
+	if content := strings.TrimRight(strings.Join(kept, "\n"), "\n"); content != "" {
+		b.WriteString(content + "\n\n")
+	}
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeProfile(&b, name, profiles[name])
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	// credentials inside
+	return os.WriteFile(file, []byte(b.String()), 0600)
+}
+
+func writeProfile(b *strings.Builder, name string, p Profile) {
+	section := "profiles." + tomlKey(name)
+	fmt.Fprintf(b, "[%s]\n", section)
+	writeTomlString(b, "Broker", p.Broker)
+	if p.BrokerPort != 0 {
+		fmt.Fprintf(b, "BrokerPort = %d\n", p.BrokerPort)
+	}
+	writeTomlString(b, "BrokerUser", p.BrokerUser)
+	writeTomlString(b, "BrokerPassword", p.BrokerPassword)
+	writeTomlString(b, "Id", p.Id)
+	if p.Tls != (TlsConfig{}) {
+		fmt.Fprintf(b, "[%s.Tls]\n", section)
+		fmt.Fprintf(b, "Enabled = %t\n", p.Tls.Enabled)
+		writeTomlString(b, "CaFile", p.Tls.CaFile)
+		writeTomlString(b, "CertFile", p.Tls.CertFile)
+		writeTomlString(b, "KeyFile", p.Tls.KeyFile)
+		if p.Tls.Insecure {
+			fmt.Fprintln(b, "Insecure = true")
+		}
+	}
+	if p.Preferences != (ClientPreferences{}) {
+		fmt.Fprintf(b, "[%s.Preferences]\n", section)
+		writeTomlString(b, "HistoryFile", p.Preferences.HistoryFile)
+		if p.Preferences.HistoryLimit != 0 {
+			fmt.Fprintf(b, "HistoryLimit = %d\n", p.Preferences.HistoryLimit)
+		}
+	}
+	b.WriteString("\n")
+}
+
+// tomlString quotes s, a json string is a valid toml basic string.
+func tomlString(s string) string {
+	q, _ := json.Marshal(s)
+	return string(q)
+}
+
+func tomlKey(key string) string {
+	if bareKeyRegexp.MatchString(key) {
+		return key
+	}
+	return tomlString(key)
+}
+
+func writeTomlString(b *strings.Builder, key string, value string) {
+	if value != "" {
+		fmt.Fprintf(b, "%s = %s\n", key, tomlString(value))
+	}
+}
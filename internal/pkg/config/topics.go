@@ -0,0 +1,240 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Placeholders of the topic templates.
+const (
+	TopicPlaceholder_Namespace = "{namespace}"
+	TopicPlaceholder_Id        = "{id}"
+	TopicPlaceholder_Client    = "{client}"
+	TopicPlaceholder_Transfer  = "{transfer}"
+)
+
+// TopicsConfig are the templates of every mqtt topic used, {namespace} is replaced by
+// Namespace, {id} by the server id, {client} and {transfer} by the uuids of a transfer.
+// Client and server must share them.
+type TopicsConfig struct {
+	// Namespace is the root of the topics, e.g. tenants/acme, empty by default.
+	Namespace string
+	// shell commands to the server and their output
+	Cmd      string
+	CmdReply string
+	// beacon and presence of the server, {id} must be a whole level
+	Event string
+	// beacon request, shared by all the servers
+	Whoami string
+	// copy commands and the data of a transfer
+	CpCmd      string
+	CpCmdReply string
+	CpTransfer string
+	// tunnel commands and the data of a connection
+	TunnelCmd      string
+	TunnelCmdReply string
+	TunnelStream   string
+}
+
+func NewDefaultTopicsConfig() TopicsConfig {
+	return TopicsConfig{
+		Namespace:      "",
+		Cmd:            "{namespace}/mqtt-shell/{id}/cmd",
+		CmdReply:       "{namespace}/mqtt-shell/{id}/cmd/res",
+		Event:          "{namespace}/mqtt-shell/{id}/event",
+		Whoami:         "{namespace}/mqtt-shell/whoami",
+		CpCmd:          "{namespace}/mqtt-cp/{id}/cmd",
+		CpCmdReply:     "{namespace}/mqtt-cp/{id}/cmd/res",
+		CpTransfer:     "{namespace}/mft/{client}/{transfer}",
+		TunnelCmd:      "{namespace}/mqtt-tunnel/{id}/cmd",
+		TunnelCmdReply: "{namespace}/mqtt-tunnel/{id}/cmd/res",
+		TunnelStream:   "{namespace}/mft-tunnel/{client}/{transfer}",
+	}
+}
+
+func (t *TopicsConfig) expand(template string, id string) string {
+	namespace := strings.TrimSuffix(t.Namespace, "/")
+	topic := strings.ReplaceAll(template, TopicPlaceholder_Namespace, namespace)
+	return strings.ReplaceAll(topic, TopicPlaceholder_Id, id)
+}
+
+// ServerTopic returns the topic of template for the server id.
+func (t *TopicsConfig) ServerTopic(template string, id string) string {
+	return t.expand(template, id)
+}
+
+// WhoamiTopic is the topic of the beacon requests.
+func (t *TopicsConfig) WhoamiTopic() string {
+	return t.expand(t.Whoami, "")
+}
+
+// EventFilter is the topic filter of the beacons of all the servers.
+func (t *TopicsConfig) EventFilter() string {
+	return t.expand(t.Event, "+")
+}
+
+// transferFormat turns a transfer template in the fmt template of the mqttcp and
+// mqtttunnel packages, taking the client and the transfer uuid.
+func (t *TopicsConfig) transferFormat(template string) string {
+	f := strings.ReplaceAll(t.expand(template, ""), "%", "%%")
+	f = strings.ReplaceAll(f, TopicPlaceholder_Client, "%[1]s")
+	return strings.ReplaceAll(f, TopicPlaceholder_Transfer, "%[2]s")
+}
+
+// CpTransferFormat is the topic of the copy data, for mqttcp.WithOptionTransferTopic.
+func (t *TopicsConfig) CpTransferFormat() string {
+	return t.transferFormat(t.CpTransfer)
+}
+
+// TunnelStreamFormat is the topic of the tunnel data, for mqtttunnel.WithOptionStreamTopic.
+func (t *TopicsConfig) TunnelStreamFormat() string {
+	return t.transferFormat(t.TunnelStream)
+}
+
+// BeaconConverter returns the server id of a beacon topic, the level of {id} in Event.
+func (t *TopicsConfig) BeaconConverter(topic string) string {
+	levels := strings.Split(t.EventFilter(), "/")
+	split := strings.Split(topic, "/")
+	for i, level := range levels {
+		if level == "+" && i < len(split) {
+			return split[i]
+		}
+	}
+	return ""
+}
+
+var placeholderRegexp = regexp.MustCompile(`\{[^}]*\}`)
+
+type topicTemplate struct {
+	name     string
+	template string
+	allowed  []string
+	required []string
+}
+
+func (t *TopicsConfig) templates() []topicTemplate {
+	server := []string{TopicPlaceholder_Namespace, TopicPlaceholder_Id}
+	transfer := []string{TopicPlaceholder_Namespace, TopicPlaceholder_Client, TopicPlaceholder_Transfer}
+	return []topicTemplate{
+		{"Cmd", t.Cmd, server, server[1:]},
+		{"CmdReply", t.CmdReply, server, server[1:]},
+		{"Event", t.Event, server, server[1:]},
+		{"Whoami", t.Whoami, server[:1], nil},
+		{"CpCmd", t.CpCmd, server, server[1:]},
+		{"CpCmdReply", t.CpCmdReply, server, server[1:]},
+		{"CpTransfer", t.CpTransfer, transfer, transfer[1:]},
+		{"TunnelCmd", t.TunnelCmd, server, server[1:]},
+		{"TunnelCmdReply", t.TunnelCmdReply, server, server[1:]},
+		{"TunnelStream", t.TunnelStream, transfer, transfer[1:]},
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validTopicName checks the rules of mqtt for the topics messages are published to.
+func validTopicName(topic string) error {
+	if topic == "" {
+		return errors.New("empty topic")
+	} else if strings.ContainsAny(topic, "+#\x00") {
+		return errors.New("wildcards not allowed")
+	} else if strings.HasPrefix(topic, "$") {
+		return errors.New("topics starting with $ are reserved to the broker")
+	} else if len(topic) > 65535 {
+		return errors.New("topic too long")
+	}
+	return nil
+}
+
+// topicMatches tells if topic is matched by filter, with + wildcards only.
+func topicMatches(filter string, topic string) bool {
+	f, l := strings.Split(filter, "/"), strings.Split(topic, "/")
+	if len(f) != len(l) {
+		return false
+	}
+	for i := range f {
+		if f[i] != "+" && f[i] != l[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks the templates: known placeholders only, the ones needed present, valid
+// topics and no topic shared by two of them.
+func (t *TopicsConfig) Validate() error {
+	if err := validTopicName(t.Namespace); t.Namespace != "" && err != nil {
+		return errors.New(fmt.Sprintf("topic namespace %s: %s", t.Namespace, err.Error()))
+	} else if placeholderRegexp.MatchString(t.Namespace) {
+		return errors.New(fmt.Sprintf("topic namespace %s: placeholders not allowed", t.Namespace))
+	}
+
+	used := make(map[string]string)
+	names, topics := []string{}, []string{}
+	for _, tt := range t.templates() {
+		if tt.template == "" {
+			return errors.New(fmt.Sprintf("topic %s empty", tt.name))
+		}
+		for _, p := range placeholderRegexp.FindAllString(tt.template, -1) {
+			if !contains(tt.allowed, p) {
+				return errors.New(fmt.Sprintf("topic %s %s: placeholder %s not allowed, only %s", tt.name, tt.template, p,
+					strings.Join(tt.allowed, " ")))
+			}
+		}
+		for _, p := range tt.required {
+			if !strings.Contains(tt.template, p) {
+				return errors.New(fmt.Sprintf("topic %s %s: placeholder %s missing", tt.name, tt.template, p))
+			}
+		}
+
+		topic := t.expand(tt.template, "id")
+		topic = strings.ReplaceAll(topic, TopicPlaceholder_Client, "client")
+		topic = strings.ReplaceAll(topic, TopicPlaceholder_Transfer, "transfer")
+		if err := validTopicName(topic); err != nil {
+			return errors.New(fmt.Sprintf("topic %s %s: %s", tt.name, tt.template, err.Error()))
+		}
+		if other, exist := used[topic]; exist {
+			return errors.New(fmt.Sprintf("topics %s and %s are the same: %s", other, tt.name, topic))
+		}
+		used[topic] = tt.name
+		names, topics = append(names, tt.name), append(topics, topic)
+	}
+
+	// discovery subscribes to the beacons of every server
+	if !contains(strings.Split(t.Event, "/"), TopicPlaceholder_Id) {
+		return errors.New(fmt.Sprintf("topic Event %s: %s must be a whole level", t.Event, TopicPlaceholder_Id))
+	}
+	for i, topic := range topics {
+		if names[i] != "Event" && topicMatches(t.EventFilter(), topic) {
+			return errors.New(fmt.Sprintf("topic %s %s is matched by the beacons %s", names[i], topic, t.EventFilter()))
+		}
+	}
+	return nil
+}
+
+// LoadTopics reads the topic templates of a config file, the default ones if the file does not exist.
+func LoadTopics(file string) (TopicsConfig, error) {
+	topics := NewDefaultTopicsConfig()
+	if !fileExists(file) {
+		return topics, nil
+	}
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return topics, err
+	}
+	if err := v.UnmarshalKey("topics", &topics); err != nil {
+		return topics, err
+	}
+	return topics, topics.Validate()
+}
@@ -12,3 +12,7 @@ const MQTT_SCREEN_Broker = "Broker"
 const MQTT_SCREEN_Port = "Port"
 const MQTT_SCREEN_User = "User"
 const MQTT_SCREEN_Password = "Password"
+const MQTT_SCREEN_Profile = "Profile"
+const MQTT_SCREEN_Tls = "TLS"
+const MQTT_SCREEN_CaFile = "CA file"
+const MQTT_SCREEN_ServerId = "Server"
@@ -11,7 +11,10 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-func lumberjackLogger(c *config.LoggingFileConfig) io.Writer {
+// fileLogger is the log file of the last Setup, closed when the logging is set up again
+var fileLogger *lumberjack.Logger
+
+func lumberjackLogger(c *config.LoggingFileConfig) *lumberjack.Logger {
 	// Lumberjack file size parameter should be expressed in Megabytes
 	maxSizeMb := int(c.MaxSize / 1024 / 1024)
 
@@ -55,11 +58,17 @@ func Setup(conf *config.LoggingConfig) {
 		outputs = append(outputs, os.Stdout)
 	}
 
+	previous := fileLogger
+	fileLogger = nil
 	if conf.File.Enabled && conf.File.Filename != "" {
-		outputs = append(outputs, lumberjackLogger(&conf.File))
+		fileLogger = lumberjackLogger(&conf.File)
+		outputs = append(outputs, fileLogger)
 	}
 
 	log.SetOutput(io.MultiWriter(outputs...))
+	if previous != nil {
+		previous.Close()
+	}
 }
 
 func LogError(err error, args ...interface{}) {
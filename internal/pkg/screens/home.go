@@ -1,7 +1,6 @@
 package screens
 
 import (
-	"fmt"
 	"image/color"
 	"io"
 	"strings"
@@ -13,7 +12,6 @@ import (
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
-	"github.com/freedreamer82/mqtt-shell/internal/pkg/config"
 	"github.com/freedreamer82/mqtt-shell/internal/pkg/constant"
 )
 
@@ -126,8 +124,9 @@ func (s *MainScreen) clientCb(c string) {
 	s.verText.SetText(info.VERSION)
 	s.connectedIcon.SetResource(theme.ConfirmIcon())
 
-	txTopic := fmt.Sprintf(config.TemplateSubTopic, c)
-	rxTopic := fmt.Sprintf(config.TemplateSubTopicreply, c)
+	topics := s.mqttScreen.topics
+	txTopic := topics.ServerTopic(topics.Cmd, c)
+	rxTopic := topics.ServerTopic(topics.CmdReply, c)
 
 	if s.client != nil && s.client.IsRunning() {
 		s.client.Stop()
@@ -171,11 +170,11 @@ func (s *MainScreen) clear() {
 	}
 }
 
-func NewMainScreen(app fyne.App, appWindow fyne.Window) *MainScreen {
+func NewMainScreen(app fyne.App, appWindow fyne.Window, configFile string) *MainScreen {
 
 	input := widget.NewEntry()
 
-	s := MainScreen{mqttScreen: NewMqttDialog(appWindow, app.Preferences()),
+	s := MainScreen{mqttScreen: NewMqttDialog(appWindow, app.Preferences(), configFile),
 		cmdScreen: NewCmdOverlay(appWindow, app.Preferences()),
 		input:     input, app: app, appWindow: appWindow}
 	s.chanReadReady = make(chan bool)
@@ -2,11 +2,16 @@ package screens
 
 import (
 	"errors"
-	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
 	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/widget"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/freedreamer82/mqtt-shell/internal/pkg/config"
 	"github.com/freedreamer82/mqtt-shell/internal/pkg/constant"
 	"github.com/freedreamer82/mqtt-shell/pkg/mqtt"
 )
@@ -24,6 +29,14 @@ type MqttDialog struct {
 	broker      *widget.Entry
 	password    *widget.Entry
 	port        *widget.Entry
+	tls         *widget.Check
+	caFile      *widget.Entry
+	serverId    *widget.Entry
+	// profiles shared with the command line, in the config file
+	configFile string
+	profiles   map[string]config.Profile
+	profile    *widget.SelectEntry
+	topics     config.TopicsConfig
 }
 
 const mqttBroker = "mqttBroker"
@@ -31,6 +44,7 @@ const mqttBrokerPassword = "mqttBrokerPassword"
 const mqttBrokerUser = "mqttBrokerUser"
 const mqttBrokerHost = "mqttBrokerHost"
 const mqttBrokerPort = "mqttBrokerPort"
+const mqttProfile = "mqttProfile"
 
 func (s *MqttDialog) GetContainer() fyne.CanvasObject {
 	return s.container
@@ -53,6 +67,68 @@ func (s *MqttDialog) getDataFromStorage() {
 
 }
 
+func (s *MqttDialog) profileNames() []string {
+	names := make([]string, 0, len(s.profiles))
+	for name := range s.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// showProfile fills the form with the profile name, if it exists.
+func (s *MqttDialog) showProfile(name string) {
+	p, exist := s.profiles[strings.ToLower(name)]
+	if !exist {
+		return
+	}
+	s.broker.SetText(p.Broker)
+	s.port.SetText("")
+	if p.BrokerPort != 0 {
+		s.port.SetText(strconv.Itoa(p.BrokerPort))
+	}
+	s.user.SetText(p.BrokerUser)
+	s.password.SetText(p.BrokerPassword)
+	s.tls.SetChecked(p.Tls.Enabled)
+	s.caFile.SetText(p.Tls.CaFile)
+	s.serverId.SetText(p.Id)
+}
+
+// saveProfile stores the form in the profile named in the form, keeping the settings
+// not editable here.
+func (s *MqttDialog) saveProfile() error {
+	name := strings.ToLower(strings.TrimSpace(s.profile.Text))
+	if name == "" {
+		return errors.New("profile name required")
+	}
+	port := 0
+	if s.port.Text != "" {
+		var err error
+		port, err = strconv.Atoi(s.port.Text)
+		if err != nil {
+			return errors.New("port not valid")
+		}
+	}
+	p := s.profiles[name]
+	p.Broker, p.BrokerPort, p.BrokerUser, p.BrokerPassword = s.broker.Text, port, s.user.Text, s.password.Text
+	p.Tls.Enabled, p.Tls.CaFile = s.tls.Checked, s.caFile.Text
+	p.Id = s.serverId.Text
+	s.profiles[name] = p
+	s.profile.SetOptions(s.profileNames())
+	return config.SaveProfiles(s.configFile, s.profiles)
+}
+
+func (s *MqttDialog) deleteProfile() error {
+	name := strings.ToLower(strings.TrimSpace(s.profile.Text))
+	if _, exist := s.profiles[name]; !exist {
+		return errors.New("profile " + name + " not found")
+	}
+	delete(s.profiles, name)
+	s.profile.SetOptions(s.profileNames())
+	s.profile.SetText("")
+	return config.SaveProfiles(s.configFile, s.profiles)
+}
+
 func (s *MqttDialog) createForm() {
 
 	s.broker.SetPlaceHolder("broker host")
@@ -82,12 +158,36 @@ func (s *MqttDialog) createForm() {
 		s.password.SetText(text)
 	}
 
+	s.caFile.SetPlaceHolder("system roots")
+	s.serverId.SetPlaceHolder("scan")
+	s.profile.SetPlaceHolder("none")
+	s.profile.SetOptions(s.profileNames())
+	s.profile.OnChanged = s.showProfile
+	if text := s.storage.String(mqttProfile); text != "" {
+		s.profile.SetText(text)
+	}
+	saveButton := widget.NewButton("Save profile", func() {
+		if err := s.saveProfile(); err != nil {
+			dialog.ShowError(err, s.app)
+		}
+	})
+	deleteButton := widget.NewButton("Delete profile", func() {
+		if err := s.deleteProfile(); err != nil {
+			dialog.ShowError(err, s.app)
+		}
+	})
+
 	s.dialog = dialog.NewForm("Mqtt broker settings", "Connect", "Cancel",
 		[]*widget.FormItem{
+			{Text: constant.MQTT_SCREEN_Profile, Widget: s.profile, HintText: "Profile of the config file, shared with the command line"},
 			{Text: constant.MQTT_SCREEN_Broker, Widget: s.broker, HintText: "MQTT broker to connect to"},
 			{Text: constant.MQTT_SCREEN_Port, Widget: s.port, HintText: "MQTT broker port"},
 			{Text: constant.MQTT_SCREEN_User, Widget: s.user, HintText: "User to use for connecting (optional)"},
 			{Text: constant.MQTT_SCREEN_Password, Widget: s.password, HintText: "User password to use for connecting (optional)"},
+			{Text: constant.MQTT_SCREEN_Tls, Widget: s.tls},
+			{Text: constant.MQTT_SCREEN_CaFile, Widget: s.caFile, HintText: "CA certificate of the broker (optional)"},
+			{Text: constant.MQTT_SCREEN_ServerId, Widget: s.serverId, HintText: "Server to connect to, found by scan if empty"},
+			{Widget: container.NewHBox(saveButton, deleteButton)},
 		},
 		func(confirm bool) {
 			if !confirm {
@@ -97,11 +197,20 @@ func (s *MqttDialog) createForm() {
 				return
 			}
 
-			brokerurl := s.broker.Text
-			addr := fmt.Sprintf("tcp://%s:%s", brokerurl, s.port.Text)
+			port, _ := strconv.Atoi(s.port.Text)
+			addr := config.BrokerUrl(s.broker.Text, port, s.tls.Checked)
 
 			opts := MQTT.NewClientOptions()
 			opts.AddBroker(addr)
+			if s.tls.Checked {
+				tlsConf, err := config.NewTlsConfig(s.tlsSettings())
+				if err != nil {
+					dialog.ShowError(err, s.app)
+					defer s.createForm()
+					return
+				}
+				opts.SetTLSConfig(tlsConf)
+			}
 			if s.user.Text != "" {
 				opts.SetUsername(s.user.Text)
 			}
@@ -112,6 +221,11 @@ func (s *MqttDialog) createForm() {
 			s.mqttOpts = opts
 			s.mqttClient = MQTT.NewClient(s.mqttOpts)
 			s.scanScreen.SetMqttOpts(s.mqttOpts)
+			s.storage.SetString(mqttProfile, s.profile.Text)
+			if s.serverId.Text != "" && s.scanScreen.cb != nil {
+				s.scanScreen.cb(s.serverId.Text)
+				return
+			}
 			s.scanScreen.Scan()
 
 			if len(s.scanScreen.GetClients()) != 0 {
@@ -134,14 +248,37 @@ func (s *MqttDialog) createForm() {
 //	s.createForm()
 //}
 
-func NewMqttDialog(app fyne.Window, storage fyne.Preferences) *MqttDialog {
+// tlsSettings returns the tls of the selected profile, with the fields of the form.
+func (s *MqttDialog) tlsSettings() config.TlsConfig {
+	t := s.profiles[strings.ToLower(strings.TrimSpace(s.profile.Text))].Tls
+	t.Enabled, t.CaFile = s.tls.Checked, s.caFile.Text
+	return t
+}
+
+func NewMqttDialog(app fyne.Window, storage fyne.Preferences, configFile string) *MqttDialog {
 	w := widget.NewLabel("")
-	s := MqttDialog{container: w, app: app, storage: storage}
-	s.scanScreen = NewScanOverlay(app, s.mqttOpts)
+	s := MqttDialog{container: w, app: app, storage: storage, configFile: configFile}
+	profiles, err := config.LoadProfiles(configFile)
+	if err != nil {
+		dialog.ShowError(err, app)
+		profiles = make(map[string]config.Profile)
+	}
+	s.profiles = profiles
+	topics, err := config.LoadTopics(configFile)
+	if err != nil {
+		dialog.ShowError(err, app)
+		topics = config.NewDefaultTopicsConfig()
+	}
+	s.topics = topics
+	s.scanScreen = NewScanOverlay(app, s.mqttOpts, s.topics)
 	s.user = widget.NewEntry()
 	s.broker = widget.NewEntry()
 	s.password = widget.NewPasswordEntry()
 	s.port = widget.NewEntry()
+	s.tls = widget.NewCheck("", nil)
+	s.caFile = widget.NewEntry()
+	s.serverId = widget.NewEntry()
+	s.profile = widget.NewSelectEntry(nil)
 
 	s.createForm()
 	s.dialog.Resize(fyne.NewSize(constant.MainWindowW/2, constant.MainWindowH/2))
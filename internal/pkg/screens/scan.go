@@ -1,6 +1,7 @@
 package screens
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -13,6 +14,7 @@ import (
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/freedreamer82/mqtt-shell/internal/pkg/config"
 	mqtt "github.com/freedreamer82/mqtt-shell/pkg/mqttchat"
+	log "github.com/sirupsen/logrus"
 )
 
 type OnClientChosen func(c string)
@@ -28,6 +30,7 @@ type ScanScreen struct {
 	clientName  string
 	cb          OnClientChosen
 	waitBar     *WaitBar
+	topics      config.TopicsConfig
 }
 
 func (s *ScanScreen) GetContainer() fyne.CanvasObject {
@@ -54,32 +57,17 @@ func (s *ScanScreen) Scan() {
 
 	//clear clients list...
 	s.clients = []mqtt.Client{}
-	discovery := mqtt.NewBeaconDiscovery(s.mqttOpts, config.BeaconRequestTopic, config.BeaconReplyTopic, 5,
-		config.BeaconConverter)
-
-	clients := make(chan mqtt.Client, 100)
-	quit := make(chan bool)
-
-	go func() {
-		for {
-			select {
-			case client := <-clients:
-				//fmt.Printf("Ip: %15s - Id: %20s - Version: %10s - Time: %s - Uptime: %s \r\n", client.Ip,
-				//	client.Id, client.Version, client.Time, client.Uptime)
-				s.clients = append(s.clients, client)
-			case <-quit:
-				fmt.Printf("End Scan...")
-				return
-			}
-
-		}
-	}()
+	discovery := mqtt.NewBeaconDiscovery(s.mqttOpts, s.topics.WhoamiTopic(), s.topics.EventFilter(), 5,
+		s.topics.BeaconConverter)
 
 	s.waitBar.Resize(fyne.NewSize(s.app.Canvas().Size().Width/2, s.app.Canvas().Size().Height/20))
 	s.waitBar.Show()
 
-	discovery.Run(clients)
-	quit <- true
+	clients, err := discovery.Discover(context.Background(), nil)
+	if err != nil {
+		log.Errorf("scan: %s", err.Error())
+	}
+	s.clients = clients
 
 	s.waitBar.Hide()
 	s.ShowPopUp()
@@ -110,6 +98,18 @@ func (s *ScanScreen) ShowPopUp() {
 		msg = append(msg, "Ip: "+s.clients[s.selectedCmd].Ip)
 		msg = append(msg, "Time: "+s.clients[s.selectedCmd].Time)
 		msg = append(msg, "Uptime: "+s.clients[s.selectedCmd].Uptime)
+		if host := s.clients[s.selectedCmd].Host; host != nil {
+			msg = append(msg, "Hostname: "+host.Hostname)
+			msg = append(msg, "Os: "+host.Os+"/"+host.Arch+" "+host.Kernel)
+			msg = append(msg, "Addresses: "+strings.Join(host.Addresses, " "))
+			msg = append(msg, "Load: "+host.Load)
+			msg = append(msg, "Memory: "+host.Memory)
+			msg = append(msg, "Capabilities: "+strings.Join(host.Capabilities, ","))
+			msg = append(msg, "Labels: "+mqtt.FormatLabels(host.Labels))
+		}
+		if conflicts := s.clients[s.selectedCmd].Conflicts; len(conflicts) > 0 {
+			msg = append(msg, "ID COLLISION with: "+strings.Join(conflicts, " "))
+		}
 
 		dialog.ShowInformation("Info", strings.Join(msg, "\n"), s.app)
 	})
@@ -148,9 +148,9 @@ func (s *ScanScreen) ShowPopUp() {
 	s.container.Show()
 }
 
-func NewScanOverlay(app fyne.Window, opt *MQTT.ClientOptions) *ScanScreen {
+func NewScanOverlay(app fyne.Window, opt *MQTT.ClientOptions, topics config.TopicsConfig) *ScanScreen {
 
-	s := ScanScreen{mqttOpts: opt}
+	s := ScanScreen{mqttOpts: opt, topics: topics}
 
 	s.waitBar = NewWaitBar(app)
 	s.selectedCmd = -1
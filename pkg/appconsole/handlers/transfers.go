@@ -0,0 +1,90 @@
+package appconsole
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/freedreamer82/go-console/pkg/console"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp"
+	"github.com/olekukonko/tablewriter"
+)
+
+const CommandTransfers = "transfers"
+const CommandTransfersHelp = "transfers - List the file transfers in progress"
+
+const CommandCancel = "cancel"
+const CommandCancelHelp = "cancel <uuid> - Cancel a file transfer"
+
+type TransfersCommand struct {
+	console.ConsoleCommand
+	cpServer *mqttcp.MqttServerCp
+}
+
+func (t *TransfersCommand) handler() string {
+	var buffer bytes.Buffer
+	table := tablewriter.NewWriter(&buffer)
+	table.Header([]string{"UUID", "Client", "Command", "Path", "Progress", "Rate", "ETA"})
+
+	for _, tr := range t.cpServer.Transfers() {
+		progress := humanize.IBytes(uint64(tr.Done))
+		if tr.Percent() >= 0 {
+			progress = fmt.Sprintf("%s (%.1f%%)", progress, tr.Percent())
+		}
+		eta := "-"
+		if tr.ETA() >= 0 {
+			eta = tr.ETA().Round(time.Second).String()
+		}
+		table.Append([]string{
+			tr.UUID,
+			tr.ClientUUID,
+			tr.Cmd,
+			tr.Path,
+			progress,
+			humanize.IBytes(uint64(tr.Rate())) + "/s",
+			eta,
+		})
+	}
+
+	table.Render()
+	return buffer.String()
+}
+
+func NewTransfersCommand(cpServer *mqttcp.MqttServerCp) *console.ConsoleCommand {
+
+	tr := TransfersCommand{cpServer: cpServer}
+
+	var c = console.NewConsoleCommand(
+		CommandTransfers,
+		func(c *console.Console, command *console.ConsoleCommand, args []string) console.CommandError {
+			c.Print(tr.handler())
+			return console.N0_ERR
+		},
+		CommandTransfersHelp,
+	)
+	tr.ConsoleCommand = *c
+	return &tr.ConsoleCommand
+}
+
+func NewCancelCommand(cpServer *mqttcp.MqttServerCp) *console.ConsoleCommand {
+
+	var c = console.NewConsoleCommand(
+		CommandCancel,
+		func(c *console.Console, command *console.ConsoleCommand, args []string) console.CommandError {
+			if len(args) == 0 || args[len(args)-1] == CommandCancel {
+				c.Print(CommandCancelHelp)
+				return console.N0_ERR
+			}
+			err := cpServer.CancelTransfer(args[len(args)-1])
+			if err != nil {
+				c.Print(err.Error())
+			} else {
+				c.Print("transfer canceled")
+			}
+			return console.N0_ERR
+		},
+		CommandCancelHelp,
+	)
+	return c
+}
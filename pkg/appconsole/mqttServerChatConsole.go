@@ -7,6 +7,7 @@ import (
 	"github.com/freedreamer82/go-console/pkg/console"
 	appconsole "github.com/freedreamer82/mqtt-shell/pkg/appconsole/handlers"
 	chat "github.com/freedreamer82/mqtt-shell/pkg/mqttchat" // Import mqttchat
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp"
 )
 
 // MqttServerChatConsole manages an interactive console for the MQTT server.
@@ -58,6 +59,12 @@ func NewMqttServerChatConsole(mqttChat *chat.MqttServerChat, host string, port i
 	return handler
 }
 
+// SetCpServer adds the commands managing the file transfers of the copy server.
+func (c *MqttServerChatConsole) SetCpServer(cpServer *mqttcp.MqttServerCp) {
+	c.cmds = append(c.cmds, appconsole.NewTransfersCommand(cpServer))
+	c.cmds = append(c.cmds, appconsole.NewCancelCommand(cpServer))
+}
+
 // Start starts the interactive console.
 func (c *MqttServerChatConsole) Start() {
 	log.Printf("MQTT console started on port %d. Type 'help' for a list of commands.\n", c.port)
@@ -163,6 +163,15 @@ func (m *Worker) onBrokerDisconnect(client MQTT.Client, err error) {
 	log.Debug("BROKER disconnected !", err)
 }
 
+// PublishRetained publishes payload as the message the broker keeps for topic and hands to new subscribers.
+func (m *Worker) PublishRetained(topic string, payload interface{}) {
+	if m.client != nil && payload != nil {
+		m.client.Publish(topic, mqttQOS, true, payload)
+	} else {
+		log.Warnf("Publish fallita: client MQTT nullo o payload nullo (topic: %s)", topic)
+	}
+}
+
 func (m *Worker) Publish(topic string, payload interface{}) {
 	if m.client != nil && payload != nil {
 		m.client.Publish(topic, mqttQOS, false, payload)
@@ -0,0 +1,202 @@
+package mqttchat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// BeaconFilter selects the servers found by a discovery, empty fields match every server.
+type BeaconFilter struct {
+	// glob on the node id
+	Id string
+	// glob on the version
+	Version string
+	// network the ip of the server must be in
+	Subnet *net.IPNet
+	// requirements on the labels of the server
+	Labels LabelSelector
+}
+
+func NewBeaconFilter(id string, version string, subnet string, labels string) (*BeaconFilter, error) {
+	selector, err := ParseLabelSelector(labels)
+	if err != nil {
+		return nil, err
+	}
+	f := BeaconFilter{Id: id, Version: version, Labels: selector}
+	for _, glob := range []string{id, version} {
+		_, err := path.Match(glob, "")
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("pattern %s : %s", glob, err.Error()))
+		}
+	}
+	if subnet != "" {
+		_, network, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil, err
+		}
+		f.Subnet = network
+	}
+	return &f, nil
+}
+
+// Match tells if c is selected, a nil filter selects everything.
+func (f *BeaconFilter) Match(c Client) bool {
+	if f == nil {
+		return true
+	}
+	if f.Id != "" {
+		if matched, _ := path.Match(f.Id, c.Id); !matched {
+			return false
+		}
+	}
+	if f.Version != "" {
+		if matched, _ := path.Match(f.Version, c.Version); !matched {
+			return false
+		}
+	}
+	if f.Subnet != nil {
+		ip := net.ParseIP(c.Ip)
+		if ip == nil || !f.Subnet.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.Labels) > 0 {
+		var labels map[string]string
+		if c.Host != nil {
+			labels = c.Host.Labels
+		}
+		if !f.Labels.Match(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	labelOp_Equal    = "="
+	labelOp_NotEqual = "!="
+	labelOp_In       = "in"
+	labelOp_NotIn    = "notin"
+	labelOp_Exists   = "exists"
+	labelOp_Missing  = "!"
+)
+
+type labelRequirement struct {
+	key    string
+	op     string
+	values []string
+}
+
+// LabelSelector is a list of requirements on labels, all of them must hold.
+// It is parsed from comma separated terms, values are globs and keys are case insensitive:
+//
+//	site=milan,role!=gw*,customer,!test,tier in (1,2),zone notin (eu-*)
+type LabelSelector []labelRequirement
+
+var labelSetRegexp = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+
+func ParseLabelSelector(expr string) (LabelSelector, error) {
+	selector := LabelSelector{}
+	if strings.TrimSpace(expr) == "" {
+		return selector, nil
+	}
+	for _, term := range splitLabelTerms(expr) {
+		r, err := parseLabelRequirement(strings.TrimSpace(term))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("label selector %s : %s", expr, err.Error()))
+		}
+		selector = append(selector, r)
+	}
+	return selector, nil
+}
+
+// splitLabelTerms splits on the commas outside of parentheses.
+func splitLabelTerms(expr string) []string {
+	terms := []string{}
+	depth, start := 0, 0
+	for i, c := range expr {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, expr[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(terms, expr[start:])
+}
+
+func parseLabelRequirement(term string) (labelRequirement, error) {
+	r := labelRequirement{}
+	if m := labelSetRegexp.FindStringSubmatch(term); m != nil {
+		r.key, r.op = m[1], m[2]
+		for _, v := range strings.Split(m[3], ",") {
+			r.values = append(r.values, strings.TrimSpace(v))
+		}
+	} else if i := strings.Index(term, "!="); i >= 0 {
+		r.key, r.op, r.values = term[:i], labelOp_NotEqual, []string{strings.TrimSpace(term[i+2:])}
+	} else if i := strings.Index(term, "="); i >= 0 {
+		// == is accepted too
+		r.key, r.op, r.values = term[:i], labelOp_Equal, []string{strings.TrimSpace(strings.TrimPrefix(term[i+1:], "="))}
+	} else if strings.HasPrefix(term, "!") {
+		r.key, r.op = term[1:], labelOp_Missing
+	} else {
+		r.key, r.op = term, labelOp_Exists
+	}
+
+	r.key = strings.ToLower(strings.TrimSpace(r.key))
+	if r.key == "" || strings.ContainsAny(r.key, " \t()!=") {
+		return r, errors.New(fmt.Sprintf("invalid requirement '%s'", term))
+	}
+	for _, v := range r.values {
+		if _, err := path.Match(v, ""); err != nil {
+			return r, errors.New(fmt.Sprintf("pattern %s : %s", v, err.Error()))
+		}
+	}
+	return r, nil
+}
+
+// Match tells if the labels meet all the requirements.
+func (s LabelSelector) Match(labels map[string]string) bool {
+	lower := make(map[string]string, len(labels))
+	for k, v := range labels {
+		lower[strings.ToLower(k)] = v
+	}
+	for _, r := range s {
+		value, exist := lower[r.key]
+		matchAny := false
+		for _, glob := range r.values {
+			if matched, _ := path.Match(glob, value); matched && exist {
+				matchAny = true
+				break
+			}
+		}
+		switch r.op {
+		case labelOp_Exists:
+			if !exist {
+				return false
+			}
+		case labelOp_Missing:
+			if exist {
+				return false
+			}
+		case labelOp_Equal, labelOp_In:
+			if !matchAny {
+				return false
+			}
+		case labelOp_NotEqual, labelOp_NotIn:
+			if matchAny {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package mqttchat
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// HostInfo describes the machine running a server, advertised in its beacon.
+type HostInfo struct {
+	Hostname string `json:"hostname,omitempty"`
+	Os       string `json:"os,omitempty"`
+	Kernel   string `json:"kernel,omitempty"`
+	Arch     string `json:"arch,omitempty"`
+	// addresses of all the interfaces but loopback, in cidr notation
+	Addresses []string `json:"addresses,omitempty"`
+	// load average over 1, 5 and 15 minutes
+	Load string `json:"load,omitempty"`
+	// available and total memory
+	Memory       string            `json:"memory,omitempty"`
+	Plugins      []string          `json:"plugins,omitempty"`
+	Capabilities []string          `json:"capabilities,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+}
+
+// collectHostInfo reads the current state of the machine, the parts not available on
+// this os are left empty.
+func collectHostInfo() *HostInfo {
+	h := HostInfo{Os: runtime.GOOS, Arch: runtime.GOARCH}
+	h.Hostname, _ = os.Hostname()
+	h.Kernel = hostKernel()
+	h.Load = hostLoad()
+	h.Memory = hostMemory()
+	h.Addresses = hostAddresses()
+	return &h
+}
+
+func hostAddresses() []string {
+	addresses := []string{}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return addresses
+	}
+	for _, interf := range interfaces {
+		if interf.Flags&net.FlagLoopback != 0 || interf.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := interf.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			addresses = append(addresses, ipNet.String())
+		}
+	}
+	return addresses
+}
+
+// FormatLabels joins the labels as key=value sorted by key.
+func FormatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+labels[k])
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package mqttchat
+
+func hostKernel() string {
+	return ""
+}
+
+func hostLoad() string {
+	return ""
+}
+
+func hostMemory() string {
+	return ""
+}
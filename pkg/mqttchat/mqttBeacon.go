@@ -1,35 +1,78 @@
 package mqttchat
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
-	"github.com/freedreamer82/mqtt-shell/pkg/mqtt"
-	"math/rand"
+	"errors"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/freedreamer82/mqtt-shell/pkg/mqtt"
+
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	log "github.com/sirupsen/logrus"
 )
 
 type Client struct {
-	Id      string
-	Ip      string
-	Version string
-	Time    string
-	Uptime  string
+	Id      string `json:"id"`
+	Ip      string `json:"ip"`
+	Version string `json:"version"`
+	Time    string `json:"time"`
+	Uptime  string `json:"uptime"`
+	// nil for older servers
+	Host *HostInfo `json:"host,omitempty"`
+	// instance of the server, new at every start
+	Uuid string `json:"uuid,omitempty"`
+	// other instances running with the same id
+	Conflicts []string `json:"conflicts,omitempty"`
 }
 
+type EventType string
+
+const (
+	Event_Online  EventType = "online"
+	Event_Offline EventType = "offline"
+)
+
+// Event is a change of presence of a server.
+type Event struct {
+	Type   EventType
+	Client Client
+}
+
+// events queued for a slow reader before they are dropped
+const beaconSinkSize = 256
+
+const beaconConnectRetry = 5 * time.Second
+
+// BeaconDiscovery finds the servers from their beacons. Discover and Watch can run at
+// the same time and from many goroutines, they share one subscription.
+// A client given with WithDiscoveryMqttClient is never connected nor disconnected here,
+// otherwise the discovery connects while in use and disconnects when the last user is done.
 type BeaconDiscovery struct {
 	mqttClient          MQTT.Client
-	mqttOpts            *MQTT.ClientOptions
+	sharedClient        bool
 	beaconRequestTopic  string
 	beaconResponseTopic string
 	timeout             time.Duration
-	closeChan           chan bool
 	converter           NodeIdFromTopic
-	clients             chan Client
 	cb                  mqtt.ConnectionCallback
-	timerCheckEnabled   bool
+	// serializes the first and last user, connecting and subscribing
+	lifeMutex sync.Mutex
+	mutex     sync.Mutex
+	sinks     map[*beaconSink]bool
+	// last event of every node, replayed to users joining a running subscription
+	known map[string]Event
+	// instances online of every node, more than one is an id collision
+	instances map[string]map[string]bool
+	// stop and done of the connection of the own client
+	stop chan bool
+	done chan bool
+}
+
+type beaconSink struct {
+	in chan Event
 }
 
 type BeaconDiscoveryOption func(*BeaconDiscovery)
@@ -41,6 +84,7 @@ func WithDiscoveryConnectionCallback(cb mqtt.ConnectionCallback) BeaconDiscovery
 	}
 }
 
+// WithDiscoveryMqttClient runs the discovery on a client connected by the caller.
 func WithDiscoveryMqttClient(client MQTT.Client) BeaconDiscoveryOption {
 	return func(h *BeaconDiscovery) {
 		h.mqttClient = client
@@ -50,56 +94,198 @@ func WithDiscoveryMqttClient(client MQTT.Client) BeaconDiscoveryOption {
 func NewBeaconDiscovery(mqttOpts *MQTT.ClientOptions,
 	beaconRequestTopic string, beaconResponseTopic string, timeoutDiscoverySec uint64,
 	converter NodeIdFromTopic, opts ...BeaconDiscoveryOption) *BeaconDiscovery {
-	rand.Seed(time.Now().UnixNano())
 
 	timeout := time.Duration(timeoutDiscoverySec * uint64(time.Second))
 
-	b := BeaconDiscovery{mqttOpts: mqttOpts, cb: nil,
-		beaconRequestTopic: beaconRequestTopic, beaconResponseTopic: beaconResponseTopic, timeout: timeout, converter: converter, timerCheckEnabled: true}
-
-	b.closeChan = make(chan bool)
-
-	b.mqttOpts.SetConnectionLostHandler(b.onBrokerDisconnect)
-	b.mqttOpts.SetOnConnectHandler(b.onBrokerConnect)
+	b := BeaconDiscovery{beaconRequestTopic: beaconRequestTopic, beaconResponseTopic: beaconResponseTopic,
+		timeout: timeout, converter: converter, sinks: make(map[*beaconSink]bool), known: make(map[string]Event),
+		instances: make(map[string]map[string]bool)}
 
 	for _, opt := range opts {
 		// Call the option giving the instantiated
 		opt(&b)
 	}
 
-	if b.mqttClient == nil {
-		b.mqttClient = MQTT.NewClient(b.mqttOpts)
-
+	if b.mqttClient != nil {
+		b.sharedClient = true
+	} else {
+		// a copy, the handlers must not end up in the options of the caller
+		ownOpts := *mqttOpts
+		ownOpts.SetAutoReconnect(true)
+		ownOpts.SetConnectRetry(false)
+		ownOpts.SetConnectionLostHandler(b.onBrokerDisconnect)
+		ownOpts.SetOnConnectHandler(b.onBrokerConnect)
+		b.mqttClient = MQTT.NewClient(&ownOpts)
 	}
-
 	return &b
 }
 
-func (b *BeaconDiscovery) Run(ch chan Client) {
+// Discover collects the servers answering within the discovery timeout, one per node id
+// and sorted by id. If ctx ends first the servers found so far are returned with its error.
+func (b *BeaconDiscovery) Discover(ctx context.Context, filter *BeaconFilter) ([]Client, error) {
+	collectCtx := ctx
+	if b.timeout > 0 {
+		var cancel context.CancelFunc
+		collectCtx, cancel = context.WithTimeout(ctx, b.timeout)
+		defer cancel()
+	}
 
-	b.brokerStartConnect()
+	s, err := b.addSink()
+	if err != nil {
+		return nil, err
+	}
+	defer b.removeSink(s)
+
+	found := make(map[string]Client)
+	for collectCtx.Err() == nil {
+		select {
+		case ev := <-s.in:
+			if ev.Type == Event_Offline {
+				delete(found, ev.Client.Id)
+			} else if filter.Match(ev.Client) {
+				found[ev.Client.Id] = ev.Client
+			}
+		case <-collectCtx.Done():
+		}
+	}
 
-	b.clients = ch
+	clients := make([]Client, 0, len(found))
+	for _, c := range found {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Id < clients[j].Id })
+	if ctx.Err() != nil {
+		return clients, ctx.Err()
+	} else if len(clients) == 0 && !b.mqttClient.IsConnectionOpen() {
+		return nil, errors.New("not connected to the broker")
+	}
+	return clients, nil
+}
 
-	start := time.Now()
+// Watch streams the changes of presence of the servers until ctx ends, then the channel
+// is closed. The current state comes first, as the presence of the servers is retained
+// by the broker; a node is reported again only when it goes online or offline or its
+// ip or version change.
+func (b *BeaconDiscovery) Watch(ctx context.Context) <-chan Event {
+	out := make(chan Event)
+	s, err := b.addSink()
+	if err != nil {
+		log.Errorf("beacon watch: %s", err.Error())
+		close(out)
+		return out
+	}
 
 	go func() {
+		defer close(out)
+		defer b.removeSink(s)
+		last := make(map[string]Event)
 		for {
-			time.Sleep(time.Second)
-			now := time.Now()
-			if now.Sub(start) > b.timeout {
-				b.closeChan <- true
+			select {
+			case ev := <-s.in:
+				prev, seen := last[ev.Client.Id]
+				if seen && prev.Type == ev.Type && prev.Client.Ip == ev.Client.Ip && prev.Client.Version == ev.Client.Version &&
+					len(prev.Client.Conflicts) == len(ev.Client.Conflicts) {
+					continue
+				}
+				last[ev.Client.Id] = ev
+				select {
+				case out <- ev:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
+	return out
+}
 
-	select {
-	case <-b.closeChan:
-		{
-			b.timerCheckEnabled = false
-			log.Infoln("Stop beacon discovery")
-			b.mqttClient.Disconnect(100)
+// addSink registers a new user of the discovery, the first one starts the subscription.
+func (b *BeaconDiscovery) addSink() (*beaconSink, error) {
+	b.lifeMutex.Lock()
+	defer b.lifeMutex.Unlock()
+
+	b.mutex.Lock()
+	first := len(b.sinks) == 0
+	s := &beaconSink{in: make(chan Event, len(b.known)+beaconSinkSize)}
+	b.sinks[s] = true
+	for _, ev := range b.known {
+		s.in <- ev
+	}
+	b.mutex.Unlock()
+
+	if !first {
+		// retained beacons come only on subscribe, the known ones were replayed
+		b.sendBeaconRequest()
+		return s, nil
+	}
+	if b.sharedClient {
+		err := errors.New("mqtt client not connected")
+		if b.mqttClient.IsConnected() {
+			err = b.subscribe()
 		}
+		if err != nil {
+			b.mutex.Lock()
+			delete(b.sinks, s)
+			b.mutex.Unlock()
+			return nil, err
+		}
+		b.sendBeaconRequest()
+		return s, nil
+	}
+	if b.done != nil {
+		// the previous connection is still closing
+		<-b.done
+	}
+	b.stop, b.done = make(chan bool), make(chan bool)
+	go b.connect(b.stop, b.done)
+	return s, nil
+}
+
+// connect keeps the own client connected until stop is closed, then disconnects it.
+// The subscription and the request follow in onBrokerConnect.
+func (b *BeaconDiscovery) connect(stop chan bool, done chan bool) {
+	defer close(done)
+	for {
+		token := b.mqttClient.Connect()
+		token.Wait()
+		if token.Error() == nil {
+			break
+		}
+		log.Debugf("beacon discovery: %s, retrying", token.Error().Error())
+		select {
+		case <-time.After(beaconConnectRetry):
+		case <-stop:
+			return
+		}
+	}
+	<-stop
+	b.mqttClient.Disconnect(100)
+}
+
+// removeSink unregisters a user, the last one ends the subscription.
+func (b *BeaconDiscovery) removeSink(s *beaconSink) {
+	b.lifeMutex.Lock()
+	defer b.lifeMutex.Unlock()
+
+	b.mutex.Lock()
+	delete(b.sinks, s)
+	last := len(b.sinks) == 0
+	if last {
+		b.known = make(map[string]Event)
+		b.instances = make(map[string]map[string]bool)
+	}
+	b.mutex.Unlock()
+
+	if !last {
+		return
+	} else if b.sharedClient {
+		if b.mqttClient.IsConnected() {
+			b.mqttClient.Unsubscribe(b.beaconResponseTopic)
+		}
+	} else {
+		close(b.stop)
 	}
 }
 
@@ -108,7 +294,7 @@ func (b *BeaconDiscovery) onBrokerConnect(client MQTT.Client) {
 		b.cb(mqtt.ConnectionStatus_Connected)
 	}
 	log.Debugln("Connect to broker")
-	err := b.subscribeMessagesToBroker()
+	err := b.subscribe()
 	if err != nil {
 		log.Error("error in subscription")
 	}
@@ -117,19 +303,15 @@ func (b *BeaconDiscovery) onBrokerConnect(client MQTT.Client) {
 
 func (b *BeaconDiscovery) onBrokerDisconnect(client MQTT.Client, err error) {
 	log.Debug("BROKER disconnected !", err)
-	b.closeChan <- true
 	if b.cb != nil {
 		b.cb(mqtt.ConnectionStatus_Disconnected)
 	}
 }
 
-func (b *BeaconDiscovery) subscribeMessagesToBroker() error {
-	client := b.mqttClient
+func (b *BeaconDiscovery) subscribe() error {
 	if b.beaconResponseTopic != "" {
-		// Go For MQTT Publish
-		log.Printf("Sub topic %s, Qos: %d", b.beaconResponseTopic, 0)
-		if token := client.Subscribe(b.beaconResponseTopic, 0, b.onBeaconDiscovery); token.Error() != nil {
-			// Return Error
+		log.Debugf("Sub topic %s, Qos: %d", b.beaconResponseTopic, 0)
+		if token := b.mqttClient.Subscribe(b.beaconResponseTopic, 0, b.onBeaconDiscovery); token.Error() != nil {
 			return token.Error()
 		}
 	}
@@ -139,61 +321,66 @@ func (b *BeaconDiscovery) subscribeMessagesToBroker() error {
 func (b *BeaconDiscovery) onBeaconDiscovery(client MQTT.Client, msg MQTT.Message) {
 	if b.converter == nil {
 		log.Errorln("Node Id converter nil ?")
-	} else {
-		nodeId := b.converter(msg.Topic())
-		jData := MqttJsonData{}
-		err := json.Unmarshal(msg.Payload(), &jData)
-		if err != nil {
-			log.Errorln("error deserializing message")
-		}
-		c := Client{Id: nodeId, Ip: jData.Ip, Version: jData.Version,
-			Time: jData.Datetime, Uptime: jData.Data}
+		return
+	} else if len(msg.Payload()) == 0 {
+		// retained presence cleared
+		return
+	}
+	nodeId := b.converter(msg.Topic())
+	jData := MqttJsonData{}
+	err := json.Unmarshal(msg.Payload(), &jData)
+	if err != nil {
+		log.Errorln("error deserializing message")
+		return
+	}
+	ev := Event{Type: Event_Online, Client: Client{Id: nodeId, Ip: jData.Ip, Version: jData.Version,
+		Time: jData.Datetime, Uptime: jData.Data, Host: jData.Host, Uuid: jData.ClientUUID}}
+	if jData.Cmd == MSG_DATA_TYPE_CMD_OFFLINE {
+		ev.Type = Event_Offline
+	}
 
-		if b.clients != nil {
-			b.clients <- c
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ev.Client.Conflicts = b.trackInstance(ev)
+	b.known[nodeId] = ev
+	for s := range b.sinks {
+		select {
+		case s.in <- ev:
+		default:
+			log.Warnf("beacon of %s dropped, reader too slow", nodeId)
 		}
+	}
+}
 
-		uptimeDuration, err := time.ParseDuration(jData.Data)
-		if err != nil {
-			log.Errorln("error parsing uptime duration:", err)
-			return
-		}
-		formattedUptime := fmt.Sprintf("%d days %02d:%02d", int(uptimeDuration.Hours())/24, int(uptimeDuration.Hours())%24, int(uptimeDuration.Minutes())%60)
-		fmt.Printf("Ip: %15s - Id: %20s - Version: %10s - Time: %s - Uptime: %s \r\n", jData.Ip, nodeId, jData.Version, jData.Datetime, formattedUptime)	}
+// trackInstance records the instance of a beacon and returns the other ones online with
+// the same node id.
+func (b *BeaconDiscovery) trackInstance(ev Event) []string {
+	if ev.Client.Uuid == "" {
+		return nil
+	}
+	instances, exist := b.instances[ev.Client.Id]
+	if !exist {
+		instances = make(map[string]bool)
+		b.instances[ev.Client.Id] = instances
+	}
+	if ev.Type == Event_Offline {
+		delete(instances, ev.Client.Uuid)
+	} else {
+		instances[ev.Client.Uuid] = true
+	}
 
+	var conflicts []string
+	for uuid := range instances {
+		if uuid != ev.Client.Uuid {
+			conflicts = append(conflicts, uuid)
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts
 }
 
 func (b *BeaconDiscovery) sendBeaconRequest() {
-	if b.beaconRequestTopic != "" {
+	if b.beaconRequestTopic != "" && b.mqttClient.IsConnected() {
 		b.mqttClient.Publish(b.beaconRequestTopic, 0, false, []byte{})
 	}
 }
-
-func (b *BeaconDiscovery) brokerStartConnect() {
-
-	//on first connection library doesn't retry...do it manually
-	go func(b *BeaconDiscovery) {
-		b.mqttClient.Connect()
-		retry := time.NewTicker(30 * time.Second)
-		defer retry.Stop()
-
-		for {
-			select {
-			case <-retry.C:
-				if b.timerCheckEnabled {
-					if !b.mqttClient.IsConnected() {
-						if token := b.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-							log.Info("failed connection to broker retrying...")
-						}
-					} else {
-						return
-					}
-				} else {
-					return
-				}
-			}
-		}
-		fmt.Println("exit from check timer mqtt..")
-	}(b)
-
-}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/freedreamer82/mqtt-shell/pkg/mqtt"
@@ -25,6 +26,9 @@ const (
 	MSG_DATA_TYPE_CMD_AUTOCOMPLETE string = "autocomplete"
 	MSG_DATA_TYPE_CMD_PING         string = "ping"
 	MSG_DATA_TYPE_CMD_PONG         string = "pong"
+	// presence of a server on its beacon topic, retained by the broker
+	MSG_DATA_TYPE_CMD_BEACON  string = "beacon"
+	MSG_DATA_TYPE_CMD_OFFLINE string = "offline"
 )
 
 type SubScribeMessage struct {
@@ -47,6 +51,8 @@ type MqttJsonData struct {
 	CustomPrompt string `json:"customprompt"`
 	Flags        uint32 `json:"flags"`
 	CurrentPath  string `json:"currentpath"`
+	// host of the server, only in beacons
+	Host *HostInfo `json:"host,omitempty"`
 }
 
 type OnDataCallback func(data MqttJsonData)
@@ -64,6 +70,17 @@ type MqttChat struct {
 	isRunning          bool
 	netInterface       string
 	chatUuid           string
+	// advertised in the beacon
+	labels       map[string]string
+	capabilities []string
+	plugins      []string
+	// guards the settings changing while running, as the plugins
+	settingsMutex sync.RWMutex
+	// period of the beacon heartbeat, 0 sends it only on connect and on request
+	beaconInterval time.Duration
+	heartbeatStop  chan bool
+	// instances of other servers found running with the id of this one
+	collisions map[string]bool
 }
 
 // Costruttore con tutti i campi
@@ -222,7 +239,13 @@ func (m *MqttChat) sendBeacon() {
 
 		now := time.Now().Format(time.DateTime)
 		fromNow := fmtDuration(m.uptime())
-		reply := MqttJsonData{Ip: m.getIpAddress(), Version: m.version, Cmd: "beacon", Datetime: now, Data: fromNow}
+		reply := MqttJsonData{Ip: m.getIpAddress(), Version: m.version, Cmd: MSG_DATA_TYPE_CMD_BEACON, Datetime: now, Data: fromNow}
+		reply.Host = collectHostInfo()
+		reply.Host.Labels = m.labels
+		reply.Host.Capabilities = m.capabilities
+		m.settingsMutex.RLock()
+		reply.Host.Plugins = m.plugins
+		m.settingsMutex.RUnlock()
 		//get unique chat id can not be clientUUID
 		reply.ClientUUID = m.chatUuid
 
@@ -231,7 +254,65 @@ func (m *MqttChat) sendBeacon() {
 			fmt.Println(err)
 			return
 		}
-		m.worker.Publish(m.beaconTopic, b)
+		m.worker.PublishRetained(m.beaconTopic, b)
+	}
+}
+
+// offlineBeacon is the presence message replacing the retained beacon when the server goes away.
+func (m *MqttChat) offlineBeacon() []byte {
+	offline := MqttJsonData{Version: m.version, Cmd: MSG_DATA_TYPE_CMD_OFFLINE, ClientUUID: m.chatUuid}
+	b, _ := json.Marshal(offline)
+	return b
+}
+
+// onOwnBeacon watches the beacon topic of this server for beacons of other instances,
+// which means two servers are running with the same id and share the command topic.
+func (m *MqttChat) onOwnBeacon(client MQTT.Client, msg MQTT.Message) {
+	jData := MqttJsonData{}
+	if len(msg.Payload()) == 0 || json.Unmarshal(msg.Payload(), &jData) != nil {
+		return
+	} else if jData.ClientUUID == "" || jData.ClientUUID == m.chatUuid {
+		return
+	}
+
+	if jData.Cmd == MSG_DATA_TYPE_CMD_OFFLINE {
+		// the other instance, or the late will of a previous run, replaced our presence
+		m.sendBeacon()
+		return
+	} else if msg.Retained() {
+		// presence left on the broker, not a server alive now
+		return
+	}
+	log.Errorf("ID COLLISION: another server (instance %s, ip %s, version %s) is running with the id of this server (instance %s), "+
+		"both receive the same commands! Give every server its own id", jData.ClientUUID, jData.Ip, jData.Version, m.chatUuid)
+	if !m.collisions[jData.ClientUUID] {
+		m.collisions[jData.ClientUUID] = true
+		// the other one may not beacon for a while, let it know at once
+		m.sendBeacon()
+	}
+}
+
+// heartbeat republishes the beacon every beaconInterval until stop is closed.
+func (m *MqttChat) heartbeat(stop chan bool) {
+	ticker := time.NewTicker(m.beaconInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if m.worker.IsConnected() {
+				m.sendBeacon()
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// setPresenceWill makes the broker publish the offline beacon if the connection drops
+// without a disconnect, so watchers see the server gone at once.
+func (m *MqttChat) setPresenceWill() {
+	if m.beaconTopic != "" {
+		m.worker.GetOpts().SetBinaryWill(m.beaconTopic, m.offlineBeacon(), 1, true)
 	}
 }
 
@@ -272,11 +353,13 @@ func NewChat(mqttOpts *MQTT.ClientOptions, rxTopic string, txtopic string, versi
 	m.startTime = time.Now()
 	m.chatUuid = shortuuid.New()
 	m.timeoutCmdShell = defaultTimeoutCmd
+	m.collisions = make(map[string]bool)
 	for _, opt := range opts {
 		// Call the option giving the instantiated
 		// *House as the argument
 		opt(&m)
 	}
+	m.setPresenceWill()
 
 	m.worker.AddConnectionCB(
 		func(status mqtt.ConnectionStatus) {
@@ -285,6 +368,7 @@ func NewChat(mqttOpts *MQTT.ClientOptions, rxTopic string, txtopic string, versi
 				{
 					m.worker.Subscribe(m.rxTopic, m.onBrokerData)
 					m.worker.Subscribe(m.beaconRequestTopic, m.onBeaconRequest)
+					m.worker.Subscribe(m.beaconTopic, m.onOwnBeacon)
 					m.sendBeacon()
 				}
 			case mqtt.ConnectionStatus_Disconnected:
@@ -301,6 +385,10 @@ func NewChat(mqttOpts *MQTT.ClientOptions, rxTopic string, txtopic string, versi
 func (m *MqttChat) Start() {
 	m.isRunning = true
 	m.worker.StartMQTT()
+	if m.beaconTopic != "" && m.beaconInterval > 0 {
+		m.heartbeatStop = make(chan bool)
+		go m.heartbeat(m.heartbeatStop)
+	}
 }
 
 func (m *MqttChat) IsRunning() bool {
@@ -310,6 +398,15 @@ func (m *MqttChat) IsRunning() bool {
 func (m *MqttChat) Stop() {
 	m.worker.Unsubscribe(m.rxTopic)
 	m.worker.Unsubscribe(m.beaconRequestTopic)
+	if m.heartbeatStop != nil {
+		close(m.heartbeatStop)
+		m.heartbeatStop = nil
+	}
+	if m.beaconTopic != "" {
+		m.worker.Unsubscribe(m.beaconTopic)
+		// a clean disconnect does not fire the will
+		m.worker.PublishRetained(m.beaconTopic, m.offlineBeacon())
+	}
 	m.isRunning = false
 	m.worker.StopMQTT()
 }
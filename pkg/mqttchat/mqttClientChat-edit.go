@@ -0,0 +1,114 @@
+package mqttchat
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp/mft"
+)
+
+// edit downloads a remote file, opens it in $EDITOR and uploads it back if it changed.
+// The upload is refused when the remote file changed in the meantime, the edited
+// copy is kept so nothing is lost.
+func (m *MqttClientChat) edit(arg string) (string, error) {
+	remote, err := m.remotePath(arg)
+	if err != nil {
+		return "", err
+	}
+	remoteHash, err := m.cp.Hash(remote)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := os.MkdirTemp("", "mqtt-shell-edit-")
+	if err != nil {
+		return "", err
+	}
+	local := filepath.Join(dir, path.Base(remote))
+	err = m.withProgress(func(progress *chan mft.MftProgress) error {
+		_, errDownload := m.cp.Download(remote, local, progress)
+		return errDownload
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	before, err := fileDigest(local)
+	if err == nil {
+		err = runEditor(local)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	after, err := fileDigest(local)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	} else if after == before {
+		os.RemoveAll(dir)
+		return fmt.Sprintf("%s not changed", remote), nil
+	}
+
+	current, err := m.cp.Hash(remote)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("%s, your copy is kept in %s", err.Error(), local))
+	} else if current != remoteHash {
+		return "", errors.New(fmt.Sprintf("%s changed on the server meanwhile, your copy is kept in %s", remote, local))
+	}
+
+	m.cp.SetOverwrite(mqttcp.MqttCpOverwrite_Overwrite, "")
+	err = m.withProgress(func(progress *chan mft.MftProgress) error {
+		_, errUpload := m.cp.Upload(local, remote, progress)
+		return errUpload
+	})
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("%s, your copy is kept in %s", err.Error(), local))
+	}
+	os.RemoveAll(dir)
+	return fmt.Sprintf("%s saved", remote), nil
+}
+
+// runEditor opens file in $EDITOR, which can carry arguments too (e.g. "code --wait").
+func runEditor(file string) error {
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+		if runtime.GOOS == "windows" {
+			editor = []string{"notepad"}
+		}
+	}
+	cmd := exec.Command(editor[0], append(editor[1:], file)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return errors.New(fmt.Sprintf("editor %s: %s", editor[0], err.Error()))
+	}
+	return nil
+}
+
+func fileDigest(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
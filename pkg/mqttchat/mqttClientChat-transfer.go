@@ -0,0 +1,199 @@
+package mqttchat
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp/mft"
+)
+
+// Escape commands are run by the client instead of being sent to the server.
+const (
+	escapePut  = "!put"
+	escapeGet  = "!get"
+	escapeEdit = "!edit"
+)
+
+const escapeUsage = "usage: !put [-f] <local> [remote] | !get [-f] <remote> [local] | !edit <remote>, -f overwrites the destination\n"
+
+const progressBarWidth = 30
+
+// SetCpClient enables !put and !get, the copy client is meant to share the chat worker
+// (see mqttcp.WithOptionClientWorker).
+func (m *MqttClientChat) SetCpClient(cp *mqttcp.MqttClientCp) {
+	m.cp = cp
+}
+
+// handleEscapeCommand runs line if it is an escape command, telling if it was.
+func (m *MqttClientChat) handleEscapeCommand(line string) bool {
+	args := strings.Fields(line)
+	if len(args) == 0 || (args[0] != escapePut && args[0] != escapeGet && args[0] != escapeEdit) {
+		return false
+	}
+	if m.cp == nil {
+		m.print("file transfer not available in this session\n")
+		return true
+	}
+
+	overwrite := len(args) > 1 && args[1] == "-f" && args[0] != escapeEdit
+	if overwrite {
+		args = append(args[:1], args[2:]...)
+	}
+	if len(args) < 2 || len(args) > 3 || (args[0] == escapeEdit && len(args) != 2) {
+		m.print(escapeUsage)
+		return true
+	}
+	if overwrite {
+		m.cp.SetOverwrite(mqttcp.MqttCpOverwrite_Overwrite, "")
+	} else {
+		m.cp.SetOverwrite(mqttcp.MqttCpOverwrite_Fail, "")
+	}
+
+	var result string
+	var err error
+	if args[0] == escapePut {
+		result, err = m.put(args[1:])
+	} else if args[0] == escapeGet {
+		result, err = m.get(args[1:])
+	} else {
+		result, err = m.edit(args[1])
+	}
+	if err != nil {
+		m.printf("%s failed: %s\n", args[0], err.Error())
+	} else {
+		m.printf("%s\n", result)
+	}
+	return true
+}
+
+// remotePath makes p absolute from the current server path.
+func (m *MqttClientChat) remotePath(p string) (string, error) {
+	if path.IsAbs(p) {
+		return path.Clean(p), nil
+	} else if !path.IsAbs(m.currentServerPath) {
+		return "", errors.New("current server path unknown, use an absolute path")
+	}
+	return path.Join(m.currentServerPath, p), nil
+}
+
+func (m *MqttClientChat) put(args []string) (string, error) {
+	local := args[0]
+	info, err := os.Stat(local)
+	if err != nil {
+		return "", err
+	} else if info.IsDir() {
+		return "", errors.New(fmt.Sprintf("%s is a directory", local))
+	}
+
+	dest := filepath.Base(local)
+	if len(args) > 1 {
+		dest = args[1]
+		if strings.HasSuffix(dest, "/") {
+			dest += filepath.Base(local)
+		}
+	}
+	remote, err := m.remotePath(dest)
+	if err != nil {
+		return "", err
+	}
+
+	var result string
+	err = m.withProgress(func(progress *chan mft.MftProgress) error {
+		var errUpload error
+		result, errUpload = m.cp.Upload(local, remote, progress)
+		return errUpload
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s uploaded to %s: %s", local, remote, result), nil
+}
+
+func (m *MqttClientChat) get(args []string) (string, error) {
+	remote, err := m.remotePath(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	local := path.Base(remote)
+	if len(args) > 1 {
+		local = args[1]
+		if info, errStat := os.Stat(local); errStat == nil && info.IsDir() {
+			local = filepath.Join(local, path.Base(remote))
+		}
+	}
+	// the copy client checks the destination directory, which a bare name has not
+	local, err = filepath.Abs(local)
+	if err != nil {
+		return "", err
+	}
+
+	var received string
+	err = m.withProgress(func(progress *chan mft.MftProgress) error {
+		var errDownload error
+		received, errDownload = m.cp.Download(remote, local, progress)
+		return errDownload
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s downloaded to %s", remote, received), nil
+}
+
+// withProgress runs a transfer drawing its progress bar; Ctrl-C cancels it on both sides.
+func (m *MqttClientChat) withProgress(transfer func(progress *chan mft.MftProgress) error) error {
+	progressChan := make(chan mft.MftProgress, 200)
+	done := make(chan bool)
+	start := time.Now()
+	go func() {
+		for p := range progressChan {
+			m.print("\r" + progressBar(p, time.Since(start)))
+		}
+		m.print("\n")
+		close(done)
+	}()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	stop := make(chan bool)
+	go func() {
+		select {
+		case <-sigChan:
+			m.cp.CancelAll()
+		case <-stop:
+		}
+	}()
+
+	err := transfer(&progressChan)
+	signal.Stop(sigChan)
+	close(stop)
+	close(progressChan)
+	<-done
+	return err
+}
+
+func progressBar(p mft.MftProgress, elapsed time.Duration) string {
+	filled := int(p.Percent) * progressBarWidth / 100
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+
+	bytes := uint64(p.FrameReceived) * uint64(mft.MFT_PAYLOAD_SIZE())
+	rate := uint64(0)
+	if elapsed > 0 {
+		rate = uint64(float64(bytes) / elapsed.Seconds())
+	}
+	return fmt.Sprintf("[%s] %5.1f%% %s %s/s ", bar, p.Percent, humanize.IBytes(bytes), humanize.IBytes(rate))
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/chzyer/readline"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp"
 	"github.com/lithammer/shortuuid/v3"
 	log "github.com/sirupsen/logrus"
 )
@@ -42,6 +43,7 @@ type MqttClientChat struct {
 	lastServerActivityTime time.Time
 	pingTicker             *time.Ticker
 	pingDoneChan           chan struct{}
+	cp                     *mqttcp.MqttClientCp // Copy client for !put and !get, optional
 }
 
 // print prints the given arguments to the readline output.
@@ -264,6 +266,8 @@ func (m *MqttClientChat) clientTask() {
 		} else if line == "clear" {
 			m.clearScreen() // Use the clearScreen function
 			continue        // Do not send the command to the server
+		} else if m.handleEscapeCommand(line) {
+			continue // Run locally, like clear
 		}
 
 		// Send the command via MQTT
@@ -286,9 +290,14 @@ func (m *MqttClientChat) SetHistoryFile(file string, limit int) {
 	m.historyFile = file
 	m.historyLimit = limit
 
+	promptColor := prompt
+	if m.enableColor {
+		promptColor = fmt.Sprintf("%s%s%s", RED, prompt, NC)
+	}
+
 	// Reinitialize readline with the new history file and limit
 	rl, err := readline.NewEx(&readline.Config{
-		Prompt:       prompt,
+		Prompt:       promptColor,
 		HistoryFile:  m.historyFile,
 		HistoryLimit: m.historyLimit,
 		AutoComplete: m.setupDynamicAutocompletion(),
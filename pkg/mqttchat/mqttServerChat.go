@@ -116,14 +116,34 @@ func (m *MqttServerChat) Cleanup() {
 
 // GetInactivityTimeout returns the inactivity timeout duration.
 func (m *MqttServerChat) GetInactivityTimeout() time.Duration {
+	m.settingsMutex.RLock()
+	defer m.settingsMutex.RUnlock()
 	return m.inactivityTimeout
 }
 
 // SetInactivityTimeout sets the inactivity timeout duration.
 func (m *MqttServerChat) SetInactivityTimeout(timeout time.Duration) {
+	m.settingsMutex.Lock()
+	defer m.settingsMutex.Unlock()
 	m.inactivityTimeout = timeout
 }
 
+// SetAutoCompleteDirs sets the directories of the commands autocompleted, empty restores the default ones.
+func (m *MqttServerChat) SetAutoCompleteDirs(dirs []string) {
+	if len(dirs) == 0 {
+		dirs = defaultSystemDirs
+	}
+	m.settingsMutex.Lock()
+	defer m.settingsMutex.Unlock()
+	m.systemDirs = dirs
+}
+
+func (m *MqttServerChat) getAutoCompleteDirs() []string {
+	m.settingsMutex.RLock()
+	defer m.settingsMutex.RUnlock()
+	return m.systemDirs
+}
+
 // sendPong sends a PONG response to a client.
 func (m *MqttServerChat) sendPong(cmduuid, clientuuid string) {
 	pingData := NewMqttJsonDataEmpty()
@@ -209,7 +229,7 @@ func (m *MqttServerChat) handleAutocomplete(data MqttJsonData, state *ClientStat
 
 // getPluginById restituisce il plugin attivo dato il suo ID.
 func (m *MqttServerChat) getPluginById(pluginId string) MqttSeverChatPlugin {
-	for _, p := range m.plugins {
+	for _, p := range m.getPlugins() {
 		if p.PluginId() == pluginId {
 			return p
 		}
@@ -349,7 +369,7 @@ func (m *MqttServerChat) monitorInactivity() {
 			now := time.Now()
 			m.clientStates.Range(func(key, value interface{}) bool {
 				state := value.(*ClientState)
-				if now.Sub(state.LastActive) > m.inactivityTimeout {
+				if now.Sub(state.LastActive) > m.GetInactivityTimeout() {
 					// Remove inactive client
 					m.clientStates.Delete(state.ClientUUID)
 					log.Printf("Client %s removed due to inactivity\n", state.ClientUUID)
@@ -370,6 +390,27 @@ func WithOptionBeaconTopic(topic string, topicRequest string) MqttChatOption {
 	}
 }
 
+// WithOptionLabels sets the key/value labels advertised in the beacon.
+func WithOptionLabels(labels map[string]string) MqttServerChatOption {
+	return func(m *MqttServerChat) {
+		m.MqttChat.labels = labels
+	}
+}
+
+// WithOptionCapabilities sets the services of the node advertised in the beacon (cp, tunnel...).
+func WithOptionCapabilities(capabilities ...string) MqttServerChatOption {
+	return func(m *MqttServerChat) {
+		m.MqttChat.capabilities = append(m.MqttChat.capabilities, capabilities...)
+	}
+}
+
+// WithOptionBeaconInterval republishes the beacon periodically, 0 disables the heartbeat.
+func WithOptionBeaconInterval(interval time.Duration) MqttServerChatOption {
+	return func(m *MqttServerChat) {
+		m.MqttChat.beaconInterval = interval
+	}
+}
+
 // WithOptionNetworkInterface sets the network interface for the MQTT server chat.
 func WithOptionNetworkInterface(netI string) MqttServerChatOption {
 	return func(m *MqttServerChat) {
@@ -398,7 +439,7 @@ func (m *MqttServerChat) generateAutocompleteOptions(partialInput string, curren
 	}
 
 	var options []string
-	for _, dir := range m.systemDirs {
+	for _, dir := range m.getAutoCompleteDirs() {
 		opts := m.listFilesInDir(dir, partialInput)
 		if opts != "" {
 			options = append(options, opts)
@@ -548,7 +589,7 @@ func (m *MqttServerChat) GetClientsConnected() map[string]*ClientState {
 	m.clientStates.Range(func(key, value interface{}) bool {
 		clientUUID := key.(string)
 		state := value.(*ClientState)
-		if time.Since(state.LastActive) <= m.inactivityTimeout {
+		if time.Since(state.LastActive) <= m.GetInactivityTimeout() {
 			clients[clientUUID] = state
 		}
 		return true
@@ -36,7 +36,7 @@ func (m *MqttServerChat) handlePluginConfigCmd(state *ClientState, args []string
 
 	if argsLen == 1 && args[0] == "list" {
 		res := "Available plugins: ... "
-		for _, p := range m.plugins {
+		for _, p := range m.getPlugins() {
 			res = fmt.Sprintf("%s\r\n%s", res, p.PluginId())
 		}
 		return res, activePlugin
@@ -73,16 +73,43 @@ func (m *MqttServerChat) stopPlugin(state *ClientState) string {
 }
 
 func (m *MqttServerChat) AddPlugin(plugin MqttSeverChatPlugin) {
+	m.settingsMutex.Lock()
+	defer m.settingsMutex.Unlock()
 	m.plugins = append(m.plugins, plugin)
+	m.MqttChat.plugins = append(m.MqttChat.plugins, plugin.PluginId())
 }
 
-func (m *MqttServerChat) existPlugin(plugin string) bool {
+// RemovePlugin disables a plugin while running, the clients using it go back to the shell.
+func (m *MqttServerChat) RemovePlugin(pluginId string) {
+	m.settingsMutex.Lock()
+	plugins, ids := []MqttSeverChatPlugin{}, []string{}
 	for _, p := range m.plugins {
-		if p.PluginId() == plugin {
-			return true
+		if p.PluginId() != pluginId {
+			plugins = append(plugins, p)
+			ids = append(ids, p.PluginId())
 		}
 	}
-	return false
+	m.plugins, m.MqttChat.plugins = plugins, ids
+	m.settingsMutex.Unlock()
+
+	m.clientStates.Range(func(key, value interface{}) bool {
+		state := value.(*ClientState)
+		if state.PluginId == pluginId {
+			state.PluginId = ""
+			m.autocompleteEnabled = true
+		}
+		return true
+	})
+}
+
+func (m *MqttServerChat) getPlugins() []MqttSeverChatPlugin {
+	m.settingsMutex.RLock()
+	defer m.settingsMutex.RUnlock()
+	return m.plugins
+}
+
+func (m *MqttServerChat) existPlugin(plugin string) bool {
+	return m.getPluginById(plugin) != nil
 }
 
 func (s *ClientState) hasActivePlugin() (string, bool) {
@@ -93,11 +120,8 @@ func (s *ClientState) hasActivePlugin() (string, bool) {
 }
 
 func (m *MqttServerChat) execPluginCommand(pluginId string, data MqttJsonData) {
-	for _, p := range m.plugins {
-		if p.PluginId() == pluginId {
-			data.CustomPrompt = "<" + p.GetName() + ">"
-			p.OnDataRx(data)
-			return
-		}
+	if p := m.getPluginById(pluginId); p != nil {
+		data.CustomPrompt = "<" + p.GetName() + ">"
+		p.OnDataRx(data)
 	}
 }
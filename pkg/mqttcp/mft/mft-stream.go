@@ -0,0 +1,367 @@
+package mft
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// A Stream is a reliable byte stream over two topics, one per direction.
+// Data frames are numbered upward wrapping around; the receiver acknowledges the frames received,
+// which stops their retransmission, and the frames consumed by Read, which give the writer
+// room in its window. The end frame takes a number too, so it is delivered after the data.
+
+const (
+	defaultStreamWindow         = 32
+	defaultStreamRetransmit     = 3 * time.Second
+	defaultStreamMaxRetransmits = 5
+	defaultStreamLinger         = 10 * time.Second
+	maxStreamWindow             = 1024
+	firstStreamFrameNo          = 1
+)
+
+var ErrStreamClosed = errors.New("mft stream closed")
+var ErrStreamTimeout = errors.New("mft stream timeout, peer not answering")
+
+// Transport is the MQTT connection a Stream runs on, mqtt.Worker satisfies it.
+type Transport interface {
+	Publish(topic string, payload interface{})
+	Subscribe(topic string, onMessageCb MQTT.MessageHandler) error
+	Unsubscribe(topic string) error
+}
+
+type Stream struct {
+	transport      Transport
+	txTopic        string
+	rxTopic        string
+	window         int
+	retransmit     time.Duration
+	maxRetransmits int
+	linger         time.Duration
+
+	mutex sync.Mutex
+	// signaled on every change of the state below
+	cond   *sync.Cond
+	closed bool
+	err    error
+	done   chan bool
+
+	// write side
+	nextNo       uint16
+	unacked      []*MftFrame
+	ackedNo      uint16
+	peerReadNo   uint16
+	writeClosed  bool
+	lastProgress time.Time
+	retransmits  int
+
+	// read side
+	expectedNo uint16
+	pending    map[uint16]*MftFrame
+	readBuf    []*MftFrame
+	readOffset int
+	readNo     uint16
+	credit     int
+}
+
+type StreamOption func(*Stream)
+
+// WithOptionStreamWindow sets the frames the writer can send before the reader consumes them.
+func WithOptionStreamWindow(frames int) StreamOption {
+	return func(s *Stream) {
+		s.window = frames
+	}
+}
+
+// WithOptionStreamRetransmit sets after how long frames not acknowledged are sent again,
+// and how many times before the stream fails.
+func WithOptionStreamRetransmit(timeout time.Duration, max int) StreamOption {
+	return func(s *Stream) {
+		s.retransmit = timeout
+		s.maxRetransmits = max
+	}
+}
+
+// WithOptionStreamLinger sets how long Close waits for the peer to acknowledge the data.
+func WithOptionStreamLinger(linger time.Duration) StreamOption {
+	return func(s *Stream) {
+		s.linger = linger
+	}
+}
+
+// NewStream opens a stream writing on txTopic and reading from rxTopic; the peer uses the same
+// topics swapped. Close must be called to release it.
+func NewStream(transport Transport, txTopic string, rxTopic string, opts ...StreamOption) (*Stream, error) {
+	s := &Stream{
+		transport:      transport,
+		txTopic:        txTopic,
+		rxTopic:        rxTopic,
+		window:         defaultStreamWindow,
+		retransmit:     defaultStreamRetransmit,
+		maxRetransmits: defaultStreamMaxRetransmits,
+		linger:         defaultStreamLinger,
+		done:           make(chan bool),
+		nextNo:         firstStreamFrameNo,
+		ackedNo:        firstStreamFrameNo,
+		peerReadNo:     firstStreamFrameNo,
+		expectedNo:     firstStreamFrameNo,
+		readNo:         firstStreamFrameNo,
+		pending:        make(map[uint16]*MftFrame),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.window < 1 || s.window > maxStreamWindow {
+		return nil, errors.New("stream window not valid")
+	} else if s.retransmit <= 0 {
+		return nil, errors.New("stream retransmit timeout not valid")
+	}
+	s.cond = sync.NewCond(&s.mutex)
+
+	err := transport.Subscribe(rxTopic, s.onFrame)
+	if err != nil {
+		return nil, err
+	}
+	go s.retransmitLoop()
+	return s, nil
+}
+
+// distance is how many frames b is ahead of a, wrapping around.
+func distance(a uint16, b uint16) int {
+	return int(int16(b - a))
+}
+
+func (s *Stream) onFrame(client MQTT.Client, msg MQTT.Message) {
+	frame, err := DecodeMftFrame(msg.Payload())
+	if err != nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	switch frame.GetFrameType() {
+	case MftFrameType_TRANSMISSION, MftFrameType_END:
+		s.receive(frame)
+	case MftFrameType_ACK:
+		s.acknowledge(frame)
+	}
+}
+
+func (s *Stream) receive(frame *MftFrame) {
+	no := frame.GetFrameNo()
+	d := distance(s.expectedNo, no)
+	if d < 0 {
+		// already received, the acknowledge was lost
+		s.sendAck()
+		return
+	} else if d >= s.window {
+		return
+	}
+	s.pending[no] = frame
+	for {
+		next, exist := s.pending[s.expectedNo]
+		if !exist {
+			break
+		}
+		delete(s.pending, s.expectedNo)
+		s.expectedNo++
+		s.readBuf = append(s.readBuf, next)
+	}
+	s.sendAck()
+	s.cond.Broadcast()
+}
+
+func (s *Stream) acknowledge(frame *MftFrame) {
+	payload := frame.GetPayload()
+	if len(payload) < 2 {
+		return
+	}
+	received := frame.GetFrameNo()
+	consumed := binary.LittleEndian.Uint16(payload)
+
+	d := distance(s.ackedNo, received)
+	if d > 0 && d <= len(s.unacked) {
+		s.unacked = s.unacked[d:]
+		s.ackedNo = received
+		s.lastProgress = time.Now()
+		s.retransmits = 0
+	}
+	if distance(s.peerReadNo, consumed) > 0 {
+		s.peerReadNo = consumed
+	}
+	s.cond.Broadcast()
+}
+
+func (s *Stream) sendAck() {
+	s.credit = 0
+	s.transport.Publish(s.txTopic, BuildMftAckFrame(s.expectedNo, s.readNo).Encode())
+}
+
+// send publishes a new frame, kept until the peer acknowledges it.
+func (s *Stream) send(frame *MftFrame) {
+	if len(s.unacked) == 0 {
+		s.lastProgress = time.Now()
+	}
+	s.unacked = append(s.unacked, frame)
+	s.nextNo++
+	s.transport.Publish(s.txTopic, frame.Encode())
+}
+
+func (s *Stream) retransmitLoop() {
+	ticker := time.NewTicker(s.retransmit / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mutex.Lock()
+			if s.err == nil && len(s.unacked) > 0 && time.Since(s.lastProgress) >= s.retransmit {
+				if s.retransmits >= s.maxRetransmits {
+					s.err = ErrStreamTimeout
+					s.cond.Broadcast()
+				} else {
+					s.retransmits++
+					s.lastProgress = time.Now()
+					for _, frame := range s.unacked {
+						s.transport.Publish(s.txTopic, frame.Encode())
+					}
+				}
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// Read returns the data in order, io.EOF once the peer closed its side.
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for len(s.readBuf) == 0 && !s.closed && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return 0, ErrStreamClosed
+	} else if len(s.readBuf) == 0 {
+		return 0, s.err
+	}
+
+	head := s.readBuf[0]
+	if head.GetFrameType() == MftFrameType_END {
+		return 0, io.EOF
+	}
+	payload := head.GetPayload()
+	n := copy(p, payload[s.readOffset:])
+	s.readOffset += n
+	if s.readOffset == len(payload) {
+		s.readBuf = s.readBuf[1:]
+		s.readOffset = 0
+		s.readNo++
+		s.credit++
+		// the writer may be waiting for room in its window
+		if s.credit >= s.window/2 || len(s.readBuf) == 0 {
+			s.sendAck()
+		}
+	}
+	return n, nil
+}
+
+// Write sends p, blocking while the window is full.
+func (s *Stream) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	written := 0
+	for len(p) > 0 {
+		for s.err == nil && !s.closed && !s.writeClosed && distance(s.peerReadNo, s.nextNo) >= s.window {
+			s.cond.Wait()
+		}
+		if s.closed || s.writeClosed {
+			return written, ErrStreamClosed
+		} else if s.err != nil {
+			return written, s.err
+		}
+
+		n := len(p)
+		if n > MFT_PAYLOAD_SIZE() {
+			n = MFT_PAYLOAD_SIZE()
+		}
+		chunk := make([]byte, n)
+		copy(chunk, p[:n])
+		frame, err := BuildMftFrame(s.nextNo, chunk)
+		if err != nil {
+			return written, err
+		}
+		s.send(frame)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite closes the writing side, the peer reads io.EOF after the data sent.
+func (s *Stream) CloseWrite() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed || s.writeClosed {
+		return nil
+	}
+	s.writeClosed = true
+	s.send(BuildMftEndFrame(s.nextNo))
+	s.cond.Broadcast()
+	return nil
+}
+
+// Close closes both sides, waiting up to the linger time for the peer to receive the data.
+func (s *Stream) Close() error {
+	s.CloseWrite()
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	expired := false
+	timer := time.AfterFunc(s.linger, func() {
+		s.mutex.Lock()
+		expired = true
+		s.cond.Broadcast()
+		s.mutex.Unlock()
+	})
+	for len(s.unacked) > 0 && s.err == nil && !expired {
+		s.cond.Wait()
+	}
+	timer.Stop()
+	err := s.err
+	if err == nil && len(s.unacked) > 0 {
+		err = ErrStreamTimeout
+	}
+	s.mutex.Unlock()
+
+	s.shutdown()
+	return err
+}
+
+// Abort closes both sides at once, the data not acknowledged yet is dropped.
+func (s *Stream) Abort() {
+	s.shutdown()
+}
+
+func (s *Stream) shutdown() {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+
+	s.transport.Unsubscribe(s.rxTopic)
+}
@@ -32,6 +32,9 @@ const MftFrameType_START MftFrameType = 0
 const MftFrameType_TRANSMISSION MftFrameType = 1
 const MftFrameType_END MftFrameType = 2
 
+// MftFrameType_ACK acknowledges the frames of a Stream up to its frame number
+const MftFrameType_ACK MftFrameType = 3
+
 type MftFrame struct {
 	header MftHeader
 	body   MftBody
@@ -108,6 +111,25 @@ func BuildMftEndFrame(frameNo uint16) *MftFrame {
 	return &MftFrame{header: buildMftHeader(frameNo, MftFrameType_END), body: buildMftBody(emptyBody), footer: buildMftFooter()}
 }
 
+// BuildMftAckFrame acknowledges the frames received before frameNo, the body carries
+// the first frame the reader has not consumed yet.
+func BuildMftAckFrame(frameNo uint16, consumedNo uint16) *MftFrame {
+	body := make([]byte, 2)
+	binary.LittleEndian.PutUint16(body, consumedNo)
+	return &MftFrame{header: buildMftHeader(frameNo, MftFrameType_ACK), body: buildMftBody(body), footer: buildMftFooter()}
+}
+
+// BuildMftEndFrameWithPayload builds an end frame carrying a trailer, used by streams
+// to send size and hash once the data is over.
+func BuildMftEndFrameWithPayload(frameNo uint16, payload []byte) (*MftFrame, error) {
+	if len(payload) < 1 {
+		return nil, errors.New("body exceeds min size limit")
+	} else if len(payload) > maxMftBodySizeByte {
+		return nil, errors.New("body exceeds max size limit")
+	}
+	return &MftFrame{header: buildMftHeader(frameNo, MftFrameType_END), body: buildMftBody(payload), footer: buildMftFooter()}, nil
+}
+
 func BuildMftFrame(frameNo uint16, frameBody []byte) (*MftFrame, error) {
 	if frameBody == nil {
 		return nil, errors.New("body nil not acceptable")
@@ -150,7 +172,7 @@ func decodeMftHeader(b []byte) (*MftHeader, error) {
 		}
 	}
 	frameType := MftFrameType(b[len(topHeaderConst)])
-	if frameType != MftFrameType_START && frameType != MftFrameType_TRANSMISSION && frameType != MftFrameType_END {
+	if frameType != MftFrameType_START && frameType != MftFrameType_TRANSMISSION && frameType != MftFrameType_END && frameType != MftFrameType_ACK {
 		return nil, errors.New("invalid frame type")
 	}
 	frameNo := binary.LittleEndian.Uint16(b[len(topHeaderConst)+1:])
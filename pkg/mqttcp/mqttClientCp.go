@@ -1,187 +1,430 @@
 package mqttcp
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqtt"
 	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp/mft"
 	"github.com/lithammer/shortuuid/v3"
 	"io"
 	"os"
 	"path"
+	"sync"
 	"time"
 )
 
 type MqttClientCp struct {
 	*MqttCp
 	waitServerChan chan bool
-	bufferInbound  chan MqttJsonCp
-	uuid           string
-	writer         io.Writer
+	startMutex     sync.Mutex
+	// replies of the server, dispatched by transfer uuid to the request waiting for them
+	replies       map[string]chan MqttJsonCp
+	repliesMutex  sync.Mutex
+	uuid          string
+	writer        io.Writer
+	hashAlgo      string
+	signingKey    ed25519.PrivateKey
+	signatureFile string
+	overwrite     string
+	backupSuffix  string
+	setMode       string
+	setOwner      string
+	preserveOwner bool
+	blockSize     int
+	checksum      bool
+	// running transfers, closed when they are canceled
+	transfers      map[string]chan bool
+	transfersMutex sync.Mutex
+	sharedWorker   *mqtt.Worker
+	transferTopic  string
 }
 
-func NewMqttClientCp(mqttOpts *MQTT.ClientOptions, rxTopic string, txTopic string) *MqttClientCp {
+type MqttClientCpOption func(*MqttClientCp)
+
+// WithOptionWriter sets where the copy commands report their progress, stdout by default.
+func WithOptionWriter(w io.Writer) MqttClientCpOption {
+	return func(c *MqttClientCp) {
+		c.writer = w
+	}
+}
+
+// WithOptionClientWorker runs the client on an existing mqtt connection, such as the one of a chat.
+func WithOptionClientWorker(worker *mqtt.Worker) MqttClientCpOption {
+	return func(c *MqttClientCp) {
+		c.sharedWorker = worker
+	}
+}
+
+// WithOptionClientTransferTopic sets the topic of the file data, see WithOptionTransferTopic.
+func WithOptionClientTransferTopic(template string) MqttClientCpOption {
+	return func(c *MqttClientCp) {
+		c.transferTopic = template
+	}
+}
+
+// WithOptionHashAlgo sets the hash algorithm requested in the handshake.
+func WithOptionHashAlgo(algo string) MqttClientCpOption {
+	return func(c *MqttClientCp) {
+		c.hashAlgo = algo
+	}
+}
+
+// WithOptionSigningKey signs every uploaded file with the given key.
+func WithOptionSigningKey(key ed25519.PrivateKey) MqttClientCpOption {
+	return func(c *MqttClientCp) {
+		c.signingKey = key
+	}
+}
+
+// WithOptionSignatureFile attaches a precomputed detached signature to the upload.
+func WithOptionSignatureFile(fileName string) MqttClientCpOption {
+	return func(c *MqttClientCp) {
+		c.signatureFile = fileName
+	}
+}
+
+// WithOptionOverwrite sets what happens when the destination already exists
+// (fail, overwrite or backup with the given suffix).
+func WithOptionOverwrite(policy string, backupSuffix string) MqttClientCpOption {
+	return func(c *MqttClientCp) {
+		c.overwrite = policy
+		c.backupSuffix = backupSuffix
+	}
+}
+
+// WithOptionDestinationAttr sets an explicit mode (octal) and owner (user[:group]) on the destination
+// instead of the source ones.
+func WithOptionDestinationAttr(mode string, owner string) MqttClientCpOption {
+	return func(c *MqttClientCp) {
+		c.setMode = mode
+		c.setOwner = owner
+	}
+}
+
+// WithOptionPreserveOwner keeps uid/gid of the source, when the receiver is privileged.
+func WithOptionPreserveOwner(preserve bool) MqttClientCpOption {
+	return func(c *MqttClientCp) {
+		c.preserveOwner = preserve
+	}
+}
+
+// WithOptionDeltaBlockSize sets the block size of delta transfers, 0 picks it from the file size.
+func WithOptionDeltaBlockSize(size int) MqttClientCpOption {
+	return func(c *MqttClientCp) {
+		c.blockSize = size
+	}
+}
+
+// WithOptionChecksum makes sync compare files by hash instead of size and modification time.
+func WithOptionChecksum(checksum bool) MqttClientCpOption {
+	return func(c *MqttClientCp) {
+		c.checksum = checksum
+	}
+}
+
+func NewMqttClientCp(mqttOpts *MQTT.ClientOptions, rxTopic string, txTopic string, opts ...MqttClientCpOption) *MqttClientCp {
 	mqttOpts.SetOrderMatters(true)
-	clientCp := MqttClientCp{uuid: shortuuid.New(), writer: os.Stdout, bufferInbound: make(chan MqttJsonCp, 5)}
-	cp := NewCp(mqttOpts, rxTopic, txTopic)
+	clientCp := MqttClientCp{uuid: shortuuid.New(), writer: os.Stdout, replies: make(map[string]chan MqttJsonCp),
+		hashAlgo: defaultHashAlgo, overwrite: MqttCpOverwrite_Fail, transfers: make(map[string]chan bool)}
+	for _, opt := range opts {
+		opt(&clientCp)
+	}
+	cpOpts := []MqttCpOption{}
+	if clientCp.sharedWorker != nil {
+		cpOpts = append(cpOpts, WithOptionMqttWorker(clientCp.sharedWorker))
+	}
+	if clientCp.transferTopic != "" {
+		cpOpts = append(cpOpts, WithOptionTransferTopic(clientCp.transferTopic))
+	}
+	cp := NewCp(mqttOpts, rxTopic, txTopic, cpOpts...)
 	cp.SetDataCallback(clientCp.onDataRx)
 	clientCp.MqttCp = cp
 	return &clientCp
 }
 
+// SetOverwrite changes the policy applied when the destination exists, see WithOptionOverwrite.
+func (c *MqttClientCp) SetOverwrite(policy string, backupSuffix string) {
+	c.overwrite = policy
+	c.backupSuffix = backupSuffix
+}
+
 func (c *MqttClientCp) onDataRx(data MqttJsonCp) {
 	if data.ClientUUID == c.uuid {
-		c.bufferInbound <- data
+		if data.Step == MqttCpStep_Cancel {
+			c.abortTransfer(data.UUID)
+			return
+		}
+		c.deliverReply(data)
 	}
 }
 
-func (c *MqttClientCp) startUpClient() bool {
+// expectReplies registers a request before it is sent, so that none of its replies is lost;
+// forgetReplies must follow when the request is over.
+func (c *MqttClientCp) expectReplies(uuid string) {
+	c.repliesMutex.Lock()
+	c.replies[uuid] = make(chan MqttJsonCp, 5)
+	c.repliesMutex.Unlock()
+}
+
+func (c *MqttClientCp) forgetReplies(uuid string) {
+	c.repliesMutex.Lock()
+	delete(c.replies, uuid)
+	c.repliesMutex.Unlock()
+}
+
+// deliverReply hands a reply to the request waiting for it. It never blocks, the mqtt
+// connection may be shared with a chat: replies nobody waits for are dropped.
+func (c *MqttClientCp) deliverReply(data MqttJsonCp) {
+	c.repliesMutex.Lock()
+	res, exist := c.replies[data.UUID]
+	c.repliesMutex.Unlock()
+	if exist {
+		select {
+		case res <- data:
+		default:
+		}
+	}
+}
+
+func (c *MqttClientCp) startUpClient() error {
+	c.startMutex.Lock()
 	if !c.IsRunning() {
 		c.Start()
 		time.Sleep(time.Second)
 	}
+	c.startMutex.Unlock()
 
 	if !c.worker.GetMqttClient().IsConnected() {
-		c.Print("mqtt connection fail")
-		return false
+		return errors.New("mqtt connection fail")
 	}
-	return true
+	return nil
 }
 
 func (c *MqttClientCp) CopyRemoteToLocal(remoteFile string, localPath string, progress *chan mft.MftProgress) {
-	connection := c.startUpClient()
-	if !connection {
+	if localPath == MqttCpStreamPath {
+		size, err := c.DownloadStream(remoteFile, os.Stdout, nil)
+		if err != nil {
+			c.Print(err.Error())
+			return
+		}
+		c.Printf("%d bytes received", size)
+		c.Println()
 		return
 	}
+	newLocalPath, err := c.Download(remoteFile, localPath, progress)
+	if err != nil {
+		c.Print(err.Error())
+		return
+	}
+	c.Printf("\nfile received with success: %s", newLocalPath)
+	c.Println()
+}
+
+// Download copies remoteFile into localPath, returning the path of the received file.
+func (c *MqttClientCp) Download(remoteFile string, localPath string, progress *chan mft.MftProgress) (string, error) {
+	errConn := c.startUpClient()
+	if errConn != nil {
+		return "", errConn
+	}
 
 	if !path.IsAbs(remoteFile) {
-		c.Print("remote path must be absolute")
-		return
+		return "", errors.New("remote path must be absolute")
 	}
 
 	newLocalPath, errCheck := fileDestinationPathCheck(localPath, remoteFile)
 	if errCheck != nil {
-		c.Print(errCheck.Error())
-		return
+		return "", errCheck
+	}
+
+	errPolicy := validateOverwritePolicy(c.overwrite, c.backupSuffix)
+	if errPolicy == nil {
+		errPolicy = checkOverwrite(newLocalPath, c.overwrite)
+	}
+	if errPolicy == nil && c.setMode != "" {
+		_, errPolicy = parseFileMode(c.setMode)
 	}
+	if errPolicy != nil {
+		return "", errPolicy
+	}
+
+	uuid := shortuuid.New()
+	c.expectReplies(uuid)
+	defer c.forgetReplies(uuid)
 
-	startMsg, errHandShake := c.remote2LocalHandshakeProcedure(newLocalPath, remoteFile)
+	startMsg, errHandShake := c.remote2LocalHandshakeProcedure(uuid, newLocalPath, remoteFile)
 	if errHandShake != nil {
-		c.Printf("error in handshake: %s", errHandShake.Error())
-		return
+		return "", errors.New(fmt.Sprintf("error in handshake: %s", errHandShake.Error()))
 	} else {
 		c.Print("handshake success, start transmission")
 		c.Println()
 	}
 
 	inChan := make(chan []byte, 10000)
-
-	onMftFrame := func(client MQTT.Client, msg MQTT.Message) {
-		mqttPayload := msg.Payload()
-		inChan <- mqttPayload
-	}
-
-	errSub := c.worker.Subscribe(startMsg.Topic, onMftFrame)
+	errSub := c.worker.Subscribe(startMsg.Topic, queueFrames(inChan))
 	if errSub != nil {
-		c.Printf("error in subscribe %s", errSub.Error())
-		return
+		return "", errors.New(fmt.Sprintf("error in subscribe %s", errSub.Error()))
 	}
 	defer c.worker.Unsubscribe(startMsg.Topic)
 
-	tmpName := fmt.Sprintf("%s.tmp", newLocalPath)
-	f, errCreation := os.Create(tmpName)
+	f, errCreation := createTempFile(newLocalPath)
 	if errCreation != nil {
-		c.Printf("error in subscribe %s", errCreation.Error())
-		os.Remove(tmpName)
-		return
+		return "", errors.New(fmt.Sprintf("error in file creation %s", errCreation.Error()))
 	}
+	tmpName := f.Name()
+
+	cancel := c.registerTransfer(startMsg.UUID)
+	defer c.unregisterTransfer(startMsg.UUID)
 
 	errTrans := c.Transmit(*startMsg)
 	if errTrans != nil {
-		c.Printf("error in start msg %s", errTrans.Error())
+		f.Close()
 		os.Remove(tmpName)
-		return
+		return "", errors.New(fmt.Sprintf("error in start msg %s", errTrans.Error()))
 	}
 
-	errReceive := c.receiveFileAndCheck(f, inChan, startMsg.Request.MD5, startMsg.Request.Size, progress)
+	_, errReceive := c.receiveFileAndCheck(f, inChan, startMsg.Request, progress, cancel)
+	if errReceive == nil {
+		attr := startMsg.Request
+		attr.SetMode = c.setMode
+		attr.SetOwner = c.setOwner
+		attr.PreserveOwner = c.preserveOwner
+		errReceive = applyFileAttr(tmpName, attr)
+	}
+	if errReceive == nil {
+		errReceive = commitFile(tmpName, newLocalPath, c.overwrite, c.backupSuffix)
+	}
 	if errReceive != nil {
-		c.Print(errReceive.Error())
 		os.Remove(tmpName)
-		return
+		return "", errReceive
 	}
-	c.Printf("\nfile received with success: %s", newLocalPath)
-	c.Println()
-
+	return newLocalPath, nil
 }
 
 func (c *MqttClientCp) CopyLocalToRemote(localFile string, remotePath string, progress *chan mft.MftProgress) {
-	connection := c.startUpClient()
-	if !connection {
+	var str string
+	var err error
+	if localFile == MqttCpStreamPath {
+		str, err = c.UploadStream(os.Stdin, remotePath, nil)
+	} else {
+		str, err = c.Upload(localFile, remotePath, progress)
+	}
+	if err != nil {
+		c.Print(err.Error())
 		return
 	}
+	c.Printf("success: %s", str)
+	c.Println()
+}
+
+// Upload copies localFile to remotePath, returning the server outcome.
+func (c *MqttClientCp) Upload(localFile string, remotePath string, progress *chan mft.MftProgress) (string, error) {
+	errConn := c.startUpClient()
+	if errConn != nil {
+		return "", errConn
+	}
 
 	if !path.IsAbs(remotePath) {
-		c.Print("remote path must be absolute")
-		return
+		return "", errors.New("remote path must be absolute")
 	}
 
-	size, md5Value, err := takeFileInfo(localFile)
+	size, hashValue, err := takeFileInfo(localFile, c.hashAlgo)
 	if err != nil {
-		c.Printf(err.Error())
-		return
+		return "", err
+	}
+
+	signature, errSign := c.fileSignature(hashValue)
+	if errSign != nil {
+		return "", errors.New(fmt.Sprintf("error in signature: %s", errSign.Error()))
+	}
+
+	msg, errReq := c.newUploadRequest(localFile, remotePath, size, hashValue, signature)
+	if errReq != nil {
+		return "", errors.New(fmt.Sprintf("error in handshake: %s", errReq.Error()))
 	}
+	c.expectReplies(msg.UUID)
+	defer c.forgetReplies(msg.UUID)
 
-	uuid, transmissionTopic, errHandShake := c.local2RemoteHandshakeProcedure(localFile, remotePath, size, md5Value)
+	uuid, transmissionTopic, errHandShake := c.local2RemoteHandshake(msg)
 	if errHandShake != nil {
-		c.Printf("error in handshake: %s", errHandShake.Error())
-		return
+		return "", errors.New(fmt.Sprintf("error in handshake: %s", errHandShake.Error()))
 	} else {
 		c.Print("handshake success, start transmission")
 		c.Println()
 	}
 
-	errTrans := c.mftTransmitFile(localFile, transmissionTopic, progress)
+	cancel := c.registerTransfer(uuid)
+	defer c.unregisterTransfer(uuid)
+
+	errTrans := c.mftTransmitFile(localFile, transmissionTopic, progress, cancel)
 	if errTrans != nil {
-		c.Printf("error in data transfer: %s", errTrans.Error())
-		return
+		return "", errors.New(fmt.Sprintf("error in data transfer: %s", errTrans.Error()))
 	} else {
 		c.Printf("%d bytes sent", size)
 		c.Println()
 	}
 
-	str, errV := c.verifyTransmission(uuid)
+	str, errV := c.verifyTransmission(uuid, defaultTransmissionTimeout)
 	if errV != nil {
-		c.Printf("error in data receiving: %s", errV.Error())
-		return
-	} else {
-		c.Printf("success: %s", str)
-		c.Println()
+		return "", errors.New(fmt.Sprintf("error in data receiving: %s", errV.Error()))
 	}
+	return str, nil
+}
 
+// fileSignature returns the base64 detached signature to send in the handshake, if any.
+func (c *MqttClientCp) fileSignature(hashValue string) (string, error) {
+	if c.signatureFile != "" {
+		sig, err := LoadSignature(c.signatureFile)
+		if err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(sig), nil
+	}
+	if c.signingKey != nil {
+		if c.hashAlgo != MqttCpHash_SHA256 {
+			return "", errors.New("signature requires sha256")
+		}
+		digest, err := hex.DecodeString(hashValue)
+		if err != nil {
+			return "", err
+		}
+		return signDigest(c.signingKey, digest), nil
+	}
+	return "", nil
 }
 
-func (c *MqttClientCp) verifyTransmission(uuid string) (string, error) {
-	res, errEnd := c.awaitResponse(uuid, MqttCpStep_End, defaultTransmissionTimeout)
+func (c *MqttClientCp) verifyTransmission(uuid string, timeout time.Duration) (string, error) {
+	res, errEnd := c.awaitResponse(uuid, MqttCpStep_End, timeout)
 	if errEnd != nil {
 		return "", errEnd
 	} else {
 		if res.Error == "" {
 			return res.EndStr, nil
 		} else {
-			return "", errors.New(res.Error)
+			return "", replyError(res)
 		}
 	}
 }
 
-func (c *MqttClientCp) remote2LocalHandshakeProcedure(localFile, remoteFile string) (*MqttJsonCp, error) {
+func (c *MqttClientCp) remote2LocalHandshakeProcedure(uuid string, localFile, remoteFile string) (*MqttJsonCp, error) {
+	return c.remote2LocalHandshake(uuid, MqttCpCommand_CopyRemoteToLocal, localFile, remoteFile)
+}
+
+// remote2LocalHandshake sends a download request with the given transfer uuid, whose replies
+// must be expected.
+func (c *MqttClientCp) remote2LocalHandshake(uuid string, cmd string, localFile, remoteFile string) (*MqttJsonCp, error) {
 
 	msg := MqttJsonCp{}
 	msg.ClientUUID = c.uuid
-	msg.UUID = shortuuid.New()
+	msg.UUID = uuid
 	msg.Step = MqttCpStep_Handshake1
-	msg.Request.Cmd = MqttCpCommand_CopyRemoteToLocal
+	msg.Request.Cmd = cmd
 	msg.Request.ClientPath = localFile
 	msg.Request.ServerPath = remoteFile
+	msg.Request.HashAlgo = c.hashAlgo
 
 	errTrans := c.Transmit(msg)
 	if errTrans != nil {
@@ -197,6 +440,7 @@ func (c *MqttClientCp) remote2LocalHandshakeProcedure(localFile, remoteFile stri
 	if errHandshake != nil {
 		return nil, errHandshake
 	}
+	normalizeHashRequest(&res.Request)
 
 	startMsg := res
 	startMsg.Step = MqttCpStep_Start
@@ -205,7 +449,7 @@ func (c *MqttClientCp) remote2LocalHandshakeProcedure(localFile, remoteFile stri
 
 }
 
-func (c *MqttClientCp) local2RemoteHandshakeProcedure(localFile string, remotePath string, localFileSize int64, localFileMd5 string) (string, string, error) {
+func (c *MqttClientCp) newUploadRequest(localFile string, remotePath string, localFileSize int64, localFileHash string, signature string) (MqttJsonCp, error) {
 
 	msg := MqttJsonCp{}
 	msg.ClientUUID = c.uuid
@@ -213,9 +457,30 @@ func (c *MqttClientCp) local2RemoteHandshakeProcedure(localFile string, remotePa
 	msg.Step = MqttCpStep_Handshake1
 	msg.Request.Cmd = MqttCpCommand_CopyLocalToRemote
 	msg.Request.Size = localFileSize
-	msg.Request.MD5 = localFileMd5
+	msg.Request.HashAlgo = c.hashAlgo
+	msg.Request.Hash = localFileHash
+	msg.Request.Signature = signature
+	msg.Request.Overwrite = c.overwrite
+	msg.Request.BackupSuffix = c.backupSuffix
+	msg.Request.SetMode = c.setMode
+	msg.Request.SetOwner = c.setOwner
+	msg.Request.PreserveOwner = c.preserveOwner
+
+	errAttr := fillFileAttr(localFile, &msg.Request)
+	if errAttr != nil {
+		return msg, errAttr
+	}
+	if c.hashAlgo == MqttCpHash_MD5 {
+		msg.Request.MD5 = localFileHash
+	}
 	msg.Request.ClientPath = localFile
 	msg.Request.ServerPath = remotePath
+	return msg, nil
+}
+
+// local2RemoteHandshake sends an upload request, whose replies must be expected, and waits until
+// the server is ready for the data, returning the transfer uuid and topic.
+func (c *MqttClientCp) local2RemoteHandshake(msg MqttJsonCp) (string, string, error) {
 
 	errTrans := c.Transmit(msg)
 	if errTrans != nil {
@@ -234,9 +499,11 @@ func (c *MqttClientCp) local2RemoteHandshakeProcedure(localFile string, remotePa
 
 	transmissionTopic := res.Topic
 
-	_, errStart := c.awaitResponse(msg.UUID, MqttCpStep_Start, c.handshakeTimeout)
-	if errRes != nil {
+	startRes, errStart := c.awaitResponse(msg.UUID, MqttCpStep_Start, c.handshakeTimeout)
+	if errStart != nil {
 		return "", "", errStart
+	} else if startRes.Error != "" {
+		return "", "", replyError(startRes)
 	}
 
 	return msg.UUID, transmissionTopic, nil
@@ -245,26 +512,40 @@ func (c *MqttClientCp) local2RemoteHandshakeProcedure(localFile string, remotePa
 
 func (c *MqttClientCp) validateHandshake(response MqttJsonCp) error {
 	if response.Error != "" {
-		return errors.New(response.Error)
+		return replyError(response)
 	} else if response.Topic == "" {
 		return errors.New("topic missing")
-	} else if response.Request.MD5 == "" {
-		return errors.New("md5 missing")
-	} else if response.Request.Size == 0 {
-		return errors.New("size missing")
+	} else if response.Request.Hash == "" && response.Request.MD5 == "" && !isStreamCommand(response.Request.Cmd) {
+		return errors.New("hash missing")
+	} else if response.Request.HashAlgo == "" && c.hashAlgo != MqttCpHash_MD5 {
+		// a reply without algorithm means md5, accepted only if it was asked for
+		return errors.New("hash algorithm missing")
+	} else if response.Request.HashAlgo != "" && response.Request.HashAlgo != c.hashAlgo {
+		return errors.New(fmt.Sprintf("hash algorithm %s not requested", response.Request.HashAlgo))
+	} else if response.Request.Size < 0 {
+		return errors.New("size not valid")
 	}
 	return nil
 }
 
+// awaitResponse waits for the reply of a request registered with expectReplies.
 func (c *MqttClientCp) awaitResponse(msgUUID string, step MqttCpStep, timeout time.Duration) (MqttJsonCp, error) {
-	ticker := time.NewTicker(timeout)
+	c.repliesMutex.Lock()
+	replies, exist := c.replies[msgUUID]
+	c.repliesMutex.Unlock()
+	if !exist {
+		return MqttJsonCp{}, errors.New(fmt.Sprintf("request %s not expected", msgUUID))
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 	for {
 		select {
-		case msg := <-c.bufferInbound:
-			if msg.UUID == msgUUID && msg.Step == string(step) {
+		case msg := <-replies:
+			if msg.Step == string(step) {
 				return msg, nil
 			}
-		case <-ticker.C:
+		case <-timer.C:
 			return MqttJsonCp{}, errors.New("timeout")
 		}
 	}
@@ -0,0 +1,98 @@
+package mqttcp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fillFileAttr copies mode, mtime and owner of fileName in the request.
+func fillFileAttr(fileName string, req *MqttJsonCpRequest) error {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	req.Mode = uint32(info.Mode().Perm())
+	req.ModTime = info.ModTime().UnixNano()
+	if uid, gid, ok := fileOwner(info); ok {
+		req.Uid = &uid
+		req.Gid = &gid
+	}
+	return nil
+}
+
+// applyFileAttr sets on fileName the attributes carried by the request,
+// the explicit ones win over the source ones.
+func applyFileAttr(fileName string, req MqttJsonCpRequest) error {
+	if req.SetMode != "" {
+		mode, err := parseFileMode(req.SetMode)
+		if err != nil {
+			return err
+		}
+		if err = os.Chmod(fileName, mode); err != nil {
+			return err
+		}
+	} else if req.Mode != 0 {
+		if err := os.Chmod(fileName, os.FileMode(req.Mode).Perm()); err != nil {
+			return err
+		}
+	}
+
+	if req.ModTime != 0 {
+		if err := os.Chtimes(fileName, time.Now(), time.Unix(0, req.ModTime)); err != nil {
+			return err
+		}
+	}
+
+	if req.SetOwner != "" {
+		uid, gid, err := lookupOwner(req.SetOwner)
+		if err != nil {
+			return err
+		}
+		return os.Chown(fileName, uid, gid)
+	} else if req.PreserveOwner && req.Uid != nil && req.Gid != nil && isPrivileged() {
+		return os.Chown(fileName, *req.Uid, *req.Gid)
+	}
+	return nil
+}
+
+func parseFileMode(mode string) (os.FileMode, error) {
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value > 0777 {
+		return 0, errors.New(fmt.Sprintf("mode %s not valid", mode))
+	}
+	return os.FileMode(value), nil
+}
+
+// lookupOwner resolves user[:group], names or numeric ids; -1 keeps the current value.
+func lookupOwner(owner string) (int, int, error) {
+	uid, gid := -1, -1
+	userName, groupName, _ := strings.Cut(owner, ":")
+	if userName != "" {
+		id, err := strconv.Atoi(userName)
+		if err != nil {
+			u, errLookup := user.Lookup(userName)
+			if errLookup != nil {
+				return -1, -1, errLookup
+			}
+			id, _ = strconv.Atoi(u.Uid)
+		}
+		uid = id
+	}
+	if groupName != "" {
+		id, err := strconv.Atoi(groupName)
+		if err != nil {
+			g, errLookup := user.LookupGroup(groupName)
+			if errLookup != nil {
+				return -1, -1, errLookup
+			}
+			id, _ = strconv.Atoi(g.Gid)
+		}
+		gid = id
+	}
+	return uid, gid, nil
+}
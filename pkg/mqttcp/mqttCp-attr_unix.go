@@ -0,0 +1,20 @@
+//go:build !windows
+
+package mqttcp
+
+import (
+	"os"
+	"syscall"
+)
+
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+func isPrivileged() bool {
+	return os.Geteuid() == 0
+}
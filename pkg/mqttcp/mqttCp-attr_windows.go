@@ -0,0 +1,13 @@
+//go:build windows
+
+package mqttcp
+
+import "os"
+
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+func isPrivileged() bool {
+	return false
+}
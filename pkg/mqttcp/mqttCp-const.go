@@ -1,7 +1,6 @@
 package mqttcp
 
 import (
-	"fmt"
 	"time"
 )
 
@@ -21,6 +20,21 @@ type MqttCpCommand string
 const (
 	MqttCpCommand_CopyLocalToRemote = "local2remote"
 	MqttCpCommand_CopyRemoteToLocal = "remote2local"
+	MqttCpCommand_List              = "list"
+	MqttCpCommand_Stat              = "stat"
+	MqttCpCommand_Mkdir             = "mkdir"
+	MqttCpCommand_Remove            = "remove"
+	MqttCpCommand_Rename            = "rename"
+	MqttCpCommand_SetAttr           = "setattr"
+	MqttCpCommand_Hash              = "hash"
+	MqttCpCommand_Signature         = "signature"
+	MqttCpCommand_Delta             = "delta"
+	MqttCpCommand_Multicast         = "multicast"
+	// size and hash are unknown up front, they travel in the end frame
+	MqttCpCommand_StreamLocalToRemote = "stream-local2remote"
+	MqttCpCommand_StreamRemoteToLocal = "stream-remote2local"
+	MqttCpCommand_Transfers           = "transfers"
+	MqttCpCommand_Cancel              = "cancel"
 )
 
 type MqttCpStep string
@@ -30,12 +44,22 @@ const (
 	MqttCpStep_Handshake2 = "handshake-p2"
 	MqttCpStep_Start      = "start"
 	MqttCpStep_End        = "end"
+	MqttCpStep_Result     = "result"
+	MqttCpStep_Repair     = "repair"
+	MqttCpStep_Cancel     = "cancel"
 )
 
 const (
-	MqttCpMftTopic = "/mft/%s/%s"
+	MqttCpHash_SHA256 = "sha256"
+	MqttCpHash_MD5    = "md5"
 )
 
-func mftTopic(clientUUID, transferUUID string) string {
-	return fmt.Sprintf(MqttCpMftTopic, clientUUID, transferUUID)
-}
+const defaultHashAlgo = MqttCpHash_SHA256
+
+// MqttCpStreamPath as local path means stdin or stdout
+const MqttCpStreamPath = "-"
+
+// MqttCpMftTopic is the default topic of the file data, with the client and the transfer uuid.
+const (
+	MqttCpMftTopic = "/mft/%s/%s"
+)
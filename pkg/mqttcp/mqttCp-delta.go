@@ -0,0 +1,444 @@
+package mqttcp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Delta transfers work like rsync: the receiver sends the checksums of the blocks of its copy,
+// the sender answers with a delta made of references to those blocks and literal data.
+//
+// delta format, integers big endian:
+//
+//	'C' first block uint32, block count uint32
+//	'L' length uint32, data
+
+const (
+	deltaOpCopy    = 'C'
+	deltaOpLiteral = 'L'
+
+	blockStrongSize = 16
+	blockSigSize    = 4 + blockStrongSize
+
+	minBlockSize     = 2 * 1024
+	maxBlockSize     = 128 * 1024
+	maxLiteralLength = 64 * 1024
+)
+
+type blockSig struct {
+	weak   uint32
+	strong [blockStrongSize]byte
+}
+
+// rollingChecksum is the rsync weak checksum, cheap to slide by one byte.
+type rollingChecksum struct {
+	a, b uint32
+	n    uint32
+}
+
+func (r *rollingChecksum) init(data []byte) {
+	r.a, r.b, r.n = 0, 0, uint32(len(data))
+	for i, x := range data {
+		r.a += uint32(x)
+		r.b += uint32(len(data)-i) * uint32(x)
+	}
+}
+
+func (r *rollingChecksum) roll(out byte, in byte) {
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - r.n*uint32(out) + r.a
+}
+
+func (r *rollingChecksum) sum() uint32 {
+	return (r.a & 0xffff) | (r.b << 16)
+}
+
+func strongChecksum(data ...[]byte) [blockStrongSize]byte {
+	h := sha256.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	var strong [blockStrongSize]byte
+	copy(strong[:], h.Sum(nil))
+	return strong
+}
+
+// DeltaBlockSize picks a block size for a file, growing with its size to bound the checksums sent.
+func DeltaBlockSize(size int64) int {
+	blockSize := int(math.Sqrt(float64(size)))
+	blockSize = (blockSize + 1023) / 1024 * 1024
+	if blockSize < minBlockSize {
+		return minBlockSize
+	} else if blockSize > maxBlockSize {
+		return maxBlockSize
+	}
+	return blockSize
+}
+
+// computeSignature returns the packed checksums of every block of r, the last one may be shorter.
+func computeSignature(r io.Reader, blockSize int) ([]byte, error) {
+	var packed bytes.Buffer
+	block := make([]byte, blockSize)
+	var roll rollingChecksum
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			roll.init(block[:n])
+			strong := strongChecksum(block[:n])
+			binary.Write(&packed, binary.BigEndian, roll.sum())
+			packed.Write(strong[:])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return packed.Bytes(), nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func unpackSignature(packed []byte) ([]blockSig, error) {
+	if len(packed)%blockSigSize != 0 {
+		return nil, errors.New("block checksums malformed")
+	}
+	sigs := make([]blockSig, len(packed)/blockSigSize)
+	for i := range sigs {
+		b := packed[i*blockSigSize:]
+		sigs[i].weak = binary.BigEndian.Uint32(b)
+		copy(sigs[i].strong[:], b[4:blockSigSize])
+	}
+	return sigs, nil
+}
+
+// deltaWriter encodes the delta ops, merging consecutive blocks and literal bytes.
+type deltaWriter struct {
+	w          io.Writer
+	literal    []byte
+	copyStart  uint32
+	copyCount  uint32
+	literalLen int64
+	matchedLen int64
+}
+
+func (d *deltaWriter) writeLiteral(b byte) error {
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	d.literal = append(d.literal, b)
+	if len(d.literal) >= maxLiteralLength {
+		return d.flushLiteral()
+	}
+	return nil
+}
+
+func (d *deltaWriter) writeLiteralBlock(data []byte) error {
+	for _, b := range data {
+		if err := d.writeLiteral(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *deltaWriter) writeCopy(block uint32, length int) error {
+	if err := d.flushLiteral(); err != nil {
+		return err
+	}
+	d.matchedLen += int64(length)
+	if d.copyCount > 0 && d.copyStart+d.copyCount == block {
+		d.copyCount++
+		return nil
+	}
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	d.copyStart, d.copyCount = block, 1
+	return nil
+}
+
+func (d *deltaWriter) flushLiteral() error {
+	if len(d.literal) == 0 {
+		return nil
+	}
+	header := [5]byte{deltaOpLiteral}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(d.literal)))
+	if _, err := d.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := d.w.Write(d.literal); err != nil {
+		return err
+	}
+	d.literalLen += int64(len(d.literal))
+	d.literal = d.literal[:0]
+	return nil
+}
+
+func (d *deltaWriter) flushCopy() error {
+	if d.copyCount == 0 {
+		return nil
+	}
+	op := [9]byte{deltaOpCopy}
+	binary.BigEndian.PutUint32(op[1:], d.copyStart)
+	binary.BigEndian.PutUint32(op[5:], d.copyCount)
+	d.copyCount = 0
+	_, err := d.w.Write(op[:])
+	return err
+}
+
+func (d *deltaWriter) flush() error {
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	return d.flushLiteral()
+}
+
+// computeDelta writes into w the delta rebuilding src from the base described by sigs,
+// returning the literal and the matched bytes.
+func computeDelta(src io.Reader, sigs []blockSig, blockSize int, baseSize int64, w io.Writer) (int64, int64, error) {
+	index := make(map[uint32][]int)
+	for i, s := range sigs {
+		index[s.weak] = append(index[s.weak], i)
+	}
+	lastBlockLen := 0
+	if len(sigs) > 0 {
+		lastBlockLen = int(baseSize - int64(len(sigs)-1)*int64(blockSize))
+	}
+	blockLen := func(i int) int {
+		if i == len(sigs)-1 {
+			return lastBlockLen
+		}
+		return blockSize
+	}
+	match := func(weak uint32, length int, data ...[]byte) (int, bool) {
+		candidates, ok := index[weak]
+		if !ok {
+			return 0, false
+		}
+		strong := strongChecksum(data...)
+		for _, i := range candidates {
+			if blockLen(i) == length && sigs[i].strong == strong {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+
+	enc := deltaWriter{w: w}
+	br := bufio.NewReaderSize(src, 64*1024)
+	ring := make([]byte, blockSize)
+	fill := func() (int, error) {
+		n, err := io.ReadFull(br, ring)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, nil
+		}
+		return n, err
+	}
+
+	n, err := fill()
+	if err != nil {
+		return 0, 0, err
+	}
+	tail := ring[:n]
+	start := 0
+	var roll rollingChecksum
+	if n == blockSize {
+		roll.init(ring)
+	}
+	for n == blockSize {
+		if i, ok := match(roll.sum(), blockSize, ring[start:], ring[:start]); ok {
+			if err = enc.writeCopy(uint32(i), blockSize); err != nil {
+				return 0, 0, err
+			}
+			if n, err = fill(); err != nil {
+				return 0, 0, err
+			}
+			tail, start = ring[:n], 0
+			if n == blockSize {
+				roll.init(ring)
+			}
+			continue
+		}
+
+		out := ring[start]
+		if err = enc.writeLiteral(out); err != nil {
+			return 0, 0, err
+		}
+		in, errRead := br.ReadByte()
+		if errRead == io.EOF {
+			tail = append(append([]byte{}, ring[start+1:]...), ring[:start]...)
+			break
+		} else if errRead != nil {
+			return 0, 0, errRead
+		}
+		ring[start] = in
+		start = (start + 1) % blockSize
+		roll.roll(out, in)
+	}
+
+	// what is left is shorter than a block, it can only be the last block of the base
+	if len(tail) > 0 {
+		roll.init(tail)
+		if i, ok := match(roll.sum(), len(tail), tail); ok {
+			err = enc.writeCopy(uint32(i), len(tail))
+		} else {
+			err = enc.writeLiteralBlock(tail)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if err = enc.flush(); err != nil {
+		return 0, 0, err
+	}
+	return enc.literalLen, enc.matchedLen, nil
+}
+
+// applyDelta rebuilds into out the file described by delta, base may be nil if there is none.
+func applyDelta(base io.ReaderAt, baseSize int64, delta io.Reader, out io.Writer, blockSize int) error {
+	if blockSize <= 0 {
+		return errors.New("block size not valid")
+	}
+	header := make([]byte, 9)
+	for {
+		_, err := io.ReadFull(delta, header[:1])
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch header[0] {
+		case deltaOpCopy:
+			if _, err = io.ReadFull(delta, header[1:9]); err != nil {
+				return err
+			}
+			if base == nil {
+				return errors.New("delta references a missing base")
+			}
+			offset := int64(binary.BigEndian.Uint32(header[1:])) * int64(blockSize)
+			length := int64(binary.BigEndian.Uint32(header[5:])) * int64(blockSize)
+			if offset+length > baseSize {
+				length = baseSize - offset
+			}
+			if length <= 0 {
+				return errors.New("delta block out of range")
+			}
+			if _, err = io.Copy(out, io.NewSectionReader(base, offset, length)); err != nil {
+				return err
+			}
+		case deltaOpLiteral:
+			if _, err = io.ReadFull(delta, header[1:5]); err != nil {
+				return err
+			}
+			length := int64(binary.BigEndian.Uint32(header[1:]))
+			if _, err = io.CopyN(out, delta, length); err != nil {
+				return err
+			}
+		default:
+			return errors.New(fmt.Sprintf("delta op %d unknown", header[0]))
+		}
+	}
+}
+
+// handleSignatureRequest replies with the block checksums of a server file, to build a delta against it.
+func (s *MqttServerCp) handleSignatureRequest(data MqttJsonCp) {
+	data.Step = MqttCpStep_Result
+	blocks, err := s.fileSignature(&data.Request)
+	if err != nil {
+		data.Error = err.Error()
+		log.Errorf("%s %s: %s", data.Request.Cmd, data.Request.ServerPath, err.Error())
+	}
+	data.Blocks = blocks
+	errT := s.Transmit(data)
+	if errT != nil {
+		log.Error(errT.Error())
+	}
+}
+
+func (s *MqttServerCp) fileSignature(req *MqttJsonCpRequest) ([]byte, error) {
+	if req.BlockSize < minBlockSize || req.BlockSize > maxBlockSize {
+		return nil, errors.New(fmt.Sprintf("block size must be between %d and %d", minBlockSize, maxBlockSize))
+	}
+	if req.HashAlgo == "" {
+		req.HashAlgo = defaultHashAlgo
+	}
+	errHash := s.validateHashAlgo(req.HashAlgo)
+	if errHash != nil {
+		return nil, errHash
+	}
+	// the checksums let a client guess the content, so reading is required too
+	p, err := s.getPathJail().CheckRead(req.ServerPath)
+	if err != nil {
+		return nil, err
+	}
+	size, hashValue, err := takeFileInfo(p, req.HashAlgo)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	req.Size = size
+	req.Hash = hashValue
+	return computeSignature(bufio.NewReader(f), req.BlockSize)
+}
+
+// patchFile rebuilds the destination applying the received delta to the current file,
+// returning the new file beside it and its digest.
+func (s *MqttServerCp) patchFile(deltaName string, req MqttJsonCpRequest) (string, []byte, error) {
+	var base io.ReaderAt
+	var baseSize int64
+	if req.BaseHash != "" {
+		size, baseHash, err := takeFileInfo(req.ServerPath, req.HashAlgo)
+		if err != nil {
+			return "", nil, err
+		} else if baseHash != req.BaseHash {
+			return "", nil, errors.New(fmt.Sprintf("%s changed during the transfer", req.ServerPath))
+		}
+		f, err := os.Open(req.ServerPath)
+		if err != nil {
+			return "", nil, err
+		}
+		defer f.Close()
+		base, baseSize = f, size
+	}
+
+	delta, err := os.Open(deltaName)
+	if err != nil {
+		return "", nil, err
+	}
+	defer delta.Close()
+
+	out, err := createTempFile(req.ServerPath)
+	if err != nil {
+		return "", nil, err
+	}
+	writer := bufio.NewWriter(out)
+	errApply := applyDelta(base, baseSize, bufio.NewReader(delta), writer, req.BlockSize)
+	if errApply == nil {
+		errApply = writer.Flush()
+	}
+	errClose := out.Close()
+	if errApply == nil {
+		errApply = errClose
+	}
+	var digest []byte
+	if errApply == nil {
+		digest, errApply = checkFileIntegrity(out.Name(), req.HashAlgo, req.TargetHash, req.TargetSize)
+	}
+	if errApply != nil {
+		os.Remove(out.Name())
+		return "", nil, errApply
+	}
+	return out.Name(), digest, nil
+}
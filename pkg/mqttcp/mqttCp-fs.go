@@ -0,0 +1,312 @@
+package mqttcp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/lithammer/shortuuid/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultFsTimeout = 10 * time.Second
+const defaultDirMode = 0755
+
+func isFsCommand(cmd string) bool {
+	switch cmd {
+	case MqttCpCommand_List, MqttCpCommand_Stat, MqttCpCommand_Mkdir, MqttCpCommand_Remove, MqttCpCommand_Rename, MqttCpCommand_SetAttr, MqttCpCommand_Hash:
+		return true
+	}
+	return false
+}
+
+func newFsEntry(p string, info os.FileInfo) MqttJsonFsEntry {
+	entry := MqttJsonFsEntry{
+		Name:    info.Name(),
+		Path:    p,
+		Size:    info.Size(),
+		Mode:    uint32(info.Mode()),
+		Perm:    info.Mode().String(),
+		ModTime: info.ModTime().UnixNano(),
+		IsDir:   info.IsDir(),
+		IsLink:  info.Mode()&os.ModeSymlink != 0,
+	}
+	if entry.IsLink {
+		entry.Link, _ = os.Readlink(p)
+	}
+	if uid, gid, ok := fileOwner(info); ok {
+		entry.Uid = &uid
+		entry.Gid = &gid
+	}
+	return entry
+}
+
+// handleFsRequest runs a filesystem command and replies with a single result message.
+func (s *MqttServerCp) handleFsRequest(data MqttJsonCp) {
+	entries, err := s.execFsCommand(data.Request)
+	data.Step = MqttCpStep_Result
+	data.Entries = entries
+	if err != nil {
+		data.Error = err.Error()
+		data.NotExist = isNotExist(err)
+		log.Errorf("%s %s: %s", data.Request.Cmd, data.Request.ServerPath, err.Error())
+	}
+	errT := s.Transmit(data)
+	if errT != nil {
+		log.Error(errT.Error())
+	}
+}
+
+func (s *MqttServerCp) execFsCommand(req MqttJsonCpRequest) ([]MqttJsonFsEntry, error) {
+	if req.ServerPath == "" {
+		return nil, errors.New("missing remote path")
+	} else if !path.IsAbs(req.ServerPath) {
+		return nil, errors.New("path must be absolute")
+	}
+
+	switch req.Cmd {
+	case MqttCpCommand_List:
+		dir, err := s.getPathJail().CheckRead(req.ServerPath)
+		if err != nil {
+			return nil, err
+		}
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		entries := make([]MqttJsonFsEntry, 0, len(files))
+		for _, f := range files {
+			info, errInfo := f.Info()
+			if errInfo != nil {
+				continue
+			}
+			entries = append(entries, newFsEntry(filepath.Join(dir, f.Name()), info))
+		}
+		return entries, nil
+
+	case MqttCpCommand_Stat:
+		p, err := s.getPathJail().CheckReadEntry(req.ServerPath)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Lstat(p)
+		if err != nil {
+			return nil, err
+		}
+		return []MqttJsonFsEntry{newFsEntry(p, info)}, nil
+
+	case MqttCpCommand_Hash:
+		if req.HashAlgo == "" {
+			req.HashAlgo = defaultHashAlgo
+		}
+		err := s.validateHashAlgo(req.HashAlgo)
+		if err != nil {
+			return nil, err
+		}
+		p, err := s.getPathJail().CheckRead(req.ServerPath)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		_, hashValue, err := takeFileInfo(p, req.HashAlgo)
+		if err != nil {
+			return nil, err
+		}
+		entry := newFsEntry(p, info)
+		entry.Hash = hashValue
+		return []MqttJsonFsEntry{entry}, nil
+
+	case MqttCpCommand_Mkdir:
+		p, err := s.getPathJail().CheckWrite(req.ServerPath)
+		if err != nil {
+			return nil, err
+		}
+		mode := os.FileMode(defaultDirMode)
+		if req.SetMode != "" {
+			mode, err = parseFileMode(req.SetMode)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if req.Recursive {
+			err = os.MkdirAll(p, mode)
+		} else {
+			err = os.Mkdir(p, mode)
+		}
+		return nil, err
+
+	case MqttCpCommand_Remove:
+		p, err := s.getPathJail().CheckWriteEntry(req.ServerPath)
+		if err != nil {
+			return nil, err
+		}
+		if req.Recursive {
+			if _, errStat := os.Lstat(p); errStat != nil {
+				return nil, errStat
+			}
+			return nil, os.RemoveAll(p)
+		}
+		return nil, os.Remove(p)
+
+	case MqttCpCommand_Rename:
+		if req.DestPath == "" {
+			return nil, errors.New("missing destination path")
+		}
+		oldPath, err := s.getPathJail().CheckWriteEntry(req.ServerPath)
+		if err != nil {
+			return nil, err
+		}
+		newPath, err := s.getPathJail().CheckWriteEntry(req.DestPath)
+		if err != nil {
+			return nil, err
+		}
+		if _, errStat := os.Lstat(newPath); errStat == nil && req.Overwrite != MqttCpOverwrite_Overwrite {
+			return nil, errors.New(fmt.Sprintf("%s already exist", req.DestPath))
+		}
+		return nil, os.Rename(oldPath, newPath)
+
+	case MqttCpCommand_SetAttr:
+		p, err := s.getPathJail().CheckWrite(req.ServerPath)
+		if err != nil {
+			return nil, err
+		}
+		if req.SetMode != "" {
+			mode, errMode := parseFileMode(req.SetMode)
+			if errMode != nil {
+				return nil, errMode
+			}
+			if err = os.Chmod(p, mode); err != nil {
+				return nil, err
+			}
+		}
+		if req.ModTime != 0 {
+			if err = os.Chtimes(p, time.Now(), time.Unix(0, req.ModTime)); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+	return nil, errors.New("command unrecognized")
+}
+
+// fsRequest sends a filesystem command to the server and waits for its result.
+func (c *MqttClientCp) fsRequest(req MqttJsonCpRequest) (MqttJsonCp, error) {
+	if !path.IsAbs(req.ServerPath) || (req.DestPath != "" && !path.IsAbs(req.DestPath)) {
+		return MqttJsonCp{}, errors.New("remote path must be absolute")
+	}
+	return c.request(req, defaultFsTimeout)
+}
+
+// request sends a single message command and waits for its result.
+func (c *MqttClientCp) request(req MqttJsonCpRequest, timeout time.Duration) (MqttJsonCp, error) {
+	errConn := c.startUpClient()
+	if errConn != nil {
+		return MqttJsonCp{}, errConn
+	}
+
+	msg := MqttJsonCp{}
+	msg.ClientUUID = c.uuid
+	msg.UUID = shortuuid.New()
+	msg.Step = MqttCpStep_Handshake1
+	msg.Request = req
+
+	c.expectReplies(msg.UUID)
+	defer c.forgetReplies(msg.UUID)
+	errTrans := c.Transmit(msg)
+	if errTrans != nil {
+		return MqttJsonCp{}, errTrans
+	}
+
+	res, errRes := c.awaitResponse(msg.UUID, MqttCpStep_Result, timeout)
+	if errRes != nil {
+		return MqttJsonCp{}, errRes
+	} else if res.Error != "" {
+		return res, replyError(res)
+	}
+	return res, nil
+}
+
+// List returns the entries of a remote directory.
+func (c *MqttClientCp) List(remotePath string) ([]MqttJsonFsEntry, error) {
+	res, err := c.fsRequest(MqttJsonCpRequest{Cmd: MqttCpCommand_List, ServerPath: remotePath})
+	if err != nil {
+		return nil, err
+	}
+	return res.Entries, nil
+}
+
+// Stat describes a remote file, links are not followed.
+func (c *MqttClientCp) Stat(remotePath string) (MqttJsonFsEntry, error) {
+	res, err := c.fsRequest(MqttJsonCpRequest{Cmd: MqttCpCommand_Stat, ServerPath: remotePath})
+	if err != nil {
+		return MqttJsonFsEntry{}, err
+	} else if len(res.Entries) != 1 {
+		return MqttJsonFsEntry{}, errors.New("stat result missing")
+	}
+	return res.Entries[0], nil
+}
+
+// Hash returns the digest of a remote file, computed with the hash algorithm of the client.
+func (c *MqttClientCp) Hash(remotePath string) (string, error) {
+	res, err := c.fsRequest(MqttJsonCpRequest{Cmd: MqttCpCommand_Hash, ServerPath: remotePath, HashAlgo: c.hashAlgo})
+	if err != nil {
+		return "", err
+	} else if len(res.Entries) != 1 || res.Entries[0].Hash == "" {
+		return "", errors.New("hash result missing")
+	}
+	return res.Entries[0].Hash, nil
+}
+
+// Mkdir creates a remote directory, with parents the missing ones too; mode is octal, empty for default.
+func (c *MqttClientCp) Mkdir(remotePath string, parents bool, mode string) error {
+	_, err := c.fsRequest(MqttJsonCpRequest{Cmd: MqttCpCommand_Mkdir, ServerPath: remotePath, Recursive: parents, SetMode: mode})
+	return err
+}
+
+// Remove deletes a remote file or empty directory, recursive deletes whole trees.
+func (c *MqttClientCp) Remove(remotePath string, recursive bool) error {
+	_, err := c.fsRequest(MqttJsonCpRequest{Cmd: MqttCpCommand_Remove, ServerPath: remotePath, Recursive: recursive})
+	return err
+}
+
+// Rename moves a remote file, failing if newPath exists unless overwrite is set.
+func (c *MqttClientCp) Rename(oldPath string, newPath string, overwrite bool) error {
+	req := MqttJsonCpRequest{Cmd: MqttCpCommand_Rename, ServerPath: oldPath, DestPath: newPath, Overwrite: MqttCpOverwrite_Fail}
+	if overwrite {
+		req.Overwrite = MqttCpOverwrite_Overwrite
+	}
+	_, err := c.fsRequest(req)
+	return err
+}
+
+// SetAttr changes mode (octal, empty to keep it) and modification time (zero to keep it) of a remote file.
+func (c *MqttClientCp) SetAttr(remotePath string, mode string, modTime time.Time) error {
+	req := MqttJsonCpRequest{Cmd: MqttCpCommand_SetAttr, ServerPath: remotePath, SetMode: mode}
+	if !modTime.IsZero() {
+		req.ModTime = modTime.UnixNano()
+	}
+	_, err := c.fsRequest(req)
+	return err
+}
+
+// FileInfo exposes the entry as an os.FileInfo.
+func (e MqttJsonFsEntry) FileInfo() os.FileInfo {
+	return fsEntryInfo{entry: e}
+}
+
+type fsEntryInfo struct {
+	entry MqttJsonFsEntry
+}
+
+func (i fsEntryInfo) Name() string       { return i.entry.Name }
+func (i fsEntryInfo) Size() int64        { return i.entry.Size }
+func (i fsEntryInfo) Mode() os.FileMode  { return os.FileMode(i.entry.Mode) }
+func (i fsEntryInfo) ModTime() time.Time { return time.Unix(0, i.entry.ModTime) }
+func (i fsEntryInfo) IsDir() bool        { return i.entry.IsDir }
+func (i fsEntryInfo) Sys() interface{}   { return nil }
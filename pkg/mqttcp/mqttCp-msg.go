@@ -9,13 +9,69 @@ type MqttJsonCp struct {
 	Error      string            `json:"error"`
 	Topic      string            `json:"topic"`
 	EndStr     string            `json:"endStr"`
+	Entries    []MqttJsonFsEntry `json:"entries,omitempty"`
+	// packed block checksums, see computeSignature
+	Blocks []byte `json:"blocks,omitempty"`
+	// frames missing to a multicast receiver
+	Frames []uint16 `json:"frames,omitempty"`
+	// transfers in progress on the server
+	Transfers []MqttJsonTransfer `json:"transfers,omitempty"`
+	// the error is about a path missing on the server
+	NotExist bool `json:"notexist,omitempty"`
 }
 
 type MqttJsonCpRequest struct {
-	Cmd        string `json:"cmd"`
-	ClientPath string `json:"clientpath"`
-	ServerPath string `json:"serverpath"`
-	Size       int64  `json:"size"`
-	MD5        string `json:"md5"`
-	Protocol   string `json:"protocol"`
+	Cmd          string `json:"cmd"`
+	ClientPath   string `json:"clientpath"`
+	ServerPath   string `json:"serverpath"`
+	DestPath     string `json:"destpath"`
+	Recursive    bool   `json:"recursive"`
+	Size         int64  `json:"size"`
+	MD5          string `json:"md5"`
+	HashAlgo     string `json:"hashalgo"`
+	Hash         string `json:"hash"`
+	Signature    string `json:"signature"`
+	Overwrite    string `json:"overwrite"`
+	BackupSuffix string `json:"backupsuffix"`
+	Protocol     string `json:"protocol"`
+	// source file attributes, applied on the destination after the check
+	Mode          uint32 `json:"mode"`
+	ModTime       int64  `json:"mtime"`
+	Uid           *int   `json:"uid,omitempty"`
+	Gid           *int   `json:"gid,omitempty"`
+	PreserveOwner bool   `json:"preserveowner"`
+	// explicit destination attributes, override the source ones
+	SetMode  string `json:"setmode"`
+	SetOwner string `json:"setowner"`
+	// delta transfers: Size and Hash describe the delta, these the rebuilt file
+	BlockSize  int    `json:"blocksize,omitempty"`
+	BaseHash   string `json:"basehash,omitempty"`
+	TargetSize int64  `json:"targetsize,omitempty"`
+	TargetHash string `json:"targethash,omitempty"`
+	// transfer to cancel
+	TransferUUID string `json:"transferuuid,omitempty"`
+}
+
+// MqttJsonCpStreamEnd is the trailer of a stream, carried by its end frame.
+type MqttJsonCpStreamEnd struct {
+	Size      int64  `json:"size"`
+	Hash      string `json:"hash"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// MqttJsonFsEntry describes a remote file, result of the filesystem commands.
+type MqttJsonFsEntry struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	Mode    uint32 `json:"mode"`
+	Perm    string `json:"perm"`
+	ModTime int64  `json:"mtime"`
+	IsDir   bool   `json:"isdir"`
+	IsLink  bool   `json:"islink"`
+	Link    string `json:"link,omitempty"`
+	Uid     *int   `json:"uid,omitempty"`
+	Gid     *int   `json:"gid,omitempty"`
+	// digest of the content, only set by the hash command
+	Hash string `json:"hash,omitempty"`
 }
@@ -0,0 +1,432 @@
+package mqttcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp/mft"
+	log "github.com/sirupsen/logrus"
+)
+
+// Multicast transfers publish the frames once on a topic shared by every target server.
+// Frames can be received in any order; a server missing some of them asks the sender to
+// publish them again (repair step) and reports the outcome with its own end message.
+
+const (
+	// a receiver without new frames for this long asks for the missing ones
+	multicastRepairInterval = 3 * time.Second
+	// repair requests without any progress before a receiver gives up
+	maxMulticastRepairs = 5
+	// frames asked in a single repair request
+	maxRepairFrames = 2000
+	// repair requests of different nodes are merged within this window
+	multicastRepairWindow = 500 * time.Millisecond
+	// the sender gives up on nodes silent for this long
+	multicastIdleTimeout = (maxMulticastRepairs + 2) * multicastRepairInterval
+)
+
+// MulticastTarget is a copy server taking part to a multicast transfer.
+type MulticastTarget struct {
+	Id      string
+	RxTopic string
+	TxTopic string
+}
+
+// MulticastResult is the outcome of a multicast transfer on a single server.
+type MulticastResult struct {
+	Id      string
+	Error   string
+	EndStr  string
+	Repairs int
+}
+
+type multicastMsg struct {
+	id  string
+	msg MqttJsonCp
+}
+
+func frameCount(size int64) int {
+	payloadSize := int64(mft.MFT_PAYLOAD_SIZE())
+	return int((size + payloadSize - 1) / payloadSize)
+}
+
+// tooManyFrames tells if a file of size bytes needs more frames than a transfer can number.
+func tooManyFrames(size int64) bool {
+	return size > int64(^uint16(0))*int64(mft.MFT_PAYLOAD_SIZE())
+}
+
+// Multicast copies localFile to remotePath on every target, publishing the data once.
+// It returns the result of each target; the error is set only if the transfer could not start.
+func (c *MqttClientCp) Multicast(localFile string, remotePath string, targets []MulticastTarget, progress *chan mft.MftProgress) ([]MulticastResult, error) {
+	errConn := c.startUpClient()
+	if errConn != nil {
+		return nil, errConn
+	}
+	if !path.IsAbs(remotePath) {
+		return nil, errors.New("remote path must be absolute")
+	} else if len(targets) == 0 {
+		return nil, errors.New("no target")
+	}
+
+	size, hashValue, err := takeFileInfo(localFile, c.hashAlgo)
+	if err != nil {
+		return nil, err
+	}
+	if tooManyFrames(size) {
+		return nil, errors.New("file too big")
+	}
+	signature, err := c.fileSignature(hashValue)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("error in signature: %s", err.Error()))
+	}
+	msg, err := c.newUploadRequest(localFile, remotePath, size, hashValue, signature)
+	if err != nil {
+		return nil, err
+	}
+	msg.Request.Cmd = MqttCpCommand_Multicast
+	msg.Topic = c.mftTopic(c.uuid, msg.UUID)
+
+	inbound := make(chan multicastMsg, 1000)
+	for _, t := range targets {
+		id := t.Id
+		onReply := func(client MQTT.Client, m MQTT.Message) {
+			data := MqttJsonCp{}
+			if errJson := json.Unmarshal(decodeData(m.Payload()), &data); errJson != nil {
+				return
+			}
+			if data.ClientUUID == c.uuid && data.UUID == msg.UUID {
+				inbound <- multicastMsg{id: id, msg: data}
+			}
+		}
+		errSub := c.worker.Subscribe(t.RxTopic, onReply)
+		if errSub != nil {
+			return nil, errSub
+		}
+		defer c.restoreSubscription(t.RxTopic)
+	}
+
+	results := make(map[string]*MulticastResult)
+	for _, t := range targets {
+		results[t.Id] = &MulticastResult{Id: t.Id}
+		errT := c.transmitTo(t.TxTopic, msg)
+		if errT != nil {
+			results[t.Id].Error = errT.Error()
+		}
+	}
+
+	pending := c.multicastHandshake(inbound, results, targets)
+	if len(pending) == 0 {
+		return sortedResults(results), errors.New("no server accepted the transfer")
+	}
+
+	startMsg := msg
+	startMsg.Step = MqttCpStep_Start
+	for _, t := range targets {
+		if pending[t.Id] {
+			errT := c.transmitTo(t.TxTopic, startMsg)
+			if errT != nil {
+				results[t.Id].Error = errT.Error()
+				delete(pending, t.Id)
+			}
+		}
+	}
+
+	errTrans := c.mftTransmitFile(localFile, msg.Topic, progress, nil)
+	if errTrans != nil {
+		return sortedResults(results), errors.New(fmt.Sprintf("error in data transfer: %s", errTrans.Error()))
+	}
+
+	c.multicastRepair(localFile, msg.Topic, frameCount(size), inbound, results, pending)
+	return sortedResults(results), nil
+}
+
+// multicastHandshake collects the answers to the request, returning the servers ready for the data.
+func (c *MqttClientCp) multicastHandshake(inbound chan multicastMsg, results map[string]*MulticastResult, targets []MulticastTarget) map[string]bool {
+	waiting := make(map[string]bool)
+	for _, t := range targets {
+		if results[t.Id].Error == "" {
+			waiting[t.Id] = true
+		}
+	}
+	pending := make(map[string]bool)
+	timeout := time.NewTimer(c.handshakeTimeout)
+	defer timeout.Stop()
+	for len(waiting) > 0 {
+		select {
+		case m := <-inbound:
+			if !waiting[m.id] || m.msg.Step != MqttCpStep_Handshake2 {
+				continue
+			}
+			delete(waiting, m.id)
+			errHandshake := c.validateHandshake(m.msg)
+			if errHandshake != nil {
+				results[m.id].Error = errHandshake.Error()
+			} else {
+				pending[m.id] = true
+			}
+		case <-timeout.C:
+			for id := range waiting {
+				results[id].Error = "no answer"
+			}
+			return pending
+		}
+	}
+	return pending
+}
+
+// multicastRepair publishes again the frames the servers missed, until every server reported its outcome.
+func (c *MqttClientCp) multicastRepair(localFile string, topic string, total int, inbound chan multicastMsg, results map[string]*MulticastResult, pending map[string]bool) {
+	missing := make(map[uint16]bool)
+	var repairC <-chan time.Time
+	idle := time.NewTimer(multicastIdleTimeout)
+	defer idle.Stop()
+
+	for len(pending) > 0 {
+		select {
+		case m := <-inbound:
+			if !pending[m.id] {
+				continue
+			}
+			switch m.msg.Step {
+			case MqttCpStep_Repair:
+				results[m.id].Repairs++
+				for _, no := range m.msg.Frames {
+					missing[no] = true
+				}
+				if repairC == nil {
+					repairC = time.After(multicastRepairWindow)
+				}
+			case MqttCpStep_Cancel:
+				results[m.id].Error = errTransferCanceled.Error()
+				delete(pending, m.id)
+			case MqttCpStep_End:
+				results[m.id].Error = m.msg.Error
+				results[m.id].EndStr = m.msg.EndStr
+				delete(pending, m.id)
+			default:
+				continue
+			}
+			idle.Reset(multicastIdleTimeout)
+		case <-repairC:
+			repairC = nil
+			frames := make([]uint16, 0, len(missing))
+			for no := range missing {
+				frames = append(frames, no)
+			}
+			missing = make(map[uint16]bool)
+			errRepair := c.mftTransmitFrames(localFile, topic, total, frames)
+			if errRepair != nil {
+				log.Errorf("error in repair: %s", errRepair.Error())
+			}
+		case <-idle.C:
+			for id := range pending {
+				results[id].Error = "timeout"
+			}
+			return
+		}
+	}
+}
+
+// restoreSubscription removes a multicast subscription, giving the topic back to the client if it is its own.
+func (c *MqttClientCp) restoreSubscription(topic string) {
+	c.worker.Unsubscribe(topic)
+	if topic == c.rxTopic {
+		c.worker.Subscribe(c.rxTopic, c.onBrokerData)
+	}
+}
+
+func sortedResults(results map[string]*MulticastResult) []MulticastResult {
+	list := make([]MulticastResult, 0, len(results))
+	for _, r := range results {
+		list = append(list, *r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+// mftTransmitFrames publishes again some frames of a file followed by the end frame.
+func (m *MqttCp) mftTransmitFrames(fileName string, topic string, total int, frames []uint16) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sort.Slice(frames, func(i, j int) bool { return frames[i] > frames[j] })
+	payloadSize := mft.MFT_PAYLOAD_SIZE()
+	buf := make([]byte, payloadSize)
+	for _, no := range frames {
+		if int(no) < 1 || int(no) > total {
+			continue
+		}
+		offset := int64(total-int(no)) * int64(payloadSize)
+		n, errRead := f.ReadAt(buf, offset)
+		if errRead != nil && errRead != io.EOF {
+			return errRead
+		}
+		errT := m.mftTransmit(buf[:n], no, topic)
+		if errT != nil {
+			return errT
+		}
+		time.Sleep(mft.MFT_FRAME_DELAY())
+	}
+	m.mftTransmitEnd(0, topic)
+	return nil
+}
+
+func (s *MqttServerCp) runMulticastTransfer(msg *MqttJsonCp, conn *ClientCpConnection) {
+	defer s.unregisterTransfer(conn)
+
+	inChan := make(chan []byte, 10000)
+	// subscribed before answering, the frames are published as soon as every server answered
+	errSub := s.worker.Subscribe(msg.Topic, queueFrames(inChan))
+	if errSub != nil {
+		s.failHandshake(*msg, errSub.Error())
+		return
+	}
+	defer s.worker.Unsubscribe(msg.Topic)
+
+	f, errCreation := createTempFile(msg.Request.ServerPath)
+	if errCreation != nil {
+		s.failHandshake(*msg, errCreation.Error())
+		return
+	}
+	tmpName := f.Name()
+	defer os.Remove(tmpName)
+
+	msg.Step = MqttCpStep_Handshake2
+	err := s.Transmit(*msg)
+	if err != nil {
+		log.Error(err.Error())
+		f.Close()
+		return
+	}
+
+	// the client starts once every server answered or its own handshake timeout expired
+	startMsg, errStart := conn.awaitResponse(MqttCpStep_Start, 2*s.handshakeTimeout)
+	if errStart != nil || startMsg.Error != "" {
+		log.Error("multicast transfer not started")
+		f.Close()
+		return
+	}
+
+	errRecv := s.mftReceiveMulticast(f, inChan, *msg, conn)
+	errClose := f.Close()
+	if errRecv == nil {
+		errRecv = errClose
+	}
+	var digest []byte
+	if errRecv == nil {
+		digest, errRecv = checkFileIntegrity(tmpName, msg.Request.HashAlgo, msg.Request.Hash, msg.Request.Size)
+	}
+	if errRecv == nil {
+		errRecv = s.commitReceivedFile(tmpName, digest, msg.Request)
+	}
+	if errRecv != nil {
+		s.failEnd(*msg, errRecv.Error())
+		return
+	}
+
+	msg.Step = MqttCpStep_End
+	finalMsg := fmt.Sprintf("file received with sucess: %s", msg.Request.ServerPath)
+	msg.EndStr = finalMsg
+	log.Info(finalMsg)
+	errTx := s.Transmit(*msg)
+	if errTx != nil {
+		log.Error(errTx.Error())
+	}
+}
+
+// mftReceiveMulticast writes every frame at its offset, asking for the missing ones
+// when the sender ends or stays silent.
+func (s *MqttServerCp) mftReceiveMulticast(f *os.File, inChan chan []byte, msg MqttJsonCp, conn *ClientCpConnection) error {
+	payloadSize := int64(mft.MFT_PAYLOAD_SIZE())
+	size := msg.Request.Size
+	total := frameCount(size)
+	received := make([]bool, total)
+	missing := total
+	repairs := 0
+	lastFrameTs := time.Now()
+	ticker := time.NewTicker(multicastRepairInterval)
+	defer ticker.Stop()
+
+	for missing > 0 {
+		select {
+		case b := <-inChan:
+			frame, errM := mft.DecodeMftFrame(b)
+			if errM != nil {
+				log.Debugf("multicast frame dropped: %s", errM.Error())
+				continue
+			}
+			switch frame.GetFrameType() {
+			case mft.MftFrameType_TRANSMISSION:
+				no := int(frame.GetFrameNo())
+				if no < 1 || no > total || received[total-no] {
+					continue
+				}
+				idx := int64(total - no)
+				expected := payloadSize
+				if size-idx*payloadSize < expected {
+					expected = size - idx*payloadSize
+				}
+				payload := frame.GetPayload()
+				if int64(len(payload)) != expected {
+					continue
+				}
+				_, errW := f.WriteAt(payload, idx*payloadSize)
+				if errW != nil {
+					return errW
+				}
+				received[total-no] = true
+				missing--
+				conn.setFramesDone(uint32(total - missing))
+				repairs = 0
+				lastFrameTs = time.Now()
+			case mft.MftFrameType_END:
+				if missing > 0 {
+					repairs++
+					s.requestRepair(msg, received)
+				}
+			}
+		case <-ticker.C:
+			if time.Since(lastFrameTs) < multicastRepairInterval {
+				continue
+			}
+			if repairs >= maxMulticastRepairs {
+				return errors.New(fmt.Sprintf("%d frames missing", missing))
+			}
+			repairs++
+			s.requestRepair(msg, received)
+		case <-conn.cancel:
+			return errTransferCanceled
+		}
+	}
+	return nil
+}
+
+func (s *MqttServerCp) requestRepair(msg MqttJsonCp, received []bool) {
+	total := len(received)
+	frames := make([]uint16, 0)
+	for idx, ok := range received {
+		if !ok {
+			frames = append(frames, uint16(total-idx))
+			if len(frames) >= maxRepairFrames {
+				break
+			}
+		}
+	}
+	log.Infof("multicast %s: asking %d frames again", msg.UUID, len(frames))
+	msg.Step = MqttCpStep_Repair
+	msg.Frames = frames
+	err := s.Transmit(msg)
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
@@ -0,0 +1,219 @@
+package mqttcp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lithammer/shortuuid/v3"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	MqttCpOverwrite_Fail      = "fail"
+	MqttCpOverwrite_Overwrite = "overwrite"
+	MqttCpOverwrite_Backup    = "backup"
+)
+
+const defaultBackupSuffix = ".bak"
+
+// PathJail restricts the server paths a client can read from and write to.
+// Paths are compared after following symlinks; an empty root list means unrestricted.
+type PathJail struct {
+	readRoots  []string
+	writeRoots []string
+}
+
+func NewPathJail(readRoots []string, writeRoots []string) (*PathJail, error) {
+	j := PathJail{}
+	for _, r := range readRoots {
+		resolved, err := resolveRoot(r)
+		if err != nil {
+			return nil, err
+		}
+		j.readRoots = append(j.readRoots, resolved)
+	}
+	for _, r := range writeRoots {
+		resolved, err := resolveRoot(r)
+		if err != nil {
+			return nil, err
+		}
+		j.writeRoots = append(j.writeRoots, resolved)
+	}
+	return &j, nil
+}
+
+// CheckRead returns the resolved path if p is inside one of the read roots.
+func (j *PathJail) CheckRead(p string) (string, error) {
+	resolved, err := resolvePath(p)
+	if err != nil {
+		return "", err
+	}
+	if j != nil && !isInsideRoots(resolved, j.readRoots) {
+		return "", errors.New(fmt.Sprintf("%s : read not allowed", p))
+	}
+	return resolved, nil
+}
+
+// CheckWrite returns the resolved path if p is inside one of the write roots.
+func (j *PathJail) CheckWrite(p string) (string, error) {
+	resolved, err := resolvePath(p)
+	if err != nil {
+		return "", err
+	}
+	if j != nil && !isInsideRoots(resolved, j.writeRoots) {
+		return "", errors.New(fmt.Sprintf("%s : write not allowed", p))
+	}
+	return resolved, nil
+}
+
+func resolveRoot(root string) (string, error) {
+	if !filepath.IsAbs(root) {
+		return "", errors.New(fmt.Sprintf("root %s must be absolute", root))
+	}
+	resolved, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// resolvePath follows every symlink of p; the trailing elements may not exist yet.
+func resolvePath(p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		return "", errors.New("path must be absolute")
+	}
+	current := filepath.Clean(p)
+	missing := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(current)
+		if err == nil {
+			return filepath.Join(resolved, missing), nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		if _, errL := os.Lstat(current); errL == nil {
+			// dangling symlink
+			return "", errors.New(fmt.Sprintf("%s : broken link", current))
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			return "", err
+		}
+		missing = filepath.Join(filepath.Base(current), missing)
+		current = parent
+	}
+}
+
+// resolveEntry resolves the parent of p only, so a symlink is the entry itself and not its target.
+func resolveEntry(p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		return "", errors.New("path must be absolute")
+	}
+	p = filepath.Clean(p)
+	if p == filepath.Dir(p) {
+		return p, nil
+	}
+	dir, err := resolvePath(filepath.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(p)), nil
+}
+
+// CheckReadEntry is CheckRead without following the last element of p.
+func (j *PathJail) CheckReadEntry(p string) (string, error) {
+	resolved, err := resolveEntry(p)
+	if err != nil {
+		return "", err
+	}
+	if j != nil && !isInsideRoots(resolved, j.readRoots) {
+		return "", errors.New(fmt.Sprintf("%s : read not allowed", p))
+	}
+	return resolved, nil
+}
+
+// CheckWriteEntry is CheckWrite without following the last element of p,
+// the write roots themselves can't be removed or renamed.
+func (j *PathJail) CheckWriteEntry(p string) (string, error) {
+	resolved, err := resolveEntry(p)
+	if err != nil {
+		return "", err
+	}
+	if j != nil && (!isInsideRoots(resolved, j.writeRoots) || isRoot(resolved, j.writeRoots)) {
+		return "", errors.New(fmt.Sprintf("%s : write not allowed", p))
+	}
+	return resolved, nil
+}
+
+func isRoot(p string, roots []string) bool {
+	for _, root := range roots {
+		if p == root {
+			return true
+		}
+	}
+	return false
+}
+
+func isInsideRoots(p string, roots []string) bool {
+	if len(roots) == 0 {
+		return true
+	}
+	for _, root := range roots {
+		if p == root || strings.HasPrefix(p, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateOverwritePolicy(policy string, backupSuffix string) error {
+	if strings.ContainsRune(backupSuffix, '/') || strings.ContainsRune(backupSuffix, filepath.Separator) {
+		return errors.New("backup suffix not valid")
+	}
+	switch policy {
+	case "", MqttCpOverwrite_Fail, MqttCpOverwrite_Overwrite, MqttCpOverwrite_Backup:
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("overwrite policy %s not valid", policy))
+	}
+}
+
+// checkOverwrite fails if dest already exists and the policy doesn't allow to replace it.
+func checkOverwrite(dest string, policy string) error {
+	info, err := os.Stat(dest)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if info.IsDir() {
+		return errors.New(fmt.Sprintf("%s is a dir", dest))
+	} else if policy == MqttCpOverwrite_Fail || policy == "" {
+		return errors.New(fmt.Sprintf("%s already exist", dest))
+	}
+	return nil
+}
+
+// createTempFile creates a unique temporary file beside dest, so a transfer never clobbers another one.
+func createTempFile(dest string) (*os.File, error) {
+	tmpName := filepath.Join(filepath.Dir(dest), fmt.Sprintf(".%s.%s.tmp", filepath.Base(dest), shortuuid.New()))
+	return os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+}
+
+// commitFile moves the received tmpName into dest applying the overwrite policy.
+func commitFile(tmpName string, dest string, policy string, backupSuffix string) error {
+	errCheck := checkOverwrite(dest, policy)
+	if errCheck != nil {
+		return errCheck
+	}
+	if policy == MqttCpOverwrite_Backup {
+		if backupSuffix == "" {
+			backupSuffix = defaultBackupSuffix
+		}
+		errBackup := os.Rename(dest, dest+backupSuffix)
+		if errBackup != nil && !os.IsNotExist(errBackup) {
+			return errBackup
+		}
+	}
+	return os.Rename(tmpName, dest)
+}
@@ -0,0 +1,118 @@
+package mqttcp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Signatures are detached ed25519 signatures of the SHA-256 digest of the file, i.e.
+//
+//	openssl dgst -sha256 -binary fw.bin > fw.sha256
+//	openssl pkeyutl -sign -rawin -inkey key.pem -in fw.sha256 > fw.bin.sig
+
+// LoadPublicKey reads an ed25519 public key, either PEM (PKIX) or base64 encoded.
+func LoadPublicKey(fileName string) (ed25519.PublicKey, error) {
+	raw, err := readKeyFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(raw); block != nil {
+		key, errParse := x509.ParsePKIXPublicKey(block.Bytes)
+		if errParse != nil {
+			return nil, errParse
+		}
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("%s is not an ed25519 public key", fileName))
+		}
+		return pub, nil
+	}
+
+	decoded, errDecode := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(raw)))
+	if errDecode != nil {
+		return nil, errDecode
+	} else if len(decoded) != ed25519.PublicKeySize {
+		return nil, errors.New(fmt.Sprintf("%s: wrong ed25519 public key size", fileName))
+	}
+	return ed25519.PublicKey(decoded), nil
+}
+
+// LoadPrivateKey reads an ed25519 private key, either PEM (PKCS8) or base64 encoded.
+func LoadPrivateKey(fileName string) (ed25519.PrivateKey, error) {
+	raw, err := readKeyFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(raw); block != nil {
+		key, errParse := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if errParse != nil {
+			return nil, errParse
+		}
+		priv, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("%s is not an ed25519 private key", fileName))
+		}
+		return priv, nil
+	}
+
+	decoded, errDecode := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(raw)))
+	if errDecode != nil {
+		return nil, errDecode
+	}
+	switch len(decoded) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(decoded), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(decoded), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("%s: wrong ed25519 private key size", fileName))
+	}
+}
+
+// LoadSignature reads a detached signature, either raw or base64 encoded.
+func LoadSignature(fileName string) ([]byte, error) {
+	raw, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == ed25519.SignatureSize {
+		return raw, nil
+	}
+	decoded, errDecode := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(raw)))
+	if errDecode != nil || len(decoded) != ed25519.SignatureSize {
+		return nil, errors.New(fmt.Sprintf("%s: invalid ed25519 signature", fileName))
+	}
+	return decoded, nil
+}
+
+func readKeyFile(fileName string) ([]byte, error) {
+	raw, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	} else if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, errors.New(fmt.Sprintf("%s is empty", fileName))
+	}
+	return raw, nil
+}
+
+func signDigest(key ed25519.PrivateKey, digest []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, digest))
+}
+
+func verifyDigest(key ed25519.PublicKey, digest []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.New("signature not decodable")
+	} else if !ed25519.Verify(key, digest, sig) {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
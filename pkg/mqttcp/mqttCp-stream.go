@@ -0,0 +1,331 @@
+package mqttcp
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp/mft"
+	"github.com/lithammer/shortuuid/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Streams have no frame count: the start frame carries 0, data frames are numbered
+// upward from 1 wrapping around, and the end frame carries size and hash of the data.
+// While the source is idle the start frame is repeated, so the receiver does not time out.
+
+// a file streamed to the server has no mode of its own
+const defaultStreamMode = 0644
+
+const streamKeepAlive = 2 * time.Second
+
+func isStreamCommand(cmd string) bool {
+	return cmd == MqttCpCommand_StreamLocalToRemote || cmd == MqttCpCommand_StreamRemoteToLocal
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+type streamChunk struct {
+	data []byte
+	err  error
+}
+
+// mftTransmitStream sends r until EOF and returns the trailer with size and hash of the data sent.
+func (m *MqttCp) mftTransmitStream(r io.Reader, topic string, algo string, progress *chan mft.MftProgress, cancel <-chan bool) (MqttJsonCpStreamEnd, error) {
+	end := MqttJsonCpStreamEnd{}
+	hasher, err := newHash(algo)
+	if err != nil {
+		return end, err
+	}
+
+	chunks := make(chan streamChunk)
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for {
+			buf := make([]byte, mft.MFT_PAYLOAD_SIZE())
+			n, errRead := r.Read(buf)
+			if n > 0 {
+				select {
+				case chunks <- streamChunk{data: buf[:n]}:
+				case <-done:
+					return
+				}
+			}
+			if errRead != nil {
+				select {
+				case chunks <- streamChunk{err: errRead}:
+				case <-done:
+				}
+				return
+			}
+		}
+	}()
+
+	m.mftTransmitStart(0, topic)
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	var frameNo uint16 = 0
+	var frameSent uint32 = 0
+	for {
+		select {
+		case chunk := <-chunks:
+			if chunk.err == io.EOF {
+				end.Hash = fmt.Sprintf("%x", hasher.Sum(nil))
+				return end, nil
+			} else if chunk.err != nil {
+				return end, chunk.err
+			}
+			frameNo++
+			errT := m.mftTransmit(chunk.data, frameNo, topic)
+			if errT != nil {
+				return end, errT
+			}
+			hasher.Write(chunk.data)
+			end.Size += int64(len(chunk.data))
+			frameSent++
+			if progress != nil {
+				*progress <- mft.MftProgress{FrameReceived: frameSent}
+			}
+			keepAlive.Reset(streamKeepAlive)
+			time.Sleep(mft.MFT_FRAME_DELAY())
+		case <-keepAlive.C:
+			m.mftTransmitStart(0, topic)
+		case <-cancel:
+			return end, errTransferCanceled
+		}
+	}
+}
+
+func (m *MqttCp) mftTransmitStreamEnd(end MqttJsonCpStreamEnd, topic string) error {
+	b, err := json.Marshal(end)
+	if err != nil {
+		return err
+	}
+	frame, err := mft.BuildMftEndFrameWithPayload(0, b)
+	if err != nil {
+		return err
+	}
+	m.worker.Publish(topic, frame.Encode())
+	return nil
+}
+
+// mftReceiveStream writes the stream into w, checking it against the trailer which is returned.
+func (m *MqttCp) mftReceiveStream(w io.Writer, inboundChan chan []byte, algo string, progress *chan mft.MftProgress, cancel <-chan bool) (MqttJsonCpStreamEnd, error) {
+	end := MqttJsonCpStreamEnd{}
+	hasher, err := newHash(algo)
+	if err != nil {
+		return end, err
+	}
+	counter := &countWriter{}
+	writer := bufio.NewWriter(w)
+	out := io.MultiWriter(writer, hasher, counter)
+
+	ready := false
+	var frameNext uint16 = 1
+	var frameReceived uint32 = 0
+	lastFrameTs := time.Now()
+	timeoutMftTransfer := mft.MFT_FRAME_TIMEOUT()
+	ticker := time.NewTicker(timeoutMftTransfer)
+	defer ticker.Stop()
+	for {
+		select {
+		case b := <-inboundChan:
+			lastFrameTs = time.Now()
+			frame, errM := mft.DecodeMftFrame(b)
+			if errM != nil {
+				return end, errM
+			}
+			switch frame.GetFrameType() {
+			case mft.MftFrameType_START:
+				ready = true
+			case mft.MftFrameType_TRANSMISSION:
+				if !ready {
+					return end, errors.New("missing start frame")
+				} else if frame.GetFrameNo() != frameNext {
+					return end, errors.New("wrong frame order")
+				}
+				frameNext++
+				_, errW := out.Write(frame.GetPayload())
+				if errW != nil {
+					return end, errW
+				}
+				frameReceived++
+				if progress != nil {
+					*progress <- mft.MftProgress{FrameReceived: frameReceived}
+				}
+			case mft.MftFrameType_END:
+				if !ready {
+					return end, errors.New("missing start frame")
+				}
+				errFlush := writer.Flush()
+				if errFlush != nil {
+					return end, errFlush
+				}
+				errJson := json.Unmarshal(frame.GetPayload(), &end)
+				if errJson != nil {
+					return end, errors.New(fmt.Sprintf("stream trailer not valid: %s", errJson.Error()))
+				}
+				hashValue := fmt.Sprintf("%x", hasher.Sum(nil))
+				if counter.n != end.Size {
+					return end, errors.New(fmt.Sprintf("fail check actual size %d, expected: %d", counter.n, end.Size))
+				} else if hashValue != end.Hash {
+					return end, errors.New(fmt.Sprintf("fail check actual %s %s, expected: %s", algo, hashValue, end.Hash))
+				}
+				return end, nil
+			}
+		case <-ticker.C:
+			if time.Since(lastFrameTs) > timeoutMftTransfer {
+				return end, errors.New("timeout on reception")
+			}
+		case <-cancel:
+			return end, errTransferCanceled
+		}
+	}
+}
+
+// UploadStream copies everything read from r to remotePath, returning the server outcome.
+func (c *MqttClientCp) UploadStream(r io.Reader, remotePath string, progress *chan mft.MftProgress) (string, error) {
+	errConn := c.startUpClient()
+	if errConn != nil {
+		return "", errConn
+	}
+	if !path.IsAbs(remotePath) {
+		return "", errors.New("remote path must be absolute")
+	} else if c.signingKey != nil && c.hashAlgo != MqttCpHash_SHA256 {
+		return "", errors.New("signature requires sha256")
+	}
+
+	msg := MqttJsonCp{}
+	msg.ClientUUID = c.uuid
+	msg.UUID = shortuuid.New()
+	msg.Step = MqttCpStep_Handshake1
+	msg.Request.Cmd = MqttCpCommand_StreamLocalToRemote
+	msg.Request.ClientPath = MqttCpStreamPath
+	msg.Request.ServerPath = remotePath
+	msg.Request.HashAlgo = c.hashAlgo
+	msg.Request.Overwrite = c.overwrite
+	msg.Request.BackupSuffix = c.backupSuffix
+	msg.Request.Mode = defaultStreamMode
+	msg.Request.ModTime = time.Now().UnixNano()
+	msg.Request.SetMode = c.setMode
+	msg.Request.SetOwner = c.setOwner
+
+	c.expectReplies(msg.UUID)
+	defer c.forgetReplies(msg.UUID)
+	uuid, transmissionTopic, errHandShake := c.local2RemoteHandshake(msg)
+	if errHandShake != nil {
+		return "", errors.New(fmt.Sprintf("error in handshake: %s", errHandShake.Error()))
+	}
+
+	cancel := c.registerTransfer(uuid)
+	defer c.unregisterTransfer(uuid)
+
+	end, errTrans := c.mftTransmitStream(r, transmissionTopic, c.hashAlgo, progress, cancel)
+	if errTrans != nil {
+		return "", errors.New(fmt.Sprintf("error in data transfer: %s", errTrans.Error()))
+	}
+	// the signature covers the data, known only now
+	end.Signature, errTrans = c.fileSignature(end.Hash)
+	if errTrans != nil {
+		return "", errors.New(fmt.Sprintf("error in signature: %s", errTrans.Error()))
+	}
+	errTrans = c.mftTransmitStreamEnd(end, transmissionTopic)
+	if errTrans != nil {
+		return "", errors.New(fmt.Sprintf("error in data transfer: %s", errTrans.Error()))
+	}
+	c.Printf("%d bytes sent", end.Size)
+	c.Println()
+
+	str, errV := c.verifyTransmission(uuid, defaultTransmissionTimeout)
+	if errV != nil {
+		return "", errors.New(fmt.Sprintf("error in data receiving: %s", errV.Error()))
+	}
+	return str, nil
+}
+
+// DownloadStream writes remoteFile into w, returning the number of bytes written.
+// Data reaches w while it is received: on a failed check w already holds part of it.
+func (c *MqttClientCp) DownloadStream(remoteFile string, w io.Writer, progress *chan mft.MftProgress) (int64, error) {
+	errConn := c.startUpClient()
+	if errConn != nil {
+		return 0, errConn
+	}
+	if !path.IsAbs(remoteFile) {
+		return 0, errors.New("remote path must be absolute")
+	}
+
+	uuid := shortuuid.New()
+	c.expectReplies(uuid)
+	defer c.forgetReplies(uuid)
+
+	startMsg, errHandShake := c.remote2LocalHandshake(uuid, MqttCpCommand_StreamRemoteToLocal, MqttCpStreamPath, remoteFile)
+	if errHandShake != nil {
+		return 0, errors.New(fmt.Sprintf("error in handshake: %s", errHandShake.Error()))
+	}
+
+	inChan := make(chan []byte, 10000)
+	errSub := c.worker.Subscribe(startMsg.Topic, queueFrames(inChan))
+	if errSub != nil {
+		return 0, errors.New(fmt.Sprintf("error in subscribe %s", errSub.Error()))
+	}
+	defer c.worker.Unsubscribe(startMsg.Topic)
+
+	cancel := c.registerTransfer(startMsg.UUID)
+	defer c.unregisterTransfer(startMsg.UUID)
+
+	errTrans := c.Transmit(*startMsg)
+	if errTrans != nil {
+		return 0, errors.New(fmt.Sprintf("error in start msg %s", errTrans.Error()))
+	}
+
+	end, errReceive := c.mftReceiveStream(w, inChan, startMsg.Request.HashAlgo, progress, cancel)
+	if errReceive != nil {
+		return 0, errReceive
+	}
+	return end.Size, nil
+}
+
+// transmitStream sends a server file as a stream, for files changing while they are read.
+func (s *MqttServerCp) transmitStream(serverPath string, topic string, algo string, conn *ClientCpConnection) (int64, error) {
+	f, err := os.Open(serverPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	end, err := s.mftTransmitStream(f, topic, algo, &conn.progress, conn.cancel)
+	if err != nil {
+		return 0, err
+	}
+	return end.Size, s.mftTransmitStreamEnd(end, topic)
+}
+
+// receiveStream receives a stream in f, filling the expected request with its trailer.
+func (s *MqttServerCp) receiveStream(f *os.File, inChan chan []byte, expected *MqttJsonCpRequest, conn *ClientCpConnection) ([]byte, error) {
+	end, errReception := s.mftReceiveStream(f, inChan, expected.HashAlgo, &conn.progress, conn.cancel)
+	errClose := f.Close()
+	if errReception != nil {
+		return nil, errReception
+	} else if errClose != nil {
+		return nil, errClose
+	}
+	log.Debugf("stream of %d bytes received", end.Size)
+	expected.Size = end.Size
+	expected.Hash = end.Hash
+	expected.Signature = end.Signature
+	return hex.DecodeString(end.Hash)
+}
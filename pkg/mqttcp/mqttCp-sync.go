@@ -0,0 +1,281 @@
+package mqttcp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// hashing a big file on a slow node takes a while
+const defaultSignatureTimeout = 2 * time.Minute
+
+// SyncStats summarizes what a sync did.
+type SyncStats struct {
+	Files   int
+	Skipped int
+	Dirs    int
+	Deleted int
+	Failed  int
+	// bytes sent as data and bytes reused from the remote copy
+	Literal int64
+	Matched int64
+}
+
+// Sync makes remotePath equal to the local file or directory, sending only the blocks that differ
+// from the remote copy. With deleteExtra remote entries missing locally are removed.
+func (c *MqttClientCp) Sync(localPath string, remotePath string, deleteExtra bool) (SyncStats, error) {
+	stats := SyncStats{}
+	errConn := c.startUpClient()
+	if errConn != nil {
+		return stats, errConn
+	}
+	if !path.IsAbs(remotePath) {
+		return stats, errors.New("remote path must be absolute")
+	}
+
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return stats, err
+	}
+
+	var remote *MqttJsonFsEntry
+	entry, errStat := c.Stat(remotePath)
+	if errStat == nil {
+		remote = &entry
+	} else if !errors.Is(errStat, ErrRemoteNotExist) {
+		return stats, errStat
+	}
+
+	if info.IsDir() {
+		err = c.syncDir(localPath, remotePath, remote, deleteExtra, &stats)
+	} else {
+		if remote != nil && remote.IsDir {
+			remotePath = path.Join(remotePath, filepath.Base(localPath))
+			remote = nil
+			entry, errStat = c.Stat(remotePath)
+			if errStat == nil {
+				remote = &entry
+			} else if !errors.Is(errStat, ErrRemoteNotExist) {
+				return stats, errStat
+			}
+		}
+		err = c.syncFile(localPath, remotePath, info, remote, &stats)
+		if err != nil {
+			stats.Failed++
+		}
+	}
+	if err == nil && stats.Failed > 0 {
+		err = errors.New(fmt.Sprintf("%d entries failed", stats.Failed))
+	}
+	return stats, err
+}
+
+func (c *MqttClientCp) syncDir(localDir string, remoteDir string, remote *MqttJsonFsEntry, deleteExtra bool, stats *SyncStats) error {
+	info, err := os.Stat(localDir)
+	if err != nil {
+		return err
+	}
+
+	remoteEntries := make(map[string]MqttJsonFsEntry)
+	if remote == nil {
+		err = c.Mkdir(remoteDir, false, fmt.Sprintf("%o", info.Mode().Perm()))
+		if err != nil {
+			return err
+		}
+		stats.Dirs++
+		c.Printf("%s/\n", remoteDir)
+	} else if !remote.IsDir {
+		return errors.New(fmt.Sprintf("%s is not a dir", remoteDir))
+	} else {
+		entries, errList := c.List(remoteDir)
+		if errList != nil {
+			return errList
+		}
+		for _, e := range entries {
+			remoteEntries[e.Name] = e
+		}
+	}
+
+	localEntries, err := os.ReadDir(localDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range localEntries {
+		localPath := filepath.Join(localDir, e.Name())
+		remotePath := path.Join(remoteDir, e.Name())
+		var remoteEntry *MqttJsonFsEntry
+		if r, exist := remoteEntries[e.Name()]; exist {
+			remoteEntry = &r
+			delete(remoteEntries, e.Name())
+		}
+
+		errEntry := c.syncEntry(localPath, remotePath, e, remoteEntry, deleteExtra, stats)
+		if errEntry != nil {
+			stats.Failed++
+			c.Printf("%s: %s\n", remotePath, errEntry.Error())
+		}
+	}
+
+	if deleteExtra {
+		for name := range remoteEntries {
+			remotePath := path.Join(remoteDir, name)
+			errRemove := c.Remove(remotePath, true)
+			if errRemove != nil {
+				stats.Failed++
+				c.Printf("%s: %s\n", remotePath, errRemove.Error())
+				continue
+			}
+			stats.Deleted++
+			c.Printf("deleted %s\n", remotePath)
+		}
+	}
+	return nil
+}
+
+func (c *MqttClientCp) syncEntry(localPath string, remotePath string, e os.DirEntry, remote *MqttJsonFsEntry, deleteExtra bool, stats *SyncStats) error {
+	info, err := e.Info()
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		c.Printf("%s: skipped, not a regular file\n", localPath)
+		return nil
+	}
+
+	// a remote entry of another kind is replaced only in mirror mode
+	if remote != nil && (remote.IsLink || remote.IsDir != info.IsDir()) {
+		if !deleteExtra {
+			return errors.New("remote entry of a different type, use delete to replace it")
+		}
+		err = c.Remove(remotePath, true)
+		if err != nil {
+			return err
+		}
+		stats.Deleted++
+		remote = nil
+	}
+
+	if info.IsDir() {
+		return c.syncDir(localPath, remotePath, remote, deleteExtra, stats)
+	}
+	return c.syncFile(localPath, remotePath, info, remote, stats)
+}
+
+func (c *MqttClientCp) syncFile(localFile string, remotePath string, info os.FileInfo, remote *MqttJsonFsEntry, stats *SyncStats) error {
+	if remote != nil && remote.IsDir {
+		return errors.New(fmt.Sprintf("%s is a dir", remotePath))
+	}
+	if remote != nil && !c.checksum && remote.Size == info.Size() && remote.ModTime/int64(time.Second) == info.ModTime().Unix() {
+		stats.Skipped++
+		return nil
+	}
+
+	size, targetHash, err := takeFileInfo(localFile, c.hashAlgo)
+	if err != nil {
+		return err
+	}
+
+	blockSize := c.blockSize
+	var sigs []blockSig
+	var baseHash string
+	var baseSize int64
+	if remote != nil {
+		if blockSize == 0 {
+			blockSize = DeltaBlockSize(remote.Size)
+		}
+		res, errSig := c.request(MqttJsonCpRequest{Cmd: MqttCpCommand_Signature, ServerPath: remotePath,
+			BlockSize: blockSize, HashAlgo: c.hashAlgo}, defaultSignatureTimeout)
+		if errSig != nil {
+			return errSig
+		}
+		if res.Request.Hash == targetHash && res.Request.Size == size {
+			// same content, only the attributes can differ
+			stats.Skipped++
+			return c.SetAttr(remotePath, fmt.Sprintf("%o", info.Mode().Perm()), info.ModTime())
+		}
+		sigs, err = unpackSignature(res.Blocks)
+		if err != nil {
+			return err
+		}
+		baseHash, baseSize = res.Request.Hash, res.Request.Size
+	} else if blockSize == 0 {
+		blockSize = DeltaBlockSize(size)
+	}
+
+	deltaFile, err := os.CreateTemp("", "mqtt-delta-")
+	if err != nil {
+		return err
+	}
+	deltaName := deltaFile.Name()
+	defer os.Remove(deltaName)
+
+	literal, matched, err := c.writeDelta(localFile, deltaFile, sigs, blockSize, baseSize)
+	errClose := deltaFile.Close()
+	if err != nil {
+		return err
+	} else if errClose != nil {
+		return errClose
+	}
+
+	deltaSize, deltaHash, err := takeFileInfo(deltaName, c.hashAlgo)
+	if err != nil {
+		return err
+	}
+	signature, err := c.fileSignature(targetHash)
+	if err != nil {
+		return errors.New(fmt.Sprintf("error in signature: %s", err.Error()))
+	}
+
+	msg, err := c.newUploadRequest(localFile, remotePath, deltaSize, deltaHash, signature)
+	if err != nil {
+		return err
+	}
+	msg.Request.Cmd = MqttCpCommand_Delta
+	msg.Request.BlockSize = blockSize
+	msg.Request.BaseHash = baseHash
+	msg.Request.TargetSize = size
+	msg.Request.TargetHash = targetHash
+
+	c.expectReplies(msg.UUID)
+	defer c.forgetReplies(msg.UUID)
+	uuid, transmissionTopic, err := c.local2RemoteHandshake(msg)
+	if err != nil {
+		return errors.New(fmt.Sprintf("error in handshake: %s", err.Error()))
+	}
+	cancel := c.registerTransfer(uuid)
+	defer c.unregisterTransfer(uuid)
+	err = c.mftTransmitFile(deltaName, transmissionTopic, nil, cancel)
+	if err != nil {
+		return errors.New(fmt.Sprintf("error in data transfer: %s", err.Error()))
+	}
+	// the server rebuilds and hashes the whole file before answering
+	_, err = c.verifyTransmission(uuid, defaultSignatureTimeout)
+	if err != nil {
+		return err
+	}
+
+	stats.Files++
+	stats.Literal += literal
+	stats.Matched += matched
+	c.Printf("%s: %d bytes sent, %d reused\n", remotePath, literal, matched)
+	return nil
+}
+
+func (c *MqttClientCp) writeDelta(localFile string, out *os.File, sigs []blockSig, blockSize int, baseSize int64) (int64, int64, error) {
+	src, err := os.Open(localFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer src.Close()
+
+	writer := bufio.NewWriter(out)
+	literal, matched, err := computeDelta(src, sigs, blockSize, baseSize, writer)
+	if err != nil {
+		return 0, 0, err
+	}
+	return literal, matched, writer.Flush()
+}
@@ -0,0 +1,231 @@
+package mqttcp
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp/mft"
+	log "github.com/sirupsen/logrus"
+)
+
+var errTransferCanceled = errors.New("transfer canceled")
+
+// MqttJsonTransfer describes a transfer in progress on the server.
+type MqttJsonTransfer struct {
+	UUID       string `json:"uuid"`
+	ClientUUID string `json:"clientuuid"`
+	Cmd        string `json:"cmd"`
+	Path       string `json:"path"`
+	// -1 for streams, whose size is known only at the end
+	Size  int64 `json:"size"`
+	Done  int64 `json:"done"`
+	Start int64 `json:"start"`
+}
+
+// Elapsed is the time since the transfer started.
+func (t MqttJsonTransfer) Elapsed() time.Duration {
+	return time.Since(time.UnixMilli(t.Start))
+}
+
+// Rate is the average speed in bytes per second.
+func (t MqttJsonTransfer) Rate() float64 {
+	elapsed := t.Elapsed().Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(t.Done) / elapsed
+}
+
+// Percent is the progress of the transfer, -1 when the size is unknown.
+func (t MqttJsonTransfer) Percent() float64 {
+	if t.Size < 0 {
+		return -1
+	} else if t.Size == 0 {
+		return 100
+	}
+	return float64(t.Done) / float64(t.Size) * 100
+}
+
+// ETA is the estimated time left, -1 when it can not be estimated.
+func (t MqttJsonTransfer) ETA() time.Duration {
+	rate := t.Rate()
+	if t.Size < 0 || rate <= 0 {
+		return -1
+	}
+	return time.Duration(float64(t.Size-t.Done)/rate) * time.Second
+}
+
+func (c *ClientCpConnection) abort() {
+	c.cancelOnce.Do(func() {
+		close(c.cancel)
+	})
+}
+
+func (c *ClientCpConnection) setFramesDone(frames uint32) {
+	atomic.StoreUint32(&c.framesDone, frames)
+}
+
+// trackProgress follows the progress of the transfer until the connection is unregistered.
+func (c *ClientCpConnection) trackProgress() {
+	for p := range c.progress {
+		c.setFramesDone(p.FrameReceived)
+	}
+}
+
+func (c *ClientCpConnection) info() MqttJsonTransfer {
+	size := c.size
+	if isStreamCommand(string(c.connectionType)) {
+		size = -1
+	}
+	done := int64(atomic.LoadUint32(&c.framesDone)) * int64(mft.MFT_PAYLOAD_SIZE())
+	if size >= 0 && done > size {
+		done = size
+	}
+	return MqttJsonTransfer{
+		UUID:       c.transferUUID,
+		ClientUUID: c.clientUUID,
+		Cmd:        string(c.connectionType),
+		Path:       c.serverPath,
+		Size:       size,
+		Done:       done,
+		Start:      c.start.UnixMilli(),
+	}
+}
+
+// Transfers returns the transfers in progress, oldest first.
+func (s *MqttServerCp) Transfers() []MqttJsonTransfer {
+	s.mutex.Lock()
+	list := make([]MqttJsonTransfer, 0, len(s.connections))
+	for _, conn := range s.connections {
+		list = append(list, conn.info())
+	}
+	s.mutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Start < list[j].Start })
+	return list
+}
+
+// CancelTransfer aborts a transfer, its temp file is removed and its client notified.
+func (s *MqttServerCp) CancelTransfer(transferUUID string) error {
+	return s.cancelClientTransfer("", transferUUID)
+}
+
+// cancelClientTransfer aborts a transfer of clientUUID, of any client if empty.
+func (s *MqttServerCp) cancelClientTransfer(clientUUID string, transferUUID string) error {
+	var found *ClientCpConnection
+	s.mutex.Lock()
+	for _, conn := range s.connections {
+		if conn.transferUUID == transferUUID && (clientUUID == "" || conn.clientUUID == clientUUID) {
+			found = conn
+			break
+		}
+	}
+	s.mutex.Unlock()
+	if found == nil {
+		return errors.New(fmt.Sprintf("transfer %s not found", transferUUID))
+	}
+
+	log.Infof("canceling transfer %s of %s", transferUUID, found.clientUUID)
+	found.abort()
+	msg := MqttJsonCp{ClientUUID: found.clientUUID, UUID: transferUUID, Step: MqttCpStep_Cancel}
+	return s.Transmit(msg)
+}
+
+// clientTransfers returns the transfers in progress of clientUUID, oldest first.
+func (s *MqttServerCp) clientTransfers(clientUUID string) []MqttJsonTransfer {
+	list := []MqttJsonTransfer{}
+	for _, t := range s.Transfers() {
+		if t.ClientUUID == clientUUID {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+func (s *MqttServerCp) handleTransfersRequest(data MqttJsonCp) {
+	// a client reaches the transfers of the others only if the server allows it
+	owner := data.ClientUUID
+	if s.getAllowOtherTransfers() {
+		owner = ""
+	}
+	data.Step = MqttCpStep_Result
+	if data.Request.Cmd == MqttCpCommand_Cancel {
+		err := s.cancelClientTransfer(owner, data.Request.TransferUUID)
+		if err != nil {
+			data.Error = err.Error()
+		}
+	} else if owner == "" {
+		data.Transfers = s.Transfers()
+	} else {
+		data.Transfers = s.clientTransfers(owner)
+	}
+	errT := s.Transmit(data)
+	if errT != nil {
+		log.Error(errT.Error())
+	}
+}
+
+func (c *MqttClientCp) registerTransfer(uuid string) chan bool {
+	cancel := make(chan bool)
+	c.transfersMutex.Lock()
+	c.transfers[uuid] = cancel
+	c.transfersMutex.Unlock()
+	return cancel
+}
+
+func (c *MqttClientCp) unregisterTransfer(uuid string) {
+	c.transfersMutex.Lock()
+	delete(c.transfers, uuid)
+	c.transfersMutex.Unlock()
+}
+
+// abortTransfer stops a running transfer of this client, if any.
+func (c *MqttClientCp) abortTransfer(uuid string) bool {
+	c.transfersMutex.Lock()
+	defer c.transfersMutex.Unlock()
+	cancel, exist := c.transfers[uuid]
+	if exist {
+		close(cancel)
+		delete(c.transfers, uuid)
+	}
+	return exist
+}
+
+// Transfers lists the transfers in progress on the server, only the ones of this client
+// unless the server shows all of them.
+func (c *MqttClientCp) Transfers() ([]MqttJsonTransfer, error) {
+	res, err := c.request(MqttJsonCpRequest{Cmd: MqttCpCommand_Transfers}, defaultFsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return res.Transfers, nil
+}
+
+// Cancel aborts a transfer on the server, of this client unless the server lets clients
+// cancel the transfers of the others.
+func (c *MqttClientCp) Cancel(transferUUID string) error {
+	_, err := c.request(MqttJsonCpRequest{Cmd: MqttCpCommand_Cancel, TransferUUID: transferUUID}, defaultFsTimeout)
+	// the server already notified the owner, unless it could not be reached
+	c.abortTransfer(transferUUID)
+	return err
+}
+
+// CancelAll aborts the running transfers of this client on both sides,
+// meant to be called while another goroutine is inside a transfer.
+func (c *MqttClientCp) CancelAll() {
+	c.transfersMutex.Lock()
+	uuids := make([]string, 0, len(c.transfers))
+	for uuid := range c.transfers {
+		uuids = append(uuids, uuid)
+	}
+	c.transfersMutex.Unlock()
+
+	for _, uuid := range uuids {
+		err := c.Cancel(uuid)
+		if err != nil {
+			log.Errorf("cancel %s: %s", uuid, err.Error())
+		}
+	}
+}
@@ -2,16 +2,35 @@ package mqttcp
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"hash"
 	"io"
 	"os"
 	"path"
 )
 
-func calculateMD5(fileName string) ([]byte, error) {
+func newHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case MqttCpHash_SHA256:
+		return sha256.New(), nil
+	case MqttCpHash_MD5:
+		return md5.New(), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("hash algorithm %s not supported", algo))
+	}
+}
+
+func calculateHash(fileName string, algo string) ([]byte, error) {
+	hash, errHash := newHash(algo)
+	if errHash != nil {
+		return nil, errHash
+	}
+
 	file, err := os.Open(fileName)
 	if err != nil {
 		return nil, err
@@ -19,7 +38,6 @@ func calculateMD5(fileName string) ([]byte, error) {
 
 	defer file.Close()
 
-	hash := md5.New()
 	_, err = io.Copy(hash, file)
 	if err != nil {
 		return nil, err
@@ -28,7 +46,7 @@ func calculateMD5(fileName string) ([]byte, error) {
 	return hash.Sum(nil), nil
 }
 
-func takeFileInfo(fileName string) (int64, string, error) {
+func takeFileInfo(fileName string, algo string) (int64, string, error) {
 	info, err := os.Stat(fileName)
 	if os.IsNotExist(err) || info.IsDir() {
 		return 0, "", errors.New(fmt.Sprintf("%s : not found", fileName))
@@ -38,12 +56,37 @@ func takeFileInfo(fileName string) (int64, string, error) {
 
 	size := info.Size()
 
-	md5Value, errMd5 := calculateMD5(fileName)
-	if errMd5 != nil {
-		return 0, "", errMd5
+	hashValue, errHash := calculateHash(fileName, algo)
+	if errHash != nil {
+		return 0, "", errHash
+	}
+
+	return size, fmt.Sprintf("%x", hashValue), nil
+}
+
+// checkFileIntegrity compares size and hash of fileName with the expected ones
+// and returns the raw digest, needed to verify the file signature.
+func checkFileIntegrity(fileName string, algo string, hashExpected string, sizeExpected int64) ([]byte, error) {
+	size, hashValue, errInfo := takeFileInfo(fileName, algo)
+	if errInfo != nil {
+		return nil, errInfo
+	} else if size != sizeExpected {
+		return nil, errors.New(fmt.Sprintf("fail check actual size %d, expected: %d", size, sizeExpected))
+	} else if hashValue != hashExpected {
+		return nil, errors.New(fmt.Sprintf("fail check actual %s %s, expected: %s", algo, hashValue, hashExpected))
 	}
+	return hex.DecodeString(hashValue)
+}
 
-	return size, fmt.Sprintf("%x", md5Value), nil
+// normalizeHashRequest maps requests of legacy clients, which only know the md5 field,
+// on the negotiated hash fields.
+func normalizeHashRequest(req *MqttJsonCpRequest) {
+	if req.HashAlgo == "" {
+		req.HashAlgo = MqttCpHash_MD5
+		if req.Hash == "" {
+			req.Hash = req.MD5
+		}
+	}
 }
 
 func fileDestinationPathCheck(local, remote string) (string, error) {
@@ -67,11 +110,6 @@ func fileDestinationPathCheck(local, remote string) (string, error) {
 		}
 	}
 
-	_, errF := os.Stat(newLocal)
-	if errF == nil {
-		return newLocal, errors.New(fmt.Sprintf("%s already exist", newLocal))
-	}
-
 	return newLocal, nil
 }
 
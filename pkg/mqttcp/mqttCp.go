@@ -10,7 +10,6 @@ import (
 	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp/mft"
 	"io"
 	"os"
-	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -20,6 +19,40 @@ import (
 
 type OnDataCallback func(data MqttJsonCp)
 
+// ErrRemoteNotExist matches with errors.Is the errors of the server about a missing path.
+var ErrRemoteNotExist = errors.New("not found")
+
+// remoteError is the error replied by the server.
+type remoteError struct {
+	msg      string
+	notExist bool
+}
+
+func (e *remoteError) Error() string {
+	return e.msg
+}
+
+func (e *remoteError) Is(target error) bool {
+	return e.notExist && target == ErrRemoteNotExist
+}
+
+func replyError(res MqttJsonCp) error {
+	return &remoteError{msg: res.Error, notExist: res.NotExist}
+}
+
+// queueFrames returns the handler of the data frames of a transfer. It never blocks, the mqtt
+// connection may be shared with a chat: a receiver too slow to keep up loses frames and its
+// transfer fails instead.
+func queueFrames(inChan chan []byte) MQTT.MessageHandler {
+	return func(client MQTT.Client, msg MQTT.Message) {
+		select {
+		case inChan <- msg.Payload():
+		default:
+			log.Warn("receiver too slow, frame dropped")
+		}
+	}
+}
+
 type MqttCp struct {
 	worker           *mqtt.Worker
 	Cb               OnDataCallback
@@ -29,6 +62,8 @@ type MqttCp struct {
 	startTime        time.Time
 	isRunning        bool
 	handshakeTimeout time.Duration
+	// topic of the file data, see WithOptionTransferTopic
+	transferTopic string
 }
 
 func (m *MqttCp) SetDataCallback(cb OnDataCallback) {
@@ -64,6 +99,10 @@ func (m *MqttCp) Transmit(msg MqttJsonCp) error {
 }
 
 func (m *MqttCp) transmit(msg MqttJsonCp) error {
+	return m.transmitTo(m.txTopic, msg)
+}
+
+func (m *MqttCp) transmitTo(topic string, msg MqttJsonCp) error {
 
 	b, err := json.Marshal(msg)
 	if err != nil {
@@ -71,7 +110,7 @@ func (m *MqttCp) transmit(msg MqttJsonCp) error {
 	}
 
 	encodedString := base64.StdEncoding.EncodeToString(b)
-	m.worker.Publish(m.txTopic, encodedString)
+	m.worker.Publish(topic, encodedString)
 	return nil
 }
 
@@ -97,10 +136,23 @@ func WithOptionMqttWorker(worker *mqtt.Worker) MqttCpOption {
 	}
 }
 
+// WithOptionTransferTopic sets the topic of the file data, a fmt template taking the client
+// and the transfer uuid (MqttCpMftTopic by default). Client and server must use the same one.
+func WithOptionTransferTopic(template string) MqttCpOption {
+	return func(h *MqttCp) {
+		h.transferTopic = template
+	}
+}
+
+func (m *MqttCp) mftTopic(clientUUID, transferUUID string) string {
+	return fmt.Sprintf(m.transferTopic, clientUUID, transferUUID)
+}
+
 func NewCp(mqttOpts *MQTT.ClientOptions, rxTopic string, txtopic string, opts ...MqttCpOption) *MqttCp {
 
 	w := mqtt.NewWorker(mqttOpts, true, nil)
-	m := MqttCp{worker: w, rxTopic: rxTopic, txTopic: txtopic, isRunning: false, handshakeTimeout: defaultHandshakeTimeout}
+	m := MqttCp{worker: w, rxTopic: rxTopic, txTopic: txtopic, isRunning: false, handshakeTimeout: defaultHandshakeTimeout,
+		transferTopic: MqttCpMftTopic}
 
 	for _, opt := range opts {
 		// Call the option giving the instantiated
@@ -145,7 +197,7 @@ func (m *MqttCp) Stop() {
 	m.worker.StopMQTT()
 }
 
-func (m *MqttCp) mftReceiveFile(f *os.File, inboundChan chan []byte, progress *chan mft.MftProgress) error {
+func (m *MqttCp) mftReceiveFile(f *os.File, inboundChan chan []byte, progress *chan mft.MftProgress, cancel <-chan bool) error {
 	writer := bufio.NewWriter(f)
 	ready := false
 	lastFrameTs := time.Now()
@@ -222,30 +274,25 @@ func (m *MqttCp) mftReceiveFile(f *os.File, inboundChan chan []byte, progress *c
 			if time.Since(lastFrameTs) > timeoutMftTransfer {
 				return errors.New("timeout on reception")
 			}
+		case <-cancel:
+			return errTransferCanceled
 		}
 	}
 }
 
-func (m *MqttCp) receiveFileAndCheck(f *os.File, inChan chan []byte, md5Expected string, sizeExpected int64, progress *chan mft.MftProgress) error {
+// receiveFileAndCheck receives the file and verifies size and hash, returning the raw digest.
+// The caller is in charge of moving the file into place.
+func (m *MqttCp) receiveFileAndCheck(f *os.File, inChan chan []byte, expected MqttJsonCpRequest, progress *chan mft.MftProgress, cancel <-chan bool) ([]byte, error) {
 	fName := f.Name()
-	errReception := m.mftReceiveFile(f, inChan, progress)
+	errReception := m.mftReceiveFile(f, inChan, progress, cancel)
 	f.Close()
 	if errReception != nil {
-		return errReception
+		return nil, errReception
 	}
-	size, md5, errInfo := takeFileInfo(fName)
-	if errInfo != nil {
-		return errInfo
-	} else if size != sizeExpected {
-		return errors.New(fmt.Sprintf("fail check actual size %d, expected: %d", size, sizeExpected))
-	} else if md5 != md5Expected {
-		return errors.New(fmt.Sprintf("fail check actual md5 %s, expected: %s", md5, md5Expected))
-	}
-	realName := strings.TrimSuffix(f.Name(), ".tmp")
-	return os.Rename(fName, realName)
+	return checkFileIntegrity(fName, expected.HashAlgo, expected.Hash, expected.Size)
 }
 
-func (m *MqttCp) mftTransmitFile(fileName, transmissionTopic string, progress *chan mft.MftProgress) error {
+func (m *MqttCp) mftTransmitFile(fileName, transmissionTopic string, progress *chan mft.MftProgress, cancel <-chan bool) error {
 	f, errOpen := os.Open(fileName)
 	if errOpen != nil {
 		return errOpen
@@ -266,6 +313,11 @@ func (m *MqttCp) mftTransmitFile(fileName, transmissionTopic string, progress *c
 	m.mftTransmitStart(uint16(numFrames), transmissionTopic)
 
 	for frameIdx := 0; frameIdx < numFrames; frameIdx++ {
+		select {
+		case <-cancel:
+			return errTransferCanceled
+		default:
+		}
 		offset := int64(frameIdx) * int64(mftSize)
 		_, errSeek := f.Seek(offset, io.SeekStart)
 		if errSeek != nil {
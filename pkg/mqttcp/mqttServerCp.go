@@ -1,13 +1,14 @@
 package mqttcp
 
 import (
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp/mft"
 	log "github.com/sirupsen/logrus"
 	"os"
 	"path"
-	"strings"
 	"sync"
 	"time"
 )
@@ -15,28 +16,47 @@ import (
 type MqttServerCp struct {
 	*MqttCp
 	mutex             sync.Mutex
-	connections       map[string]ClientCpConnection
+	connections       map[string]*ClientCpConnection
 	maxConnections    int
 	timeoutConnection time.Duration
+	// settings which can change while running, see the setters
+	settingsMutex sync.RWMutex
+	allowMd5      bool
+	publisherKey  ed25519.PublicKey
+	jail          *PathJail
+	allowSetOwner bool
+	// clients can list and cancel the transfers of the other clients
+	allowOtherTransfers bool
 }
 
 type ClientCpConnection struct {
 	transferUUID   string
+	clientUUID     string
 	connectionType MqttCpCommand
+	serverPath     string
+	size           int64
 	msgChan        chan MqttJsonCp
 	start          time.Time
+	// closed to abort the transfer
+	cancel     chan bool
+	cancelOnce sync.Once
+	progress   chan mft.MftProgress
+	framesDone uint32
 }
 
 func (c *ClientCpConnection) awaitResponse(step MqttCpStep, timeout time.Duration) (MqttJsonCp, error) {
-	ticker := time.NewTicker(timeout)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 	for {
 		select {
 		case msg := <-c.msgChan:
 			if msg.UUID == c.transferUUID && msg.Step == string(step) {
 				return msg, nil
 			}
-		case <-ticker.C:
+		case <-timer.C:
 			return MqttJsonCp{}, errors.New("timeout")
+		case <-c.cancel:
+			return MqttJsonCp{}, errTransferCanceled
 		}
 	}
 }
@@ -46,7 +66,7 @@ func NewMqttServerCp(mqttOpts *MQTT.ClientOptions, rxTopic string, txTopic strin
 	serverCp := MqttServerCp{
 		maxConnections:    defaultServerMaxConnections,
 		timeoutConnection: defaultServerTimeoutConnection,
-		connections:       make(map[string]ClientCpConnection),
+		connections:       make(map[string]*ClientCpConnection),
 	}
 	cp := NewCp(mqttOpts, rxTopic, txTopic, opts...)
 	cp.SetDataCallback(serverCp.OnDataRx)
@@ -56,6 +76,72 @@ func NewMqttServerCp(mqttOpts *MQTT.ClientOptions, rxTopic string, txTopic strin
 	return &serverCp
 }
 
+// SetAllowMd5 accepts transfers of legacy clients still verified with md5.
+func (s *MqttServerCp) SetAllowMd5(allow bool) {
+	s.settingsMutex.Lock()
+	defer s.settingsMutex.Unlock()
+	s.allowMd5 = allow
+}
+
+// SetPublisherKey requires every uploaded file to carry a valid signature of the given key.
+func (s *MqttServerCp) SetPublisherKey(key ed25519.PublicKey) {
+	s.settingsMutex.Lock()
+	defer s.settingsMutex.Unlock()
+	s.publisherKey = key
+}
+
+// SetPathJail restricts the paths clients can read and write; nil means unrestricted.
+func (s *MqttServerCp) SetPathJail(jail *PathJail) {
+	s.settingsMutex.Lock()
+	defer s.settingsMutex.Unlock()
+	s.jail = jail
+}
+
+// SetAllowSetOwner lets clients choose the owner of the files they upload.
+func (s *MqttServerCp) SetAllowSetOwner(allow bool) {
+	s.settingsMutex.Lock()
+	defer s.settingsMutex.Unlock()
+	s.allowSetOwner = allow
+}
+
+func (s *MqttServerCp) getAllowMd5() bool {
+	s.settingsMutex.RLock()
+	defer s.settingsMutex.RUnlock()
+	return s.allowMd5
+}
+
+func (s *MqttServerCp) getPublisherKey() ed25519.PublicKey {
+	s.settingsMutex.RLock()
+	defer s.settingsMutex.RUnlock()
+	return s.publisherKey
+}
+
+func (s *MqttServerCp) getPathJail() *PathJail {
+	s.settingsMutex.RLock()
+	defer s.settingsMutex.RUnlock()
+	return s.jail
+}
+
+// SetAllowOtherTransfers lets clients list and cancel the transfers of the other clients,
+// otherwise each client sees only its own.
+func (s *MqttServerCp) SetAllowOtherTransfers(allow bool) {
+	s.settingsMutex.Lock()
+	defer s.settingsMutex.Unlock()
+	s.allowOtherTransfers = allow
+}
+
+func (s *MqttServerCp) getAllowOtherTransfers() bool {
+	s.settingsMutex.RLock()
+	defer s.settingsMutex.RUnlock()
+	return s.allowOtherTransfers
+}
+
+func (s *MqttServerCp) getAllowSetOwner() bool {
+	s.settingsMutex.RLock()
+	defer s.settingsMutex.RUnlock()
+	return s.allowSetOwner
+}
+
 func (s *MqttServerCp) closeOldConnections() {
 	ticker := time.NewTicker(defaultServerCheckConnectionInterval)
 	for {
@@ -64,6 +150,7 @@ func (s *MqttServerCp) closeOldConnections() {
 			s.mutex.Lock()
 			for k, e := range s.connections {
 				if time.Now().Sub(e.start) >= s.timeoutConnection {
+					e.abort()
 					delete(s.connections, k)
 				}
 			}
@@ -97,6 +184,11 @@ func (s *MqttServerCp) IsBusy() bool {
 	return len(s.connections) >= s.maxConnections
 }
 
+// isNotExist tells if err is about a missing path, the client gets it as ErrRemoteNotExist.
+func isNotExist(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, ErrRemoteNotExist)
+}
+
 func (s *MqttServerCp) failHandshake(msg MqttJsonCp, fail string) {
 	msg.Step = MqttCpStep_Handshake2
 	msg.Error = fail
@@ -129,20 +221,33 @@ func (s *MqttServerCp) failEnd(msg MqttJsonCp, fail string) {
 }
 
 func (s *MqttServerCp) handleNewHandshake(data MqttJsonCp) {
+	if isFsCommand(data.Request.Cmd) {
+		go s.handleFsRequest(data)
+		return
+	} else if data.Request.Cmd == MqttCpCommand_Signature {
+		go s.handleSignatureRequest(data)
+		return
+	} else if data.Request.Cmd == MqttCpCommand_Transfers || data.Request.Cmd == MqttCpCommand_Cancel {
+		go s.handleTransfersRequest(data)
+		return
+	}
 	log.Info("new handshake request")
 	if s.IsBusy() {
 		s.failHandshake(data, "server busy, try again")
 	} else {
 		err := s.validateHandshakeMsg(&data)
 		if err != nil {
+			data.NotExist = isNotExist(err)
 			s.failHandshake(data, err.Error())
 		} else {
 			c := s.registerTransfer(data)
 			switch data.Request.Cmd {
-			case MqttCpCommand_CopyLocalToRemote:
+			case MqttCpCommand_CopyLocalToRemote, MqttCpCommand_Delta, MqttCpCommand_StreamLocalToRemote:
 				go s.runClientToServerTransfer(&data, c)
-			case MqttCpCommand_CopyRemoteToLocal:
+			case MqttCpCommand_CopyRemoteToLocal, MqttCpCommand_StreamRemoteToLocal:
 				go s.runServerToClientTransfer(&data, c)
+			case MqttCpCommand_Multicast:
+				go s.runMulticastTransfer(&data, c)
 			default:
 				log.Error("unhandled mqtt cp command")
 			}
@@ -150,11 +255,11 @@ func (s *MqttServerCp) handleNewHandshake(data MqttJsonCp) {
 	}
 }
 
-func (s *MqttServerCp) runServerToClientTransfer(msg *MqttJsonCp, conn ClientCpConnection) {
-	defer s.unregisterTransfer(msg.ClientUUID)
+func (s *MqttServerCp) runServerToClientTransfer(msg *MqttJsonCp, conn *ClientCpConnection) {
+	defer s.unregisterTransfer(conn)
 
 	msg.Step = MqttCpStep_Handshake2
-	msg.Topic = mftTopic(msg.ClientUUID, msg.UUID)
+	msg.Topic = s.mftTopic(msg.ClientUUID, msg.UUID)
 	err := s.Transmit(*msg)
 	if err != nil {
 		log.Error(err.Error())
@@ -170,20 +275,33 @@ func (s *MqttServerCp) runServerToClientTransfer(msg *MqttJsonCp, conn ClientCpC
 		return
 	}
 
-	errTrans := s.mftTransmitFile(msg.Request.ServerPath, msg.Topic, nil)
+	// path checked again, a link could have been swapped meanwhile
+	serverPath, errJail := s.getPathJail().CheckRead(msg.Request.ServerPath)
+	if errJail != nil {
+		log.Error(errJail.Error())
+		return
+	}
+
+	var errTrans error
+	size := msg.Request.Size
+	if msg.Request.Cmd == MqttCpCommand_StreamRemoteToLocal {
+		size, errTrans = s.transmitStream(serverPath, msg.Topic, msg.Request.HashAlgo, conn)
+	} else {
+		errTrans = s.mftTransmitFile(serverPath, msg.Topic, &conn.progress, conn.cancel)
+	}
 	if errTrans != nil {
 		log.Errorf("error in data transfer: %s", errTrans.Error())
 	} else {
-		log.Errorf("%d bytes sent", msg.Request.Size)
+		log.Errorf("%d bytes sent", size)
 	}
 
 }
 
-func (s *MqttServerCp) runClientToServerTransfer(msg *MqttJsonCp, conn ClientCpConnection) {
-	defer s.unregisterTransfer(msg.ClientUUID)
+func (s *MqttServerCp) runClientToServerTransfer(msg *MqttJsonCp, conn *ClientCpConnection) {
+	defer s.unregisterTransfer(conn)
 
 	msg.Step = MqttCpStep_Handshake2
-	msg.Topic = mftTopic(msg.ClientUUID, msg.UUID)
+	msg.Topic = s.mftTopic(msg.ClientUUID, msg.UUID)
 	err := s.Transmit(*msg)
 	if err != nil {
 		log.Error(err.Error())
@@ -192,12 +310,7 @@ func (s *MqttServerCp) runClientToServerTransfer(msg *MqttJsonCp, conn ClientCpC
 
 	inChan := make(chan []byte, 10000)
 
-	onMftFrame := func(client MQTT.Client, msg MQTT.Message) {
-		mqttPayload := msg.Payload()
-		inChan <- mqttPayload
-	}
-
-	errSub := s.worker.Subscribe(msg.Topic, onMftFrame)
+	errSub := s.worker.Subscribe(msg.Topic, queueFrames(inChan))
 	if errSub != nil {
 		log.Error(errSub.Error())
 		s.failStart(*msg, errSub.Error())
@@ -205,22 +318,24 @@ func (s *MqttServerCp) runClientToServerTransfer(msg *MqttJsonCp, conn ClientCpC
 	}
 	defer s.worker.Unsubscribe(msg.Topic)
 
-	tmpName := fmt.Sprintf("%s.tmp", msg.Request.ServerPath)
-	f, errCreation := os.Create(tmpName)
+	f, errCreation := createTempFile(msg.Request.ServerPath)
 	if errCreation != nil {
 		log.Error(errCreation.Error())
 		s.failStart(*msg, errCreation.Error())
 		return
 	}
+	tmpName := f.Name()
 
 	msg.Step = MqttCpStep_Start
 	errT := s.Transmit(*msg)
 	if errT != nil {
 		log.Error(errT.Error())
+		f.Close()
+		os.Remove(tmpName)
 		return
 	}
 
-	errTrans := s.handleFileTransferClient2Server(f, inChan, msg.Request.MD5, msg.Request.Size)
+	errTrans := s.handleFileTransferClient2Server(f, inChan, msg.Request, conn)
 	if errTrans != nil {
 		log.Error(errTrans.Error())
 		os.Remove(tmpName)
@@ -234,47 +349,96 @@ func (s *MqttServerCp) runClientToServerTransfer(msg *MqttJsonCp, conn ClientCpC
 	log.Info(finalMsg)
 	errTx := s.Transmit(*msg)
 	if errTx != nil {
-		log.Error(errT.Error())
+		log.Error(errTx.Error())
 	}
 
 }
 
-func (s *MqttServerCp) handleFileTransferClient2Server(f *os.File, inChan chan []byte, md5Expected string, sizeExpected int64) error {
+func (s *MqttServerCp) handleFileTransferClient2Server(f *os.File, inChan chan []byte, expected MqttJsonCpRequest, conn *ClientCpConnection) error {
 	fName := f.Name()
-	errReception := s.mftReceiveFile(f, inChan, nil)
+	if expected.Cmd == MqttCpCommand_StreamLocalToRemote {
+		digest, errStream := s.receiveStream(f, inChan, &expected, conn)
+		if errStream != nil {
+			return errStream
+		}
+		return s.commitReceivedFile(fName, digest, expected)
+	}
+	errReception := s.mftReceiveFile(f, inChan, &conn.progress, conn.cancel)
 	f.Close()
 	if errReception != nil {
 		return errReception
 	}
-	size, md5, errInfo := takeFileInfo(fName)
-	if errInfo != nil {
-		return errInfo
-	} else if size != sizeExpected {
-		return errors.New(fmt.Sprintf("fail check actual size %d, expected: %d", size, sizeExpected))
-	} else if md5 != md5Expected {
-		return errors.New(fmt.Sprintf("fail check actual md5 %d, expected: %d", md5, md5Expected))
+	digest, errCheck := checkFileIntegrity(fName, expected.HashAlgo, expected.Hash, expected.Size)
+	if errCheck != nil {
+		return errCheck
+	}
+	if expected.Cmd == MqttCpCommand_Delta {
+		target, targetDigest, errPatch := s.patchFile(fName, expected)
+		os.Remove(fName)
+		if errPatch != nil {
+			return errPatch
+		}
+		errCommit := s.commitReceivedFile(target, targetDigest, expected)
+		if errCommit != nil {
+			os.Remove(target)
+		}
+		return errCommit
+	}
+	return s.commitReceivedFile(fName, digest, expected)
+}
+
+// commitReceivedFile verifies the signature of a checked file and moves it into place.
+func (s *MqttServerCp) commitReceivedFile(fName string, digest []byte, expected MqttJsonCpRequest) error {
+	if s.getPublisherKey() != nil {
+		errSign := verifyDigest(s.getPublisherKey(), digest, expected.Signature)
+		if errSign != nil {
+			return errSign
+		}
+	}
+	// setting allowed at the handshake could have been disabled meanwhile
+	errOwner := s.validateOwner(expected)
+	if errOwner != nil {
+		return errOwner
+	}
+	errAttr := applyFileAttr(fName, expected)
+	if errAttr != nil {
+		return errAttr
 	}
-	realName := strings.TrimSuffix(f.Name(), ".tmp")
-	return os.Rename(fName, realName)
+	// destination checked again, a link could have been swapped meanwhile
+	dest, errJail := s.getPathJail().CheckWrite(expected.ServerPath)
+	if errJail != nil {
+		return errJail
+	}
+	return commitFile(fName, dest, expected.Overwrite, expected.BackupSuffix)
 }
 
-func (s *MqttServerCp) registerTransfer(data MqttJsonCp) ClientCpConnection {
-	newConnection := ClientCpConnection{
+func (s *MqttServerCp) registerTransfer(data MqttJsonCp) *ClientCpConnection {
+	newConnection := &ClientCpConnection{
 		transferUUID:   data.UUID,
+		clientUUID:     data.ClientUUID,
 		start:          time.Now(),
 		connectionType: MqttCpCommand(data.Request.Cmd),
+		serverPath:     data.Request.ServerPath,
+		size:           data.Request.Size,
 		msgChan:        make(chan MqttJsonCp, 5),
+		cancel:         make(chan bool),
+		progress:       make(chan mft.MftProgress, 10),
 	}
+	go newConnection.trackProgress()
 	s.mutex.Lock()
 	s.connections[data.ClientUUID] = newConnection
 	s.mutex.Unlock()
 	return newConnection
 }
 
-func (s *MqttServerCp) unregisterTransfer(clientUuid string) {
+func (s *MqttServerCp) unregisterTransfer(conn *ClientCpConnection) {
 	s.mutex.Lock()
-	delete(s.connections, clientUuid)
+	// the client may already have started a new transfer
+	if s.connections[conn.clientUUID] == conn {
+		delete(s.connections, conn.clientUUID)
+	}
 	s.mutex.Unlock()
+	close(conn.progress)
 }
 
 func (s *MqttServerCp) validateHandshakeMsg(data *MqttJsonCp) error {
@@ -289,40 +453,160 @@ func (s *MqttServerCp) validateHandshakeMsg(data *MqttJsonCp) error {
 		return errors.New("path must be absolute")
 	}
 
-	if data.Request.Cmd == MqttCpCommand_CopyLocalToRemote {
-		if data.Request.MD5 == "" {
-			return errors.New("missing transfer uuid")
-		} else if data.Request.Size == 0 {
-			return errors.New("missing size")
+	normalizeHashRequest(&data.Request)
+	errHash := s.validateHashAlgo(data.Request.HashAlgo)
+	if errHash != nil {
+		return errHash
+	}
+
+	if data.Request.Cmd == MqttCpCommand_StreamLocalToRemote {
+		// size, hash and signature come with the end frame
+		if s.getPublisherKey() != nil && data.Request.HashAlgo != MqttCpHash_SHA256 {
+			return errors.New("signed files require sha256")
+		}
+		return s.validateDestination(data)
+
+	} else if data.Request.Cmd == MqttCpCommand_CopyLocalToRemote || data.Request.Cmd == MqttCpCommand_Delta || data.Request.Cmd == MqttCpCommand_Multicast {
+		if data.Request.Cmd == MqttCpCommand_Multicast && data.Topic != s.mftTopic(data.ClientUUID, data.UUID) {
+			// the topic is shared by every server of the transfer, so it is chosen by the client
+			return errors.New("multicast topic not valid")
+		} else if data.Request.Cmd == MqttCpCommand_Delta {
+			if data.Request.TargetHash == "" {
+				return errors.New("missing target hash")
+			} else if data.Request.BlockSize < minBlockSize || data.Request.BlockSize > maxBlockSize {
+				return errors.New("block size not valid")
+			}
 		}
+		if data.Request.Hash == "" {
+			return errors.New("missing hash")
+		} else if data.Request.Size < 0 {
+			return errors.New("size not valid")
+		} else if tooManyFrames(data.Request.Size) {
+			return errors.New("file too big")
+		} else if s.getPublisherKey() != nil && data.Request.Signature == "" {
+			return errors.New("missing signature, server accepts only signed files")
+		} else if s.getPublisherKey() != nil && data.Request.HashAlgo != MqttCpHash_SHA256 {
+			return errors.New("signed files require sha256")
+		}
+
+		return s.validateDestination(data)
 
-		newServerPath, errCheck := fileDestinationPathCheck(data.Request.ServerPath, data.Request.ClientPath)
-		if errCheck != nil {
-			return errCheck
+	} else if data.Request.Cmd == MqttCpCommand_StreamRemoteToLocal {
+		resolvedPath, errJail := s.getPathJail().CheckRead(data.Request.ServerPath)
+		if errJail != nil {
+			return errJail
 		}
+		data.Request.ServerPath = resolvedPath
 
-		data.Request.ServerPath = newServerPath
+		info, err := os.Stat(data.Request.ServerPath)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s : %w", data.Request.ServerPath, ErrRemoteNotExist)
+		} else if err != nil {
+			return err
+		} else if info.IsDir() {
+			return errors.New(fmt.Sprintf("%s is a dir", data.Request.ServerPath))
+		}
 
 	} else if data.Request.Cmd == MqttCpCommand_CopyRemoteToLocal {
+		resolvedPath, errJail := s.getPathJail().CheckRead(data.Request.ServerPath)
+		if errJail != nil {
+			return errJail
+		}
+		data.Request.ServerPath = resolvedPath
+
 		info, err := os.Stat(data.Request.ServerPath)
 		if os.IsNotExist(err) {
-			return errors.New(fmt.Sprintf("%s : not found", data.Request.ServerPath))
+			return fmt.Errorf("%s : %w", data.Request.ServerPath, ErrRemoteNotExist)
 		} else if err != nil {
 			return err
 		} else if info.IsDir() {
 			return errors.New(fmt.Sprintf("%s is a dir", data.Request.ServerPath))
 		}
 
-		size, md5Value, errInfo := takeFileInfo(data.Request.ServerPath)
+		size, hashValue, errInfo := takeFileInfo(data.Request.ServerPath, data.Request.HashAlgo)
 		if errInfo != nil {
 			return errInfo
 		}
 
-		data.Request.MD5 = md5Value
+		data.Request.Hash = hashValue
+		if data.Request.HashAlgo == MqttCpHash_MD5 {
+			data.Request.MD5 = hashValue
+		}
 		data.Request.Size = size
 
+		errAttr := fillFileAttr(data.Request.ServerPath, &data.Request)
+		if errAttr != nil {
+			return errAttr
+		}
+
 	} else {
 		return errors.New("command unrecognized")
 	}
 	return nil
 }
+
+// validateDestination checks the destination of an upload, resolving its path.
+func (s *MqttServerCp) validateDestination(data *MqttJsonCp) error {
+	newServerPath, errCheck := fileDestinationPathCheck(data.Request.ServerPath, data.Request.ClientPath)
+	if errCheck != nil {
+		return errCheck
+	} else if path.Base(newServerPath) == MqttCpStreamPath {
+		return errors.New("destination file name missing")
+	}
+
+	resolvedPath, errJail := s.getPathJail().CheckWrite(newServerPath)
+	if errJail != nil {
+		return errJail
+	}
+
+	errPolicy := validateOverwritePolicy(data.Request.Overwrite, data.Request.BackupSuffix)
+	if errPolicy != nil {
+		return errPolicy
+	}
+	errPolicy = checkOverwrite(resolvedPath, data.Request.Overwrite)
+	if errPolicy != nil {
+		return errPolicy
+	}
+
+	if data.Request.SetMode != "" {
+		_, errMode := parseFileMode(data.Request.SetMode)
+		if errMode != nil {
+			return errMode
+		}
+	}
+	errOwner := s.validateOwner(data.Request)
+	if errOwner != nil {
+		return errOwner
+	}
+
+	data.Request.ServerPath = resolvedPath
+	return nil
+}
+
+// validateOwner refuses an explicit or preserved owner unless the server allows it, any
+// uid/gid could be given otherwise.
+func (s *MqttServerCp) validateOwner(req MqttJsonCpRequest) error {
+	if req.SetOwner == "" && !req.PreserveOwner {
+		return nil
+	} else if !s.getAllowSetOwner() {
+		return errors.New("setting the owner not allowed by server")
+	} else if req.SetOwner == "" {
+		return nil
+	}
+	_, _, err := lookupOwner(req.SetOwner)
+	return err
+}
+
+func (s *MqttServerCp) validateHashAlgo(algo string) error {
+	switch algo {
+	case MqttCpHash_SHA256:
+		return nil
+	case MqttCpHash_MD5:
+		if s.getAllowMd5() {
+			return nil
+		}
+		return errors.New("md5 not accepted by server, use sha256")
+	default:
+		return errors.New(fmt.Sprintf("hash algorithm %s not supported", algo))
+	}
+}
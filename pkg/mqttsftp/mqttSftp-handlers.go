@@ -0,0 +1,272 @@
+package mqttsftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp"
+	"github.com/lithammer/shortuuid/v3"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultNewFileMode = 0644
+
+// remoteFs implements the sftp handlers on top of the copy client:
+// files are downloaded into a local temp file on open and uploaded back on close.
+type remoteFs struct {
+	server *MqttSftpServer
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(f []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(f, l[offset:])
+	if n < len(f) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// linkInfo is returned to Readlink, whose answer is the name of the info.
+type linkInfo struct {
+	os.FileInfo
+	target string
+}
+
+func (l linkInfo) Name() string { return l.target }
+
+// readFile is a downloaded copy, removed once the handle is closed.
+type readFile struct {
+	*os.File
+}
+
+func (f *readFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// writeFile collects the writes locally and uploads the file on close.
+type writeFile struct {
+	*os.File
+	fs         *remoteFs
+	remotePath string
+}
+
+func (f *writeFile) Close() error {
+	tmpName := f.Name()
+	defer os.Remove(tmpName)
+	errClose := f.File.Close()
+	if errClose != nil {
+		return errClose
+	}
+
+	f.fs.server.transferMutex.Lock()
+	defer f.fs.server.transferMutex.Unlock()
+	_, err := f.fs.server.cp.Upload(tmpName, f.remotePath, nil)
+	if err != nil {
+		log.Errorf("sftp upload %s: %s", f.remotePath, err.Error())
+		return remoteError(err)
+	}
+	log.Debugf("sftp uploaded %s", f.remotePath)
+	return nil
+}
+
+// remoteError maps the server errors on the sftp status codes clients understand.
+func remoteError(err error) error {
+	msg := err.Error()
+	switch {
+	case errors.Is(err, mqttcp.ErrRemoteNotExist):
+		return sftp.ErrSSHFxNoSuchFile
+	case strings.Contains(msg, "not allowed"), strings.Contains(msg, "permission denied"):
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	return err
+}
+
+func (fs *remoteFs) tempName() string {
+	return filepath.Join(fs.server.tmpDir, shortuuid.New())
+}
+
+func (fs *remoteFs) download(remotePath string) (*os.File, error) {
+	fs.server.transferMutex.Lock()
+	defer fs.server.transferMutex.Unlock()
+	localPath, err := fs.server.cp.Download(remotePath, fs.tempName(), nil)
+	if err != nil {
+		return nil, remoteError(err)
+	}
+	// the copy keeps the remote mode, which may be read only
+	if errChmod := os.Chmod(localPath, 0600); errChmod != nil {
+		os.Remove(localPath)
+		return nil, errChmod
+	}
+	return os.OpenFile(localPath, os.O_RDWR, 0)
+}
+
+func (fs *remoteFs) stat(remotePath string) (mqttcp.MqttJsonFsEntry, error) {
+	entry, err := fs.server.cp.Stat(remotePath)
+	if err != nil {
+		return entry, remoteError(err)
+	}
+	return entry, nil
+}
+
+// statFollow is stat following symlinks, as sftp Stat requires.
+func (fs *remoteFs) statFollow(remotePath string) (mqttcp.MqttJsonFsEntry, error) {
+	entry, err := fs.stat(remotePath)
+	for i := 0; err == nil && entry.IsLink; i++ {
+		if i > 8 {
+			return entry, errors.New(fmt.Sprintf("%s: too many links", remotePath))
+		}
+		target := entry.Link
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(entry.Path), target)
+		}
+		name := entry.Name
+		entry, err = fs.stat(target)
+		entry.Name = name
+	}
+	return entry, err
+}
+
+func (fs *remoteFs) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := fs.download(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return &readFile{File: f}, nil
+}
+
+func (fs *remoteFs) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	flags := r.Pflags()
+	mode := os.FileMode(defaultNewFileMode)
+
+	existing, errStat := fs.stat(r.Filepath)
+	if errStat == nil {
+		if flags.Excl {
+			return nil, os.ErrExist
+		} else if existing.IsDir {
+			return nil, errors.New(fmt.Sprintf("%s is a dir", r.Filepath))
+		}
+		mode = os.FileMode(existing.Mode).Perm()
+	} else if errStat != sftp.ErrSSHFxNoSuchFile {
+		return nil, errStat
+	} else if !flags.Creat {
+		return nil, errStat
+	}
+	if r.AttrFlags().Permissions {
+		mode = r.Attributes().FileMode().Perm()
+	}
+
+	var f *os.File
+	var err error
+	if errStat == nil && !flags.Trunc {
+		// partial writes and appends start from the remote content
+		f, err = fs.download(r.Filepath)
+	} else {
+		f, err = os.OpenFile(fs.tempName(), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if errChmod := f.Chmod(mode); errChmod != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, errChmod
+	}
+	return &writeFile{File: f, fs: fs, remotePath: r.Filepath}, nil
+}
+
+func (fs *remoteFs) Filecmd(r *sftp.Request) error {
+	cp := fs.server.cp
+
+	var err error
+	switch r.Method {
+	case "Setstat":
+		attrFlags := r.AttrFlags()
+		if attrFlags.Size || attrFlags.UidGid {
+			return sftp.ErrSSHFxOpUnsupported
+		}
+		mode := ""
+		var modTime time.Time
+		if attrFlags.Permissions {
+			mode = fmt.Sprintf("%o", r.Attributes().FileMode().Perm())
+		}
+		if attrFlags.Acmodtime {
+			modTime = time.Unix(int64(r.Attributes().Mtime), 0)
+		}
+		if mode == "" && modTime.IsZero() {
+			return nil
+		}
+		err = cp.SetAttr(r.Filepath, mode, modTime)
+	case "Rename":
+		err = cp.Rename(r.Filepath, r.Target, false)
+	case "Rmdir", "Remove":
+		err = cp.Remove(r.Filepath, false)
+	case "Mkdir":
+		err = cp.Mkdir(r.Filepath, false, "")
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	if err != nil {
+		return remoteError(err)
+	}
+	return nil
+}
+
+// PosixRename is the openssh extension, replacing the target if it exists.
+func (fs *remoteFs) PosixRename(r *sftp.Request) error {
+	err := fs.server.cp.Rename(r.Filepath, r.Target, true)
+	if err != nil {
+		return remoteError(err)
+	}
+	return nil
+}
+
+func (fs *remoteFs) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		entries, err := fs.server.cp.List(r.Filepath)
+		if err != nil {
+			return nil, remoteError(err)
+		}
+		infos := make(listerAt, 0, len(entries))
+		for _, e := range entries {
+			infos = append(infos, e.FileInfo())
+		}
+		return infos, nil
+	case "Stat":
+		entry, err := fs.statFollow(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{entry.FileInfo()}, nil
+	case "Readlink":
+		entry, err := fs.stat(r.Filepath)
+		if err != nil {
+			return nil, err
+		} else if !entry.IsLink {
+			return nil, errors.New(fmt.Sprintf("%s is not a link", r.Filepath))
+		}
+		return listerAt{linkInfo{FileInfo: entry.FileInfo(), target: entry.Link}}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs *remoteFs) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	entry, err := fs.stat(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{entry.FileInfo()}, nil
+}
@@ -0,0 +1,238 @@
+package mqttsftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultSftpUser = "mqtt-shell"
+const defaultStartDirectory = "/"
+
+// MqttSftpServer is a local SFTP server whose filesystem is the one of a remote
+// mqtt-shell node, reached through an MqttClientCp.
+type MqttSftpServer struct {
+	cp             *mqttcp.MqttClientCp
+	listenAddr     string
+	hostKey        ssh.Signer
+	user           string
+	password       string
+	startDirectory string
+	tmpDir         string
+	listener       net.Listener
+	// the copy server runs one transfer at a time for each client, the other
+	// requests go on meanwhile
+	transferMutex sync.Mutex
+}
+
+type MqttSftpServerOption func(*MqttSftpServer)
+
+// WithOptionHostKey sets the ssh host key, an ephemeral one is generated otherwise.
+func WithOptionHostKey(key ssh.Signer) MqttSftpServerOption {
+	return func(s *MqttSftpServer) {
+		s.hostKey = key
+	}
+}
+
+// WithOptionCredentials sets user and password, a random password is generated if empty.
+func WithOptionCredentials(user string, password string) MqttSftpServerOption {
+	return func(s *MqttSftpServer) {
+		s.user = user
+		s.password = password
+	}
+}
+
+// WithOptionStartDirectory sets the remote directory sessions start in.
+func WithOptionStartDirectory(dir string) MqttSftpServerOption {
+	return func(s *MqttSftpServer) {
+		s.startDirectory = dir
+	}
+}
+
+func NewMqttSftpServer(cp *mqttcp.MqttClientCp, listenAddr string, opts ...MqttSftpServerOption) (*MqttSftpServer, error) {
+	s := MqttSftpServer{cp: cp, listenAddr: listenAddr, user: defaultSftpUser, startDirectory: defaultStartDirectory}
+	for _, opt := range opts {
+		opt(&s)
+	}
+
+	if s.hostKey == nil {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		s.hostKey, err = ssh.NewSignerFromKey(priv)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.password == "" {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s.password = hex.EncodeToString(b)
+	}
+	return &s, nil
+}
+
+// LoadHostKey reads a PEM private key to be used as ssh host key.
+func LoadHostKey(fileName string) (ssh.Signer, error) {
+	raw, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(raw)
+}
+
+func (s *MqttSftpServer) GetUser() string {
+	return s.user
+}
+
+func (s *MqttSftpServer) GetPassword() string {
+	return s.password
+}
+
+func (s *MqttSftpServer) GetAddress() string {
+	if s.listener != nil {
+		return s.listener.Addr().String()
+	}
+	return s.listenAddr
+}
+
+// Listen opens the local port, Serve must be called to accept connections.
+func (s *MqttSftpServer) Listen() error {
+	tmpDir, err := os.MkdirTemp("", "mqtt-sftp-")
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", s.listenAddr)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	s.tmpDir = tmpDir
+	s.listener = listener
+	return nil
+}
+
+// Serve accepts connections until Close is called.
+func (s *MqttSftpServer) Serve() error {
+	if s.listener == nil {
+		return errors.New("server not listening")
+	}
+
+	sshConf := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			userOk := subtle.ConstantTimeCompare([]byte(c.User()), []byte(s.user)) == 1
+			passOk := subtle.ConstantTimeCompare(pass, []byte(s.password)) == 1
+			if userOk && passOk {
+				return nil, nil
+			}
+			return nil, errors.New(fmt.Sprintf("password rejected for %s", c.User()))
+		},
+	}
+	sshConf.AddHostKey(s.hostKey)
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handleConnection(conn, sshConf)
+	}
+}
+
+func (s *MqttSftpServer) ListenAndServe() error {
+	err := s.Listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+func (s *MqttSftpServer) Close() error {
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	if s.tmpDir != "" {
+		os.RemoveAll(s.tmpDir)
+	}
+	return err
+}
+
+func (s *MqttSftpServer) handleConnection(conn net.Conn, sshConf *ssh.ServerConfig) {
+	defer conn.Close()
+
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, sshConf)
+	if err != nil {
+		log.Debugf("sftp handshake from %s failed: %s", conn.RemoteAddr(), err.Error())
+		return
+	}
+	defer sshConn.Close()
+	log.Infof("sftp session from %s", sshConn.RemoteAddr())
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, errAccept := newChannel.Accept()
+		if errAccept != nil {
+			log.Error(errAccept.Error())
+			continue
+		}
+
+		go s.serveSession(channel, requests)
+	}
+}
+
+// serveSession serves sftp on the channel only once the sftp subsystem has been asked for
+// and accepted, shells, commands and any other request are refused.
+func (s *MqttSftpServer) serveSession(channel ssh.Channel, in <-chan *ssh.Request) {
+	serving := false
+	for req := range in {
+		ok := !serving && isSftpSubsystem(req)
+		req.Reply(ok, nil)
+		if ok {
+			serving = true
+			go s.serveChannel(channel)
+		}
+	}
+	if !serving {
+		channel.Close()
+	}
+}
+
+func isSftpSubsystem(req *ssh.Request) bool {
+	var subsystem struct{ Name string }
+	return req.Type == "subsystem" && ssh.Unmarshal(req.Payload, &subsystem) == nil && subsystem.Name == "sftp"
+}
+
+func (s *MqttSftpServer) serveChannel(channel ssh.Channel) {
+	defer channel.Close()
+	fs := &remoteFs{server: s}
+	handlers := sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs}
+	server := sftp.NewRequestServer(channel, handlers, sftp.WithStartDirectory(s.startDirectory))
+	err := server.Serve()
+	if err != nil && err != io.EOF {
+		log.Errorf("sftp: %s", err.Error())
+	}
+	server.Close()
+}
@@ -0,0 +1,249 @@
+package mqtttunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp/mft"
+	"github.com/lithammer/shortuuid/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// MqttClientTunnel opens connections from the server node, many at the same time,
+// and takes the ones of its reverse tunnels.
+type MqttClientTunnel struct {
+	*MqttTunnel
+	uuid string
+	// reverse tunnels, by listener uuid
+	remotes      map[string]*remoteForward
+	remotesMutex sync.Mutex
+	renewOnce    sync.Once
+}
+
+type remoteForward struct {
+	listen string
+	target string
+}
+
+func NewMqttClientTunnel(mqttOpts *MQTT.ClientOptions, rxTopic string, txTopic string, opts ...MqttTunnelOption) *MqttClientTunnel {
+	mqttOpts.SetOrderMatters(true)
+	c := MqttClientTunnel{uuid: shortuuid.New(), remotes: make(map[string]*remoteForward)}
+	t := NewTunnel(mqttOpts, rxTopic, txTopic, opts...)
+	t.SetDataCallback(c.onDataRx)
+	c.MqttTunnel = t
+	return &c
+}
+
+func (c *MqttClientTunnel) onDataRx(data MqttJsonTunnel) {
+	if data.ClientUUID != c.uuid {
+		return
+	} else if data.Step == MqttTunnelStep_Result {
+		c.deliverResult(data)
+	} else if data.Step == MqttTunnelStep_Request && data.Cmd == MqttTunnelCommand_Accept {
+		go c.handleAccept(data)
+	}
+}
+
+func (c *MqttClientTunnel) startUpClient() error {
+	if !c.IsRunning() {
+		c.Start()
+		time.Sleep(time.Second)
+	}
+	if !c.worker.IsConnected() {
+		return errors.New("mqtt connection fail")
+	}
+	return nil
+}
+
+// Dial opens a connection from the server node to target, a host:port.
+func (c *MqttClientTunnel) Dial(target string) (*mft.Stream, error) {
+	errConn := c.startUpClient()
+	if errConn != nil {
+		return nil, errConn
+	}
+
+	msg := MqttJsonTunnel{UUID: shortuuid.New(), ClientUUID: c.uuid, Cmd: MqttTunnelCommand_Connect, Target: target}
+	c2s, s2c := c.streamTopics(msg.ClientUUID, msg.UUID)
+	// listening before asking, the server may write first
+	stream, err := mft.NewStream(c.worker, c2s, s2c)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.request(msg)
+	if err != nil {
+		stream.Abort()
+		if res.Denied {
+			return nil, ErrTargetNotAllowed
+		}
+		return nil, err
+	}
+	return stream, nil
+}
+
+// RemoteForward makes the server node listen on listen, carrying every connection
+// to target from here. It returns the address the server listens on.
+func (c *MqttClientTunnel) RemoteForward(listen string, target string) (string, error) {
+	errConn := c.startUpClient()
+	if errConn != nil {
+		return "", errConn
+	}
+
+	msg := MqttJsonTunnel{UUID: shortuuid.New(), ClientUUID: c.uuid, Cmd: MqttTunnelCommand_Listen, Listen: listen}
+	res, err := c.request(msg)
+	if err != nil {
+		return "", err
+	}
+	c.remotesMutex.Lock()
+	// renewals reopen the same port if the server restarted
+	c.remotes[msg.UUID] = &remoteForward{listen: res.Listen, target: target}
+	c.remotesMutex.Unlock()
+	c.renewOnce.Do(func() {
+		go c.renewRemoteForwards()
+	})
+	return res.Listen, nil
+}
+
+// CancelRemoteForwards closes the reverse tunnels on the server.
+func (c *MqttClientTunnel) CancelRemoteForwards() {
+	c.remotesMutex.Lock()
+	uuids := make([]string, 0, len(c.remotes))
+	for uuid := range c.remotes {
+		uuids = append(uuids, uuid)
+	}
+	c.remotes = make(map[string]*remoteForward)
+	c.remotesMutex.Unlock()
+
+	for _, uuid := range uuids {
+		_, err := c.request(MqttJsonTunnel{UUID: uuid, ClientUUID: c.uuid, Cmd: MqttTunnelCommand_Unlisten})
+		if err != nil {
+			log.Errorf("reverse tunnel %s: %s", uuid, err.Error())
+		}
+	}
+}
+
+func (c *MqttClientTunnel) renewRemoteForwards() {
+	ticker := time.NewTicker(defaultListenRenew)
+	for range ticker.C {
+		c.remotesMutex.Lock()
+		msgs := []MqttJsonTunnel{}
+		for uuid, r := range c.remotes {
+			msgs = append(msgs, MqttJsonTunnel{UUID: uuid, ClientUUID: c.uuid, Cmd: MqttTunnelCommand_Listen, Listen: r.listen})
+		}
+		c.remotesMutex.Unlock()
+
+		for _, msg := range msgs {
+			msg.Step = MqttTunnelStep_Request
+			err := c.Transmit(msg)
+			if err != nil {
+				log.Error(err.Error())
+			}
+		}
+	}
+}
+
+// handleAccept opens the connection of a reverse tunnel to its target.
+func (c *MqttClientTunnel) handleAccept(msg MqttJsonTunnel) {
+	c.remotesMutex.Lock()
+	r, exist := c.remotes[msg.Listener]
+	c.remotesMutex.Unlock()
+	if !exist {
+		c.result(msg, errors.New("reverse tunnel not found"))
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", r.target, defaultDialTimeout)
+	if err != nil {
+		c.result(msg, err)
+		return
+	}
+	c2s, s2c := c.streamTopics(msg.ClientUUID, msg.UUID)
+	stream, err := mft.NewStream(c.worker, c2s, s2c)
+	if err != nil {
+		conn.Close()
+		c.result(msg, err)
+		return
+	}
+	log.Infof("connection from %s %s forwarded to %s", r.listen, msg.UUID, r.target)
+	c.result(msg, nil)
+	pipe(conn, stream)
+}
+
+// Forward accepts connections on listener, carrying each one to target from the server node.
+// It returns when the listener is closed.
+func (c *MqttClientTunnel) Forward(listener net.Listener, target string) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			stream, errDial := c.Dial(target)
+			if errDial != nil {
+				log.Errorf("%s not forwarded: %s", conn.RemoteAddr(), errDial.Error())
+				conn.Close()
+				return
+			}
+			log.Infof("%s forwarded to %s", conn.RemoteAddr(), target)
+			pipe(conn, stream)
+		}()
+	}
+}
+
+// ForwardSpec is a local forward, in the ssh -L form [bind:]port:host:hostport.
+type ForwardSpec struct {
+	Listen string
+	Target string
+}
+
+func ParseForwardSpec(spec string) (ForwardSpec, error) {
+	fields := splitSpec(spec)
+	f := ForwardSpec{}
+	switch len(fields) {
+	case 3:
+		f.Listen = net.JoinHostPort("127.0.0.1", fields[0])
+		f.Target = net.JoinHostPort(fields[1], fields[2])
+	case 4:
+		f.Listen = net.JoinHostPort(fields[0], fields[1])
+		f.Target = net.JoinHostPort(fields[2], fields[3])
+	default:
+		return f, errors.New(fmt.Sprintf("%s : expected [bind:]port:host:hostport", spec))
+	}
+	for _, addr := range []string{f.Listen, f.Target} {
+		_, port, _ := net.SplitHostPort(addr)
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 0 || n > 65535 {
+			return f, errors.New(fmt.Sprintf("%s : port %s not valid", spec, port))
+		}
+	}
+	return f, nil
+}
+
+// splitSpec splits on the colons outside of square brackets, so ipv6 addresses can be used.
+func splitSpec(spec string) []string {
+	fields := []string{}
+	depth := 0
+	start := 0
+	for i, r := range spec {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				fields = append(fields, strings.Trim(spec[start:i], "[]"))
+				start = i + 1
+			}
+		}
+	}
+	return append(fields, strings.Trim(spec[start:], "[]"))
+}
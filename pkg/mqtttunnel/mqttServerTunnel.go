@@ -0,0 +1,261 @@
+package mqtttunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp/mft"
+	"github.com/lithammer/shortuuid/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// MqttServerTunnel opens the connections requested by the clients, within its policy,
+// and listens for them on the reverse tunnels.
+type MqttServerTunnel struct {
+	*MqttTunnel
+	mutex          sync.Mutex
+	connections    int
+	maxConnections int
+	policy         *TunnelPolicy
+	listeners      map[string]*reverseListener
+	gatewayPorts   bool
+}
+
+type reverseListener struct {
+	uuid       string
+	clientUUID string
+	listener   net.Listener
+	lastRenew  time.Time
+}
+
+func NewMqttServerTunnel(mqttOpts *MQTT.ClientOptions, rxTopic string, txTopic string, opts ...MqttTunnelOption) *MqttServerTunnel {
+	mqttOpts.SetOrderMatters(true)
+	s := MqttServerTunnel{maxConnections: defaultServerMaxConnections, policy: &TunnelPolicy{},
+		listeners: make(map[string]*reverseListener)}
+	t := NewTunnel(mqttOpts, rxTopic, txTopic, opts...)
+	t.SetDataCallback(s.onDataRx)
+	s.MqttTunnel = t
+
+	go s.closeExpiredListeners()
+	return &s
+}
+
+// SetPolicy sets the targets clients can connect to, nothing is allowed by default.
+func (s *MqttServerTunnel) SetPolicy(policy *TunnelPolicy) {
+	if policy != nil {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.policy = policy
+	}
+}
+
+func (s *MqttServerTunnel) getPolicy() *TunnelPolicy {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.policy
+}
+
+// SetMaxConnections limits the connections open at the same time.
+func (s *MqttServerTunnel) SetMaxConnections(max int) {
+	if max > 0 {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.maxConnections = max
+	}
+}
+
+// SetGatewayPorts lets the reverse tunnels listen on addresses other than loopback.
+func (s *MqttServerTunnel) SetGatewayPorts(enable bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.gatewayPorts = enable
+}
+
+func (s *MqttServerTunnel) onDataRx(data MqttJsonTunnel) {
+	if data.ClientUUID == "" || data.UUID == "" {
+		log.Error("tunnel request without uuid")
+	} else if data.Step == MqttTunnelStep_Result {
+		s.deliverResult(data)
+	} else if data.Step != MqttTunnelStep_Request {
+		return
+	} else if data.Cmd == MqttTunnelCommand_Connect {
+		// dialing takes time, the mqtt handlers must not block
+		go s.handleConnect(data)
+	} else if data.Cmd == MqttTunnelCommand_Listen {
+		go func() {
+			listen, err := s.listen(data)
+			data.Listen = listen
+			s.result(data, err)
+		}()
+	} else if data.Cmd == MqttTunnelCommand_Unlisten {
+		s.result(data, s.unlisten(data))
+	} else {
+		s.result(data, errors.New("unhandled tunnel command"))
+	}
+}
+
+func (s *MqttServerTunnel) acquire() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.connections >= s.maxConnections {
+		return false
+	}
+	s.connections++
+	return true
+}
+
+func (s *MqttServerTunnel) release() {
+	s.mutex.Lock()
+	s.connections--
+	s.mutex.Unlock()
+}
+
+func (s *MqttServerTunnel) handleConnect(msg MqttJsonTunnel) {
+	if !s.acquire() {
+		s.result(msg, errors.New("server busy, try again"))
+		return
+	}
+	defer s.release()
+
+	addr, err := s.getPolicy().Check(msg.Target)
+	if err != nil {
+		msg.Denied = errors.Is(err, ErrTargetNotAllowed)
+		s.result(msg, err)
+		return
+	}
+	conn, err := net.DialTimeout("tcp", addr, defaultDialTimeout)
+	if err != nil {
+		s.result(msg, err)
+		return
+	}
+	c2s, s2c := s.streamTopics(msg.ClientUUID, msg.UUID)
+	stream, err := mft.NewStream(s.worker, s2c, c2s)
+	if err != nil {
+		conn.Close()
+		s.result(msg, err)
+		return
+	}
+
+	log.Infof("tunnel %s of %s to %s opened", msg.UUID, msg.ClientUUID, msg.Target)
+	s.result(msg, nil)
+	pipe(conn, stream)
+	log.Infof("tunnel %s closed", msg.UUID)
+}
+
+// listen opens a reverse listener, or renews it if it exists, returning its address.
+func (s *MqttServerTunnel) listen(msg MqttJsonTunnel) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	l, exist := s.listeners[msg.UUID]
+	if exist {
+		if l.clientUUID != msg.ClientUUID {
+			return "", errors.New("listener of another client")
+		}
+		l.lastRenew = time.Now()
+		return l.listener.Addr().String(), nil
+	}
+
+	if len(s.listeners) >= defaultServerMaxListeners {
+		return "", errors.New("too many listeners")
+	}
+	err := s.checkListenAddress(msg.Listen)
+	if err != nil {
+		return "", err
+	}
+	listener, err := net.Listen("tcp", msg.Listen)
+	if err != nil {
+		return "", err
+	}
+	l = &reverseListener{uuid: msg.UUID, clientUUID: msg.ClientUUID, listener: listener, lastRenew: time.Now()}
+	s.listeners[msg.UUID] = l
+	log.Infof("reverse tunnel %s of %s listening on %s", l.uuid, l.clientUUID, listener.Addr())
+	go s.accept(l)
+	return listener.Addr().String(), nil
+}
+
+func (s *MqttServerTunnel) checkListenAddress(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if s.gatewayPorts {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return nil
+	}
+	return errors.New(fmt.Sprintf("%s : only loopback addresses allowed", addr))
+}
+
+func (s *MqttServerTunnel) unlisten(msg MqttJsonTunnel) error {
+	s.mutex.Lock()
+	l, exist := s.listeners[msg.UUID]
+	if !exist || l.clientUUID != msg.ClientUUID {
+		s.mutex.Unlock()
+		return errors.New("listener not found")
+	}
+	delete(s.listeners, msg.UUID)
+	s.mutex.Unlock()
+
+	log.Infof("reverse tunnel %s closed", l.uuid)
+	return l.listener.Close()
+}
+
+func (s *MqttServerTunnel) closeExpiredListeners() {
+	ticker := time.NewTicker(defaultListenRenew)
+	for range ticker.C {
+		s.mutex.Lock()
+		for k, l := range s.listeners {
+			if time.Since(l.lastRenew) > defaultListenExpiry {
+				log.Infof("reverse tunnel %s of %s expired", l.uuid, l.clientUUID)
+				l.listener.Close()
+				delete(s.listeners, k)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+func (s *MqttServerTunnel) accept(l *reverseListener) {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleAccept(l, conn)
+	}
+}
+
+// handleAccept carries a connection of a reverse listener to its client.
+func (s *MqttServerTunnel) handleAccept(l *reverseListener, conn net.Conn) {
+	if !s.acquire() {
+		log.Errorf("reverse tunnel %s: connection from %s refused, server busy", l.uuid, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	defer s.release()
+
+	msg := MqttJsonTunnel{UUID: shortuuid.New(), ClientUUID: l.clientUUID, Cmd: MqttTunnelCommand_Accept, Listener: l.uuid}
+	c2s, s2c := s.streamTopics(msg.ClientUUID, msg.UUID)
+	stream, err := mft.NewStream(s.worker, s2c, c2s)
+	if err != nil {
+		log.Error(err.Error())
+		conn.Close()
+		return
+	}
+	_, err = s.request(msg)
+	if err != nil {
+		log.Errorf("reverse tunnel %s: connection from %s not forwarded: %s", l.uuid, conn.RemoteAddr(), err.Error())
+		stream.Abort()
+		conn.Close()
+		return
+	}
+	log.Infof("reverse tunnel %s: connection %s from %s opened", l.uuid, msg.UUID, conn.RemoteAddr())
+	pipe(conn, stream)
+	log.Infof("tunnel %s closed", msg.UUID)
+}
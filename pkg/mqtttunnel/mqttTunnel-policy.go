@@ -0,0 +1,178 @@
+package mqtttunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// TunnelPolicy is the list of targets a server opens connections to.
+// Each rule is host:port: the host a glob on the name or ip as requested, or a cidr
+// matched against the resolved addresses; the port a number, a range low-high or *.
+// Deny rules win over allow ones; an empty policy allows nothing.
+type TunnelPolicy struct {
+	allow []policyRule
+	deny  []policyRule
+}
+
+type policyRule struct {
+	host     string
+	network  *net.IPNet
+	portLow  int
+	portHigh int
+}
+
+func NewTunnelPolicy(allow []string, deny []string) (*TunnelPolicy, error) {
+	p := TunnelPolicy{}
+	for _, r := range allow {
+		rule, err := parsePolicyRule(r)
+		if err != nil {
+			return nil, err
+		}
+		p.allow = append(p.allow, rule)
+	}
+	for _, r := range deny {
+		rule, err := parsePolicyRule(r)
+		if err != nil {
+			return nil, err
+		}
+		p.deny = append(p.deny, rule)
+	}
+	return &p, nil
+}
+
+func parsePolicyRule(r string) (policyRule, error) {
+	rule := policyRule{}
+	i := strings.LastIndex(r, ":")
+	if i <= 0 {
+		return rule, errors.New(fmt.Sprintf("rule %s : must be host:port", r))
+	}
+	host, port := strings.Trim(r[:i], "[]"), r[i+1:]
+
+	if strings.Contains(host, "/") {
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return rule, errors.New(fmt.Sprintf("rule %s : %s", r, err.Error()))
+		}
+		rule.network = network
+	} else {
+		_, err := path.Match(host, "")
+		if err != nil {
+			return rule, errors.New(fmt.Sprintf("rule %s : %s", r, err.Error()))
+		}
+		rule.host = strings.ToLower(host)
+	}
+
+	var err error
+	if port == "*" {
+		rule.portLow, rule.portHigh = 1, 65535
+	} else if low, high, found := strings.Cut(port, "-"); found {
+		rule.portLow, err = strconv.Atoi(low)
+		if err == nil {
+			rule.portHigh, err = strconv.Atoi(high)
+		}
+	} else {
+		rule.portLow, err = strconv.Atoi(port)
+		rule.portHigh = rule.portLow
+	}
+	if err != nil || rule.portLow < 1 || rule.portHigh > 65535 || rule.portLow > rule.portHigh {
+		return rule, errors.New(fmt.Sprintf("rule %s : port not valid", r))
+	}
+	return rule, nil
+}
+
+// Check returns the address to dial for target, or an error if the policy refuses it.
+// When some rule is a cidr the address is a resolved ip, so the name can not
+// resolve differently at dial time.
+func (p *TunnelPolicy) Check(target string) (string, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return "", errors.New(fmt.Sprintf("%s : port not valid", target))
+	}
+	name := strings.ToLower(host)
+
+	ips := []net.IP{}
+	if p.hasNetworks() {
+		ips, err = resolve(host)
+		if err != nil {
+			return "", err
+		}
+	}
+	allowed := []net.IP{}
+	for _, ip := range ips {
+		if !matchAny(p.deny, name, ip, port) {
+			allowed = append(allowed, ip)
+		}
+	}
+	if matchAny(p.deny, name, nil, port) || len(ips) > 0 && len(allowed) == 0 {
+		return "", fmt.Errorf("%s : %w", target, ErrTargetNotAllowed)
+	}
+
+	for _, rule := range p.allow {
+		if !rule.matchPort(port) {
+			continue
+		}
+		if rule.network == nil && rule.matchName(name) {
+			if len(allowed) > 0 {
+				return net.JoinHostPort(allowed[0].String(), portStr), nil
+			}
+			return target, nil
+		}
+		for _, ip := range allowed {
+			if rule.network != nil && rule.network.Contains(ip) {
+				return net.JoinHostPort(ip.String(), portStr), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s : %w", target, ErrTargetNotAllowed)
+}
+
+func (p *TunnelPolicy) hasNetworks() bool {
+	for _, rules := range [][]policyRule{p.allow, p.deny} {
+		for _, rule := range rules {
+			if rule.network != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r policyRule) matchPort(port int) bool {
+	return port >= r.portLow && port <= r.portHigh
+}
+
+func (r policyRule) matchName(name string) bool {
+	matched, _ := path.Match(r.host, name)
+	return matched
+}
+
+// matchAny tells if one of the rules matches the name or, when given, the ip.
+func matchAny(rules []policyRule, name string, ip net.IP, port int) bool {
+	for _, rule := range rules {
+		if !rule.matchPort(port) {
+			continue
+		}
+		if ip == nil && rule.network == nil && rule.matchName(name) {
+			return true
+		} else if ip != nil && rule.network != nil && rule.network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func resolve(host string) ([]net.IP, error) {
+	ip := net.ParseIP(host)
+	if ip != nil {
+		return []net.IP{ip}, nil
+	}
+	return net.LookupIP(host)
+}
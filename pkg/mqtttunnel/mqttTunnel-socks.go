@@ -0,0 +1,155 @@
+package mqtttunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A minimal SOCKS5 server (rfc 1928): no authentication and CONNECT only.
+// Names are resolved by the server node, so names of its network can be used.
+
+const (
+	socksVersion          = 5
+	socksMethodNoAuth     = 0
+	socksMethodNoAccept   = 0xff
+	socksCmdConnect       = 1
+	socksAddrIPv4         = 1
+	socksAddrDomain       = 3
+	socksAddrIPv6         = 4
+	socksReplySucceeded   = 0
+	socksReplyFailure     = 1
+	socksReplyNotAllowed  = 2
+	socksReplyCmdNotSup   = 7
+	socksReplyAddrNotSup  = 8
+	socksHandshakeTimeout = 10 * time.Second
+)
+
+// ServeSocks accepts SOCKS5 connections on listener, opening them from the server node.
+// It returns when the listener is closed.
+func (c *MqttClientTunnel) ServeSocks(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go c.handleSocks(conn)
+	}
+}
+
+func (c *MqttClientTunnel) handleSocks(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	target, err := socksHandshake(conn)
+	if err != nil {
+		log.Errorf("socks %s: %s", conn.RemoteAddr(), err.Error())
+		conn.Close()
+		return
+	}
+
+	stream, err := c.Dial(target)
+	if err != nil {
+		log.Errorf("socks %s to %s: %s", conn.RemoteAddr(), target, err.Error())
+		reply := byte(socksReplyFailure)
+		if errors.Is(err, ErrTargetNotAllowed) {
+			reply = socksReplyNotAllowed
+		}
+		socksReply(conn, reply)
+		conn.Close()
+		return
+	}
+	err = socksReply(conn, socksReplySucceeded)
+	if err != nil {
+		stream.Abort()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	log.Infof("socks %s to %s", conn.RemoteAddr(), target)
+	pipe(conn, stream)
+}
+
+// socksHandshake negotiates the method and reads the request, returning its host:port.
+func socksHandshake(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return "", err
+	} else if header[0] != socksVersion {
+		return "", errors.New(fmt.Sprintf("socks version %d not supported", header[0]))
+	}
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return "", err
+	}
+	method := byte(socksMethodNoAccept)
+	for _, m := range methods {
+		if m == socksMethodNoAuth {
+			method = socksMethodNoAuth
+		}
+	}
+	_, err = conn.Write([]byte{socksVersion, method})
+	if err != nil {
+		return "", err
+	} else if method == socksMethodNoAccept {
+		return "", errors.New("client requires authentication")
+	}
+
+	request := make([]byte, 4)
+	_, err = io.ReadFull(conn, request)
+	if err != nil {
+		return "", err
+	} else if request[0] != socksVersion {
+		return "", errors.New("socks request not valid")
+	} else if request[1] != socksCmdConnect {
+		socksReply(conn, socksReplyCmdNotSup)
+		return "", errors.New(fmt.Sprintf("socks command %d not supported", request[1]))
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		size := net.IPv4len
+		if request[3] == socksAddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		_, err = io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case socksAddrDomain:
+		size := make([]byte, 1)
+		_, err = io.ReadFull(conn, size)
+		if err == nil {
+			name := make([]byte, size[0])
+			_, err = io.ReadFull(conn, name)
+			host = string(name)
+		}
+	default:
+		socksReply(conn, socksReplyAddrNotSup)
+		return "", errors.New(fmt.Sprintf("socks address type %d not supported", request[3]))
+	}
+	if err != nil {
+		return "", err
+	}
+	port := make([]byte, 2)
+	_, err = io.ReadFull(conn, port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksReply answers a request, the bound address is not known on this side.
+func socksReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socksVersion, reply, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,249 @@
+package mqtttunnel
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqtt"
+	"github.com/freedreamer82/mqtt-shell/pkg/mqttcp/mft"
+	log "github.com/sirupsen/logrus"
+)
+
+// Every tunneled connection is an mft.Stream on its own topic pair, all of them
+// sharing the mqtt connection of the node. The command topics only carry the requests
+// opening the connections.
+
+const (
+	MqttTunnelCommand_Connect = "connect"
+	// reverse tunnels: the server listens and the connections are opened from the client
+	MqttTunnelCommand_Listen   = "listen"
+	MqttTunnelCommand_Unlisten = "unlisten"
+	MqttTunnelCommand_Accept   = "accept"
+)
+
+const (
+	MqttTunnelStep_Request = "request"
+	MqttTunnelStep_Result  = "result"
+)
+
+const (
+	defaultRequestTimeout       = 10 * time.Second
+	defaultDialTimeout          = 5 * time.Second
+	defaultServerMaxConnections = 32
+	defaultServerMaxListeners   = 8
+	// a reverse listener is closed when its client stops renewing it
+	defaultListenRenew  = 10 * time.Second
+	defaultListenExpiry = 3 * defaultListenRenew
+)
+
+const (
+	MqttTunnelStreamTopic = "/mft-tunnel/%s/%s"
+)
+
+var ErrTargetNotAllowed = errors.New("target not allowed by the server")
+
+type MqttJsonTunnel struct {
+	UUID       string `json:"uuid"`
+	ClientUUID string `json:"clientuuid"`
+	Cmd        string `json:"cmd"`
+	Step       string `json:"step"`
+	// host:port the connection is opened to
+	Target string `json:"target"`
+	// address of a reverse listener on the server
+	Listen string `json:"listen,omitempty"`
+	// uuid of the reverse listener a connection comes from
+	Listener string `json:"listener,omitempty"`
+	// the target was refused by the server policy
+	Denied bool   `json:"denied,omitempty"`
+	Ts     int64  `json:"ts"`
+	Error  string `json:"error"`
+}
+
+// streamTopics returns the topics of a connection, from client to server and back.
+func (t *MqttTunnel) streamTopics(clientUUID, connUUID string) (string, string) {
+	base := fmt.Sprintf(t.streamTopic, clientUUID, connUUID)
+	return base + "/c2s", base + "/s2c"
+}
+
+type OnDataCallback func(data MqttJsonTunnel)
+
+type MqttTunnel struct {
+	worker    *mqtt.Worker
+	Cb        OnDataCallback
+	txTopic   string
+	rxTopic   string
+	isRunning bool
+	// requests waiting for their result
+	pending      map[string]chan MqttJsonTunnel
+	pendingMutex sync.Mutex
+	// topic of the connection data, see WithOptionStreamTopic
+	streamTopic string
+}
+
+type MqttTunnelOption func(*MqttTunnel)
+
+func WithOptionMqttWorker(worker *mqtt.Worker) MqttTunnelOption {
+	return func(t *MqttTunnel) {
+		t.worker = worker
+	}
+}
+
+// WithOptionStreamTopic sets the base topic of the connection data, a fmt template taking the
+// client and the connection uuid (MqttTunnelStreamTopic by default). Client and server must use the same one.
+func WithOptionStreamTopic(template string) MqttTunnelOption {
+	return func(t *MqttTunnel) {
+		t.streamTopic = template
+	}
+}
+
+func NewTunnel(mqttOpts *MQTT.ClientOptions, rxTopic string, txTopic string, opts ...MqttTunnelOption) *MqttTunnel {
+	t := MqttTunnel{rxTopic: rxTopic, txTopic: txTopic, pending: make(map[string]chan MqttJsonTunnel),
+		streamTopic: MqttTunnelStreamTopic}
+	for _, opt := range opts {
+		opt(&t)
+	}
+	if t.worker == nil {
+		t.worker = mqtt.NewWorker(mqttOpts, true, nil)
+	}
+
+	t.worker.AddConnectionCB(
+		func(status mqtt.ConnectionStatus) {
+			if status == mqtt.ConnectionStatus_Connected {
+				t.worker.Subscribe(t.rxTopic, t.onBrokerData)
+			}
+		},
+	)
+	if t.worker.IsConnected() {
+		t.worker.Subscribe(t.rxTopic, t.onBrokerData)
+	}
+	return &t
+}
+
+func (t *MqttTunnel) SetDataCallback(cb OnDataCallback) {
+	t.Cb = cb
+}
+
+func (t *MqttTunnel) Start() {
+	t.isRunning = true
+	t.worker.StartMQTT()
+}
+
+func (t *MqttTunnel) IsRunning() bool {
+	return t.isRunning
+}
+
+func (t *MqttTunnel) Stop() {
+	t.worker.Unsubscribe(t.rxTopic)
+	t.isRunning = false
+	t.worker.StopMQTT()
+}
+
+func (t *MqttTunnel) Transmit(msg MqttJsonTunnel) error {
+	msg.Ts = time.Now().UnixMilli()
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	t.worker.Publish(t.txTopic, base64.StdEncoding.EncodeToString(b))
+	return nil
+}
+
+func (t *MqttTunnel) onBrokerData(client MQTT.Client, msg MQTT.Message) {
+	raw, err := base64.StdEncoding.DecodeString(string(msg.Payload()))
+	if err != nil {
+		log.Errorf("tunnel message not valid: %s", err.Error())
+		return
+	}
+	data := MqttJsonTunnel{}
+	err = json.Unmarshal(raw, &data)
+	if err != nil {
+		log.Errorf("unmarshall error: %s", err.Error())
+	} else if t.Cb != nil {
+		t.Cb(data)
+	}
+}
+
+// request sends msg and waits for the result of the other side.
+func (t *MqttTunnel) request(msg MqttJsonTunnel) (MqttJsonTunnel, error) {
+	res := make(chan MqttJsonTunnel, 1)
+	t.pendingMutex.Lock()
+	t.pending[msg.UUID] = res
+	t.pendingMutex.Unlock()
+	defer func() {
+		t.pendingMutex.Lock()
+		delete(t.pending, msg.UUID)
+		t.pendingMutex.Unlock()
+	}()
+
+	msg.Step = MqttTunnelStep_Request
+	err := t.Transmit(msg)
+	if err != nil {
+		return msg, err
+	}
+	select {
+	case data := <-res:
+		if data.Error != "" {
+			return data, errors.New(data.Error)
+		}
+		return data, nil
+	case <-time.After(defaultRequestTimeout):
+		return msg, errors.New("timeout, no answer")
+	}
+}
+
+// deliverResult hands a result to the request waiting for it.
+func (t *MqttTunnel) deliverResult(data MqttJsonTunnel) {
+	t.pendingMutex.Lock()
+	res, exist := t.pending[data.UUID]
+	t.pendingMutex.Unlock()
+	if exist {
+		select {
+		case res <- data:
+		default:
+		}
+	}
+}
+
+func (t *MqttTunnel) result(msg MqttJsonTunnel, err error) {
+	msg.Step = MqttTunnelStep_Result
+	if err != nil {
+		log.Errorf("tunnel %s %s: %s", msg.Cmd, msg.UUID, err.Error())
+		msg.Error = err.Error()
+	}
+	errT := t.Transmit(msg)
+	if errT != nil {
+		log.Error(errT.Error())
+	}
+}
+
+// pipe copies between conn and stream until both sides are done, then closes them.
+func pipe(conn net.Conn, stream *mft.Stream) {
+	done := make(chan bool)
+	go func() {
+		io.Copy(stream, conn)
+		stream.CloseWrite()
+		close(done)
+	}()
+
+	_, err := io.Copy(conn, stream)
+	if err != nil {
+		log.Debugf("tunnel connection %s broken: %s", conn.RemoteAddr(), err.Error())
+		conn.Close()
+		stream.Abort()
+		<-done
+		return
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+	<-done
+	stream.Close()
+	conn.Close()
+}